@@ -1,45 +1,183 @@
 package main
 
 import (
+	"crypto/tls"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Sinea/loadr/pkg/loadr"
 	"github.com/Sinea/loadr/pkg/loadr/backend"
 	"github.com/Sinea/loadr/pkg/loadr/channels"
 	"github.com/Sinea/loadr/pkg/loadr/clients"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/Sinea/loadr/pkg/loadr/ratelimit"
 	"github.com/Sinea/loadr/pkg/loadr/stores"
+	"github.com/Sinea/loadr/pkg/loadr/tickets"
 )
 
 func main() {
+	logger := log.New(os.Stdout, "", 0)
 	channelConfig := getChannelConfig()
 	channel := channels.New(channelConfig)
-	store := getStore()
-	s := loadr.New(store, channel)
+	store := getStore(channel)
+	s := loadr.New(store, channel, logger)
+	for tenant, limits := range getTenantLimits() {
+		s.SetTenantLimits(tenant, limits)
+	}
 
 	backendConfig, clientsConfig := getConfigs()
+	backendConfig.RateLimits = getRateLimits(channels.RedisPool(channel))
 
-	b := backend.New(backendConfig)
-	f := clients.New(clientsConfig, log.New(os.Stdout, "", 0))
+	b, err := backend.New(backendConfig)
+	if err != nil {
+		log.Fatalf("invalid backend config: %s", err)
+	}
+	f := clients.New(clientsConfig, logger)
 
 	s.Run(b, f)
 
+	if cache, ok := store.(stores.CacheStatsProvider); ok {
+		go logCacheStats(cache, getDuration("CACHE_STATS_INTERVAL"))
+	}
+
+	go closeOnSignal(store)
+
 	for {
 		log.Println(<-s.Errors())
 	}
 }
 
+// closeOnSignal closes the store on SIGINT or SIGTERM, flushing the progresses
+// it saves in the background, and exits
+func closeOnSignal(store loadr.Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("error closing store: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
+
 func getChannelConfig() interface{} {
-	redis := os.Getenv("REDIS")
-	if strings.TrimSpace(redis) != "" {
-		return channels.RedisConfig{Address: redis}
+	channelCodec := getCodec("CODEC")
+	if redis, ok := getRedisConfig(); ok {
+		redis.Codec = channelCodec
+		if stream := strings.TrimSpace(os.Getenv("REDIS_STREAM")); stream != "" {
+			return channels.RedisStreamConfig{
+				RedisConfig: redis,
+				Stream:      stream,
+				Node:        getNodeName(),
+			}
+		}
+		redis.PerToken = getBool("REDIS_PER_TOKEN")
+		redis.Shards = getInt("REDIS_SHARDS")
+		redis.Sharded = getBool("REDIS_SHARDED")
+		if redis.Sharded && redis.PerToken {
+			log.Fatal("REDIS_PER_TOKEN can't be used with REDIS_SHARDED, use REDIS_SHARDS")
+		}
+		return redis
+	}
+	if nats := strings.TrimSpace(os.Getenv("NATS")); nats != "" {
+		return channels.NatsConfig{
+			URL:       nats,
+			Subject:   os.Getenv("NATS_SUBJECT"),
+			PerToken:  getBool("NATS_PER_TOKEN"),
+			Shards:    getInt("NATS_SHARDS"),
+			Interest:  getBool("NATS_INTEREST"),
+			Queue:     os.Getenv("NATS_QUEUE"),
+			JetStream: getBool("NATS_JETSTREAM"),
+			Stream:    os.Getenv("NATS_STREAM"),
+			Codec:     channelCodec,
+		}
+	}
+	if amqp := strings.TrimSpace(os.Getenv("AMQP")); amqp != "" {
+		return channels.AmqpConfig{
+			URL:      amqp,
+			Exchange: os.Getenv("AMQP_EXCHANGE"),
+			Topic:    getBool("AMQP_TOPIC"),
+			Codec:    channelCodec,
+		}
+	}
+	if postgres := strings.TrimSpace(os.Getenv("POSTGRES")); postgres != "" {
+		return channels.PostgresConfig{
+			DSN:     postgres,
+			Channel: os.Getenv("POSTGRES_CHANNEL"),
+			Codec:   channelCodec,
+		}
+	}
+	if peers, dns := splitList(os.Getenv("PEERS")), strings.TrimSpace(os.Getenv("PEER_DNS")); len(peers) > 0 || dns != "" {
+		config := channels.PeerConfig{
+			Address: os.Getenv("PEER_ADDRESS"),
+			Peers:   peers,
+			DNS:     dns,
+			Node:    getNodeName(),
+			Codec:   channelCodec,
+		}
+		if secret := os.Getenv("PEER_SECRET"); secret != "" {
+			config.Secret = []byte(secret)
+		}
+		return config
 	}
-	// Maybe rabbit? Someday...
 	return nil
 }
 
-func getConfigs() (backendCfg, frontendCfg loadr.NetConfig) {
+// getRedisConfig from REDIS, or REDIS_SENTINELS and REDIS_MASTER, or REDIS_CLUSTER.
+// It reports whether any of them is set.
+func getRedisConfig() (channels.RedisConfig, bool) {
+	config := channels.RedisConfig{
+		Address:           strings.TrimSpace(os.Getenv("REDIS")),
+		Username:          os.Getenv("REDIS_USERNAME"),
+		Password:          os.Getenv("REDIS_PASSWORD"),
+		Database:          getInt("REDIS_DB"),
+		SentinelAddresses: splitList(os.Getenv("REDIS_SENTINELS")),
+		SentinelMaster:    os.Getenv("REDIS_MASTER"),
+		SentinelUsername:  os.Getenv("REDIS_SENTINEL_USERNAME"),
+		SentinelPassword:  os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		ClusterAddresses:  splitList(os.Getenv("REDIS_CLUSTER")),
+	}
+	if getBool("REDIS_TLS") {
+		config.TLS = &tls.Config{ServerName: os.Getenv("REDIS_TLS_SERVER_NAME")}
+	}
+	if len(config.SentinelAddresses) > 0 && strings.TrimSpace(config.SentinelMaster) == "" {
+		log.Fatal("REDIS_MASTER is required with REDIS_SENTINELS")
+	}
+	set := config.Address != "" || len(config.SentinelAddresses) > 0 || len(config.ClusterAddresses) > 0
+	return config, set
+}
+
+// getCodec named by an environment variable, JSON by default
+func getCodec(name string) codec.Codec {
+	c, err := codec.ByName(os.Getenv(name))
+	if err != nil {
+		log.Fatalf("invalid %s: %s", name, err)
+	}
+	return c
+}
+
+// getNodeName from NODE_NAME, defaults to the host name
+func getNodeName() string {
+	if name := strings.TrimSpace(os.Getenv("NODE_NAME")); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("error getting host name: %s", err)
+	}
+	return name
+}
+
+func getConfigs() (backendCfg backend.Config, clientsCfg clients.Config) {
 	b := os.Getenv("BACKEND")
 	c := os.Getenv("CLIENTS")
 
@@ -47,25 +185,231 @@ func getConfigs() (backendCfg, frontendCfg loadr.NetConfig) {
 		log.Fatal("invalid backend address")
 	}
 
-	if strings.TrimSpace(b) == "" {
+	if strings.TrimSpace(c) == "" {
 		log.Fatal("invalid client address")
 	}
 
-	return loadr.NetConfig{Address: b}, loadr.NetConfig{Address: c}
+	backendCfg.Address = b
+	backendCfg.Timeout = getDuration("BACKEND_TIMEOUT")
+	clientsCfg.Address = c
+	clientsCfg.AllowedOrigins = splitList(os.Getenv("ALLOWED_ORIGINS"))
+	clientsCfg.MaxConnections = getInt("MAX_CONNECTIONS")
+	clientsCfg.MaxConnectionsPerIP = getInt("MAX_CONNECTIONS_PER_IP")
+	clientsCfg.TrustedProxies = splitList(os.Getenv("TRUSTED_PROXIES"))
+	clientsCfg.MaxSubscribersPerToken = getInt("MAX_SUBSCRIBERS_PER_TOKEN")
+	clientsCfg.PingInterval = getDuration("PING_INTERVAL")
+	clientsCfg.PongTimeout = getDuration("PONG_TIMEOUT")
+	for _, name := range splitList(os.Getenv("CLIENT_CODECS")) {
+		c, err := codec.ByName(name)
+		if err != nil {
+			log.Fatalf("invalid CLIENT_CODECS: %s", err)
+		}
+		clientsCfg.Codecs = append(clientsCfg.Codecs, c)
+	}
+
+	if secret := os.Getenv("TICKET_SECRET"); secret != "" {
+		signer, err := tickets.New([]byte(secret))
+		if err != nil {
+			log.Fatalf("invalid TICKET_SECRET: %s", err)
+		}
+		backendCfg.Tickets = signer
+		backendCfg.MaxTicketTTL = getDuration("MAX_TICKET_TTL")
+		clientsCfg.Tickets = signer
+	}
+
+	backendCfg.APIKeys = getAPIKeys()
+
+	return backendCfg, clientsCfg
 }
 
-func getStore() loadr.Store {
+// getAPIKeys parses API_KEYS formatted as "key=tenant,key=tenant"
+func getAPIKeys() map[string]loadr.Tenant {
+	keys := make(map[string]loadr.Tenant)
+	for _, pair := range splitList(os.Getenv("API_KEYS")) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid api key definition '%s'", pair)
+		}
+		keys[parts[0]] = loadr.Tenant(parts[1])
+	}
+	return keys
+}
+
+// getTenantLimits parses TENANT_LIMITS formatted as
+// "tenant:maxTokens:updatesPerSecond:maxSubscribers,..." where 0 means unlimited.
+// TENANT_TOKEN_IDLE_TIMEOUT applies to all of them.
+func getTenantLimits() map[loadr.Tenant]loadr.TenantLimits {
+	limits := make(map[loadr.Tenant]loadr.TenantLimits)
+	idle := getDuration("TENANT_TOKEN_IDLE_TIMEOUT")
+	for _, definition := range splitList(os.Getenv("TENANT_LIMITS")) {
+		parts := strings.Split(definition, ":")
+		if len(parts) != 4 {
+			log.Fatalf("invalid tenant limits '%s'", definition)
+		}
+		tokens, err1 := strconv.Atoi(parts[1])
+		rate, err2 := strconv.ParseFloat(parts[2], 64)
+		subscribers, err3 := strconv.Atoi(parts[3])
+		if err1 != nil || err2 != nil || err3 != nil {
+			log.Fatalf("invalid tenant limits '%s'", definition)
+		}
+		limits[loadr.Tenant(parts[0])] = loadr.TenantLimits{
+			MaxTokens:        tokens,
+			TokenIdleTimeout: idle,
+			Updates:          ratelimit.Limit{Rate: rate},
+			MaxSubscribers:   subscribers,
+		}
+	}
+	return limits
+}
+
+// getRateLimits parses RATE_LIMIT_GLOBAL, RATE_LIMIT_KEY and RATE_LIMIT_TOKEN formatted as "rate:burst".
+// Limits are shared through Redis when the Redis channel is configured.
+func getRateLimits(pool ratelimit.Pool) backend.RateLimits {
+	limiter := func(name, prefix string) ratelimit.Limiter {
+		value := strings.TrimSpace(os.Getenv(name))
+		if value == "" {
+			return nil
+		}
+		parts := strings.Split(value, ":")
+		rate, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || len(parts) > 2 {
+			log.Fatalf("invalid %s '%s'", name, value)
+		}
+		limit := ratelimit.Limit{Rate: rate}
+		if len(parts) == 2 {
+			if limit.Burst, err = strconv.Atoi(parts[1]); err != nil {
+				log.Fatalf("invalid %s '%s'", name, value)
+			}
+		}
+		if pool != nil {
+			return ratelimit.NewRedis(pool, "loadr:ratelimit:"+prefix+":", limit)
+		}
+		return ratelimit.NewMemory(limit)
+	}
+
+	return backend.RateLimits{
+		Global:   limiter("RATE_LIMIT_GLOBAL", "global"),
+		PerKey:   limiter("RATE_LIMIT_KEY", "key"),
+		PerToken: limiter("RATE_LIMIT_TOKEN", "token"),
+	}
+}
+
+// getInt from an environment variable, 0 when unset
+func getInt(name string) int {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %s", name, err)
+	}
+	return i
+}
+
+// getBool from an environment variable, false when unset
+func getBool(name string) bool {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %s", name, err)
+	}
+	return b
+}
+
+// getDuration from an environment variable, 0 when unset
+func getDuration(name string) time.Duration {
+	value := strings.TrimSpace(os.Getenv(name))
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("invalid %s: %s", name, err)
+	}
+	return d
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// logCacheStats at an interval, if any
+func logCacheStats(cache stores.CacheStatsProvider, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		stats := cache.CacheStats()
+		log.Printf("cache: %d hits, %d misses, %d evictions, %d entries\n", stats.Hits, stats.Misses, stats.Evictions, stats.Entries)
+	}
+}
+
+// getStore configured by the environment. REDIS_STORE=channel shares the deployment
+// of the Redis channel, saving and publishing progresses in a single round trip.
+func getStore(channel loadr.Channel) loadr.Store {
 	var config interface{}
 
-	mongo := strings.TrimSpace(os.Getenv("MONGO"))
-	if mongo != "" {
+	mongo, mongoURI := strings.TrimSpace(os.Getenv("MONGO")), strings.TrimSpace(os.Getenv("MONGO_URI"))
+	if mongo != "" || mongoURI != "" {
 		config = stores.MongoConfig{
+			URI:        mongoURI,
 			Address:    mongo,
 			User:       os.Getenv("MONGO_USER"),
 			Pass:       os.Getenv("MONGO_PASS"),
 			Database:   os.Getenv("MONGO_DATABASE"),
 			Collection: os.Getenv("MONGO_COLLECTION"),
+			Timeout:    getDuration("MONGO_TIMEOUT"),
+			TTL:        getDuration("MONGO_TTL"),
+		}
+	} else if postgres := strings.TrimSpace(os.Getenv("POSTGRES")); postgres != "" {
+		config = stores.PostgresConfig{
+			DSN:   postgres,
+			Table: os.Getenv("POSTGRES_TABLE"),
+			TTL:   getDuration("POSTGRES_TTL"),
+		}
+	} else if redis := strings.TrimSpace(os.Getenv("REDIS_STORE")); redis != "" {
+		redisConfig := stores.RedisConfig{
+			Prefix: os.Getenv("REDIS_STORE_PREFIX"),
+			TTL:    getDuration("REDIS_STORE_TTL"),
 		}
+		if redis == "channel" {
+			pool := channels.RedisPool(channel)
+			if pool == nil {
+				log.Fatal("REDIS_STORE=channel needs the Redis channel")
+			}
+			redisConfig.Pool = pool
+			redisConfig.Publisher = channels.RedisPublisher(channel)
+		} else {
+			// A server of its own, with the channel's credentials and TLS settings
+			connection, _ := getRedisConfig()
+			connection.Address = redis
+			connection.SentinelAddresses = nil
+			connection.ClusterAddresses = nil
+			redisConfig.Connection = connection
+		}
+		config = redisConfig
+	} else if bolt := strings.TrimSpace(os.Getenv("BOLT")); bolt != "" {
+		config = stores.BoltConfig{
+			Path: bolt,
+			TTL:  getDuration("BOLT_TTL"),
+		}
+	}
+
+	if interval, batch := getDuration("WRITE_BEHIND_INTERVAL"), getInt("WRITE_BEHIND_BATCH"); interval > 0 || batch > 0 {
+		config = stores.WriteBehindConfig{Store: config, Interval: interval, BatchSize: batch}
+	}
+	if size, ttl := getInt("CACHE_SIZE"), getDuration("CACHE_TTL"); size > 0 || ttl > 0 {
+		config = stores.CacheConfig{Store: config, Size: size, TTL: ttl}
 	}
 
 	if store, err := stores.New(config); err != nil {
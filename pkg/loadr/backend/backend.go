@@ -1,9 +1,21 @@
 package backend
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/internal/httpserver"
+	"github.com/Sinea/loadr/pkg/loadr/ratelimit"
 	"github.com/labstack/echo"
 	"gopkg.in/validator.v2"
 )
@@ -14,63 +26,384 @@ type UpdateProgressRequest struct {
 	Progress  loadr.Progress `json:"progress"`
 }
 
+// IssueTicketRequest request to issue a subscription ticket
+type IssueTicketRequest struct {
+	TTL    uint `json:"ttl"`
+	Prefix bool `json:"prefix"`
+}
+
+// IssueTicketResponse signed subscription ticket
+type IssueTicketResponse struct {
+	Ticket  string    `json:"ticket"`
+	Expires time.Time `json:"expires"`
+}
+
+// APIKeyHeader header carrying the caller's API key
+const APIKeyHeader = "X-Api-Key"
+
+// TraceHeader header carrying the caller's W3C trace context, forwarded to the
+// other nodes with the progress
+const TraceHeader = "Traceparent"
+
+// ReservedPrefix of the backend's own routes, tokens can't start with it
+const ReservedPrefix = "_"
+
+// StatsPath of the caller's usage statistics
+const StatsPath = "/" + ReservedPrefix + "stats"
+
+// DefaultTimeout of a request to the store and channel
+const DefaultTimeout = 10 * time.Second
+
+// DefaultMaxTicketTTL longest lifetime of a ticket issued by the backend
+const DefaultMaxTicketTTL = time.Hour
+
+const tenantKey = "tenant"
+
+// Config for the backend listener
+type Config struct {
+	loadr.NetConfig
+	// Tickets issues subscription tickets, the endpoint is disabled when nil
+	Tickets loadr.TicketIssuer
+	// MaxTicketTTL requests for longer lived tickets are rejected, DefaultMaxTicketTTL when 0
+	MaxTicketTTL time.Duration
+	// APIKeys maps API keys to the tenant they belong to. When empty callers
+	// are not authenticated and everything happens in the default tenant.
+	APIKeys map[string]loadr.Tenant
+	// RateLimits on writes, a nil limiter means unlimited
+	RateLimits RateLimits
+	// Timeout of a request to the store and channel, DefaultTimeout when 0
+	Timeout time.Duration
+}
+
+// RateLimits applied to backend writes
+type RateLimits struct {
+	Global ratelimit.Limiter
+	// PerKey is only applied when API keys are configured
+	PerKey   ratelimit.Limiter
+	PerToken ratelimit.Limiter
+}
+
 type backend struct {
-	config  loadr.NetConfig
-	handler loadr.ProgressHandler
+	config   Config
+	handler  loadr.ProgressHandler
+	lock     sync.Mutex
+	endpoint *echo.Echo
+	closed   bool
 }
 
 func (b *backend) Run(handler loadr.ProgressHandler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return
+	}
 	b.handler = handler
+	b.endpoint = b.routes()
+	go httpserver.Start(b.endpoint, b.config.NetConfig)
+}
+
+// routes of the backend
+func (b *backend) routes() *echo.Echo {
 	endpoint := echo.New()
-	endpoint.POST("/:token", b.updateProgress)
-	endpoint.DELETE("/:token", b.deleteProgress)
-	go startServer(endpoint, b.config)
+	endpoint.Use(b.authenticate)
+	endpoint.GET(StatsPath, b.stats)
+	endpoint.GET("/:token", b.getProgress, reserved)
+	endpoint.POST("/:token", b.updateProgress, reserved, b.limit)
+	endpoint.DELETE("/:token", b.deleteProgress, reserved, b.limit)
+	if b.config.Tickets != nil {
+		endpoint.POST("/:token/ticket", b.issueTicket, reserved)
+	}
+	return endpoint
+}
+
+// Close the listener, it isn't started if it isn't running yet
+func (b *backend) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	if b.endpoint == nil {
+		return nil
+	}
+	return b.endpoint.Close()
+}
+
+// authenticate the caller and resolve its tenant
+func (b *backend) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var tenant loadr.Tenant
+		if len(b.config.APIKeys) > 0 {
+			t, ok := b.config.APIKeys[c.Request().Header.Get(APIKeyHeader)]
+			if !ok {
+				return c.NoContent(http.StatusUnauthorized)
+			}
+			tenant = t
+		}
+		c.Set(tenantKey, tenant)
+		return next(c)
+	}
+}
+
+// rateCheck of a request against a limiter
+type rateCheck struct {
+	limiter ratelimit.Limiter
+	key     string
+}
+
+// keyHash of an API key, so keys don't end up in the limiter's storage
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// limit writes according to the configured rate limits
+func (b *backend) limit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		checks := []rateCheck{
+			{b.config.RateLimits.Global, "global"},
+			{b.config.RateLimits.PerToken, "token:" + string(tenantToken(c))},
+		}
+		// Without API keys every caller would share one key
+		if len(b.config.APIKeys) > 0 {
+			checks = append(checks, rateCheck{b.config.RateLimits.PerKey, "key:" + keyHash(c.Request().Header.Get(APIKeyHeader))})
+		}
+
+		for _, check := range checks {
+			if check.limiter == nil {
+				continue
+			}
+			allowed, wait, err := check.limiter.Allow(c.Request().Context(), check.key)
+			if err != nil {
+				// Don't reject writes because the limiter is unavailable
+				c.Logger().Warnf("error checking rate limit: %s", err)
+				continue
+			}
+			if !allowed {
+				retry := int(math.Max(1, math.Ceil(wait.Seconds())))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(retry))
+				return c.NoContent(http.StatusTooManyRequests)
+			}
+		}
+
+		return next(c)
+	}
+}
+
+// reserved rejects tokens starting with ReservedPrefix, their paths may be the backend's own
+func reserved(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if strings.HasPrefix(c.Param("token"), ReservedPrefix) {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("tokens can't start with '%s'", ReservedPrefix))
+		}
+		return next(c)
+	}
+}
+
+// tenantToken from the request path, namespaced under the caller's tenant
+func tenantToken(c echo.Context) loadr.Token {
+	return callerTenant(c).Token(loadr.Token(c.Param("token")))
+}
+
+func callerTenant(c echo.Context) loadr.Tenant {
+	t, _ := c.Get(tenantKey).(loadr.Tenant)
+	return t
 }
 
 func (b *backend) updateProgress(c echo.Context) error {
-	tokenString := c.Param("token")
-	token := loadr.Token(tokenString)
+	token := tenantToken(c)
 	update := &UpdateProgressRequest{}
 
 	if err := c.Bind(update); err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(http.StatusBadRequest, err.Error())
 	}
 
 	if err := validator.Validate(update); err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(http.StatusBadRequest, err.Error())
 	}
 
-	if err := b.handler.Set(token, &update.Progress, update.Guarantee); err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	version, conditional, err := condition(c.Request().Header)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	ctx, cancel := b.context(c)
+	defer cancel()
+	if conditional {
+		version, err := b.handler.SetIfVersion(ctx, token, &update.Progress, update.Guarantee, version)
+		if err != nil {
+			return respondError(c, err)
+		}
+		c.Response().Header().Set("ETag", etag(version))
+		return c.NoContent(http.StatusOK)
+	}
+	if err := b.handler.Set(ctx, token, &update.Progress, update.Guarantee); err != nil {
+		return respondError(c, err)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
 
+// getProgress of a token, with its version as ETag when the store keeps versions
+func (b *backend) getProgress(c echo.Context) error {
+	token := tenantToken(c)
+
+	ctx, cancel := b.context(c)
+	defer cancel()
+	progress, version, err := b.handler.Get(ctx, token)
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	if version != loadr.NoVersion {
+		tag := etag(version)
+		c.Response().Header().Set("ETag", tag)
+		if match := c.Request().Header.Get("If-None-Match"); match == "*" || strings.Contains(match, tag) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+	return c.JSON(http.StatusOK, progress)
+}
+
+// condition of a conditional update: If-Match with an ETag sets the progress only
+// at its version, If-Match: * only if it exists and If-None-Match: * only if it doesn't
+func condition(header http.Header) (loadr.Version, bool, error) {
+	match, noneMatch := strings.TrimSpace(header.Get("If-Match")), strings.TrimSpace(header.Get("If-None-Match"))
+	switch {
+	case match != "" && noneMatch != "":
+		return loadr.NoVersion, false, errors.New("If-Match and If-None-Match can't be combined")
+	case noneMatch == "*":
+		return loadr.NoVersion, true, nil
+	case noneMatch != "":
+		return loadr.NoVersion, false, errors.New("If-None-Match only supports * on updates")
+	case match == "*":
+		return loadr.AnyVersion, true, nil
+	case match != "":
+		version, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+		if err != nil || !strings.HasPrefix(match, `"`) || !strings.HasSuffix(match, `"`) ||
+			loadr.Version(version) == loadr.NoVersion || loadr.Version(version) == loadr.AnyVersion {
+			return loadr.NoVersion, false, fmt.Errorf("invalid If-Match ETag %s", match)
+		}
+		return loadr.Version(version), true, nil
+	default:
+		return loadr.NoVersion, false, nil
+	}
+}
+
+// etag of a version
+func etag(version loadr.Version) string {
+	return `"` + strconv.FormatUint(uint64(version), 10) + `"`
+}
+
 func (b *backend) deleteProgress(c echo.Context) error {
-	tokenString := c.Param("token")
-	token := loadr.Token(tokenString)
+	token := tenantToken(c)
 
-	if err := b.handler.Delete(token); err != nil {
-		return c.NoContent(http.StatusInternalServerError)
+	ctx, cancel := b.context(c)
+	defer cancel()
+	if err := b.handler.Delete(ctx, token); err != nil {
+		return respondError(c, err)
 	}
 
 	return c.NoContent(http.StatusOK)
 }
 
-func startServer(server *echo.Echo, config loadr.NetConfig) {
-	var err error
-	if config.KeyFile != "" && config.CertFile != "" {
-		err = server.StartTLS(config.Address, config.CertFile, config.KeyFile)
-	} else {
-		err = server.Start(config.Address)
+// context of a request, bounded by the configured timeout and cancelled when the caller goes away.
+// It carries the caller's trace context when the header is well formed.
+func (b *backend) context(c echo.Context) (context.Context, context.CancelFunc) {
+	ctx := c.Request().Context()
+	if trace := c.Request().Header.Get(TraceHeader); traceparent(trace) {
+		ctx = loadr.WithTrace(ctx, trace)
+	}
+	return context.WithTimeout(ctx, b.config.Timeout)
+}
+
+// traceparent reports whether a header value is a version 00 W3C traceparent:
+// 00-<32 hex trace id>-<16 hex parent id>-<2 hex flags>
+func traceparent(value string) bool {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return false
+	}
+	for i, size := range []int{2, 32, 16, 2} {
+		if len(parts[i]) != size || strings.Trim(parts[i], "0123456789abcdef") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// respondError with the status matching the error, the message is only
+// shown to callers for their own errors
+func respondError(c echo.Context, err error) error {
+	status := statusOf(err)
+	var e *loadr.Error
+	if status < http.StatusInternalServerError && errors.As(err, &e) {
+		return c.String(status, e.Message)
+	}
+	return c.NoContent(status)
+}
+
+// statusOf an error returned by the service: unknown tokens are not found, quotas,
+// invalid progresses and unmet conditions are the caller's, timeouts and unavailable
+// stores or channels are temporary
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, loadr.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, &loadr.Error{Code: loadr.QuotaExceededError}):
+		return http.StatusTooManyRequests
+	case errors.Is(err, &loadr.Error{Code: loadr.ValidationError}):
+		return http.StatusBadRequest
+	case errors.Is(err, loadr.ErrConflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, loadr.ErrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, &loadr.Error{Code: loadr.StorageError}), errors.Is(err, &loadr.Error{Code: loadr.BroadcastError}):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (b *backend) issueTicket(c echo.Context) error {
+	scope := loadr.Token(c.Param("token"))
+	request := &IssueTicketRequest{}
+
+	if err := c.Bind(request); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
 	}
 
-	server.Logger.Fatal(err)
+	if uint64(request.TTL) > uint64(b.config.MaxTicketTTL/time.Second) {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("ttl over the maximum of %d seconds", b.config.MaxTicketTTL/time.Second))
+	}
+	ttl := time.Duration(request.TTL) * time.Second
+	ticket, expires, err := b.config.Tickets.Issue(callerTenant(c), scope, request.Prefix, ttl)
+	if err != nil {
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, &IssueTicketResponse{Ticket: ticket, Expires: expires})
+}
+
+func (b *backend) stats(c echo.Context) error {
+	return c.JSON(http.StatusOK, b.handler.Stats(callerTenant(c)))
 }
 
-func New(config loadr.NetConfig) loadr.BackendListener {
+// New backend listener, tenants of API keys can't contain loadr.TenantSeparator
+func New(config Config) (loadr.BackendListener, error) {
+	// A tenant "a/b" would own tokens "a/b/x", which are tenant a's
+	for _, tenant := range config.APIKeys {
+		if strings.Contains(string(tenant), loadr.TenantSeparator) {
+			return nil, fmt.Errorf("invalid tenant '%s', it contains '%s'", tenant, loadr.TenantSeparator)
+		}
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.MaxTicketTTL <= 0 {
+		config.MaxTicketTTL = DefaultMaxTicketTTL
+	}
 	return &backend{
 		config: config,
-	}
+	}, nil
 }
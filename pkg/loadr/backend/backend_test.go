@@ -0,0 +1,230 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/stores"
+	"github.com/Sinea/loadr/pkg/loadr/tickets"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBackend(t *testing.T, config Config) *backend {
+	b, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*backend)
+}
+
+func TestNew_Tenants(t *testing.T) {
+	_, err := New(Config{APIKeys: map[string]loadr.Tenant{"key": "a" + loadr.TenantSeparator + "b"}})
+	assert.Error(t, err, "tenants can't reach into each other's tokens")
+	_, err = New(Config{APIKeys: map[string]loadr.Tenant{"key": "a", "other": ""}})
+	assert.NoError(t, err)
+}
+
+func TestStatusOf(t *testing.T) {
+	storage := func(err error) error {
+		return &loadr.Error{Code: loadr.StorageError, Message: "error saving progress", Err: err}
+	}
+	for expected, err := range map[int]error{
+		http.StatusNotFound:            fmt.Errorf("reading: %w", loadr.ErrNotFound),
+		http.StatusTooManyRequests:     &loadr.Error{Code: loadr.QuotaExceededError},
+		http.StatusBadRequest:          &loadr.Error{Code: loadr.ValidationError},
+		http.StatusPreconditionFailed:  storage(loadr.ErrConflict),
+		http.StatusNotImplemented:      loadr.ErrUnsupported,
+		http.StatusGatewayTimeout:      storage(context.DeadlineExceeded),
+		http.StatusServiceUnavailable:  storage(errors.New("connection refused")),
+		http.StatusInternalServerError: errors.New("unexpected"),
+	} {
+		assert.Equal(t, expected, statusOf(err), err.Error())
+	}
+}
+
+// versionedHandler handles progresses with a versioned store
+type versionedHandler struct {
+	loadr.ProgressHandler
+	store loadr.VersionedStore
+}
+
+func (h *versionedHandler) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	return h.store.GetVersion(ctx, token)
+}
+
+func (h *versionedHandler) SetIfVersion(ctx context.Context, token loadr.Token, p *loadr.Progress, _ uint, version loadr.Version) (loadr.Version, error) {
+	return h.store.SetIfVersion(ctx, token, p, version)
+}
+
+func TestBackend_ConditionalUpdates(t *testing.T) {
+	store, _ := stores.New(nil)
+	b := newTestBackend(t, Config{})
+	b.handler = &versionedHandler{store: store.(loadr.VersionedStore)}
+
+	request := func(method string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/x", strings.NewReader(`{"progress":{"stage":"a","progress":0.5}}`))
+		req.Header = header
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		recorder := httptest.NewRecorder()
+		c := echo.New().NewContext(req, recorder)
+		c.SetParamNames("token")
+		c.SetParamValues("x")
+		if method == http.MethodGet {
+			assert.NoError(t, b.getProgress(c))
+		} else {
+			assert.NoError(t, b.updateProgress(c))
+		}
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, http.Header{}).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodPost, http.Header{"If-Match": {"*"}}).Code)
+
+	created := request(http.MethodPost, http.Header{"If-None-Match": {"*"}})
+	assert.Equal(t, http.StatusOK, created.Code)
+	assert.Equal(t, `"1"`, created.Header().Get("ETag"))
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodPost, http.Header{"If-None-Match": {"*"}}).Code)
+
+	got := request(http.MethodGet, http.Header{})
+	assert.Equal(t, http.StatusOK, got.Code)
+	assert.Equal(t, `"1"`, got.Header().Get("ETag"))
+	assert.JSONEq(t, `{"stage":"a","progress":0.5}`, got.Body.String())
+	assert.Equal(t, http.StatusNotModified, request(http.MethodGet, http.Header{"If-None-Match": {`"1"`}}).Code)
+
+	assert.Equal(t, `"2"`, request(http.MethodPost, http.Header{"If-Match": {`"1"`}}).Header().Get("ETag"))
+	assert.Equal(t, http.StatusPreconditionFailed, request(http.MethodPost, http.Header{"If-Match": {`"1"`}}).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, http.Header{"If-Match": {"1"}}).Code)
+}
+
+// tracingHandler records the trace context progresses are set with
+type tracingHandler struct {
+	loadr.ProgressHandler
+	trace string
+}
+
+func (h *tracingHandler) Set(ctx context.Context, _ loadr.Token, _ *loadr.Progress, _ uint) error {
+	h.trace = loadr.TraceOf(ctx)
+	return nil
+}
+
+func TestBackend_Trace(t *testing.T) {
+	const trace = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	for header, expected := range map[string]string{
+		trace:                   trace,
+		"":                      "",
+		"01-" + trace[3:]:       "",
+		strings.ToUpper(trace):  "",
+		trace + "-extra":        "",
+		"00-0af7651916cd43dd-b": "",
+	} {
+		handler := &tracingHandler{}
+		b := newTestBackend(t, Config{})
+		b.handler = handler
+		req := httptest.NewRequest(http.MethodPost, "/x", strings.NewReader(`{"progress":{"stage":"a","progress":0.5}}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(TraceHeader, header)
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		c.SetParamNames("token")
+		c.SetParamValues("x")
+		assert.NoError(t, b.updateProgress(c))
+		assert.Equal(t, expected, handler.trace, header)
+	}
+}
+
+// keyRecorder records the keys it is asked about and allows them all
+type keyRecorder struct {
+	keys []string
+}
+
+func (r *keyRecorder) Allow(_ context.Context, key string) (bool, time.Duration, error) {
+	r.keys = append(r.keys, key)
+	return true, 0, nil
+}
+
+func TestBackend_LimitPerKey(t *testing.T) {
+	limit := func(apiKeys map[string]loadr.Tenant) []string {
+		recorder := &keyRecorder{}
+		b := newTestBackend(t, Config{APIKeys: apiKeys, RateLimits: RateLimits{PerKey: recorder}})
+		req := httptest.NewRequest(http.MethodPost, "/x", nil)
+		req.Header.Set(APIKeyHeader, "secret")
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		assert.NoError(t, b.limit(func(echo.Context) error { return nil })(c))
+		return recorder.keys
+	}
+
+	assert.Empty(t, limit(nil), "no per key limit without API keys")
+	keys := limit(map[string]loadr.Tenant{"secret": "a"})
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, "key:"+keyHash("secret"), keys[0])
+		assert.NotContains(t, keys[0], "secret")
+	}
+}
+
+func TestBackend_MaxTicketTTL(t *testing.T) {
+	signer, err := tickets.New([]byte("0123456789abcdef0123456789abcdef"))
+	assert.NoError(t, err)
+	b := newTestBackend(t, Config{Tickets: signer, MaxTicketTTL: time.Minute})
+	issue := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/x/ticket", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		recorder := httptest.NewRecorder()
+		c := echo.New().NewContext(req, recorder)
+		c.SetParamNames("token")
+		c.SetParamValues("x")
+		assert.NoError(t, b.issueTicket(c))
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, issue(`{"ttl":60}`).Code)
+	assert.Equal(t, http.StatusBadRequest, issue(`{"ttl":61}`).Code)
+	assert.Equal(t, http.StatusBadRequest, issue(`{"ttl":18446744073709551615}`).Code, "durations don't overflow")
+	assert.Equal(t, DefaultMaxTicketTTL, newTestBackend(t, Config{}).config.MaxTicketTTL)
+}
+
+// statsHandler answers stats and stores progresses
+type statsHandler struct {
+	versionedHandler
+}
+
+func (h *statsHandler) Set(ctx context.Context, token loadr.Token, p *loadr.Progress, _ uint) error {
+	return h.store.(loadr.Store).Set(ctx, token, p)
+}
+
+func (h *statsHandler) Stats(loadr.Tenant) loadr.TenantStats {
+	return loadr.TenantStats{Tokens: 1}
+}
+
+func TestBackend_ReservedTokens(t *testing.T) {
+	store, _ := stores.New(nil)
+	b := newTestBackend(t, Config{})
+	b.handler = &statsHandler{versionedHandler{store: store.(loadr.VersionedStore)}}
+	endpoint := b.routes()
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"progress":{"stage":"a","progress":0.5}}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		recorder := httptest.NewRecorder()
+		endpoint.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	stats := request(http.MethodGet, StatsPath)
+	assert.Equal(t, http.StatusOK, stats.Code)
+	assert.Contains(t, stats.Body.String(), `"tokens":1`)
+
+	// Tokens that could be routes can't be written
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodPost, StatsPath).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/_x").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/_x").Code)
+
+	// Others, stats included, are written and read back
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/stats").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/stats").Code)
+}
@@ -1,12 +1,76 @@
 package channels
 
-import "github.com/Sinea/loadr/pkg/loadr"
+import (
+	"encoding/base64"
+	"hash/fnv"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+)
 
 func New(config interface{}) loadr.Channel {
 	switch c := config.(type) {
 	case RedisConfig:
 		return newRedisChannel(c)
+	case RedisStreamConfig:
+		return newRedisStream(c)
+	case NatsConfig:
+		return newNatsChannel(c)
+	case AmqpConfig:
+		return newAmqpChannel(c, dialAmqp)
+	case PostgresConfig:
+		return newPostgresChannel(c)
+	case PeerConfig:
+		return newPeerChannel(c)
+	case InMemoryConfig:
+		return newInMemoryChannel(c)
 	default:
-		return newInMemoryChannel()
+		return newInMemoryChannel(InMemoryConfig{})
+	}
+}
+
+// topicToken encodes a token so it can be used as a single word of a
+// subject or routing key, whatever characters the token contains
+func topicToken(token loadr.Token) string {
+	if token == "" {
+		return "_"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// shard a token is routed to among shards
+func shard(token loadr.Token, shards int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(token))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// interests counts the tokens subscribed to each topic, so a topic shared by
+// several tokens is subscribed once and only dropped with its last token
+type interests map[string]int
+
+// add a token's interest in a topic, returns true for the first one
+func (i interests) add(topic string) bool {
+	i[topic]++
+	return i[topic] == 1
+}
+
+// remove a token's interest in a topic, returns true for the last one
+func (i interests) remove(topic string) bool {
+	if i[topic] <= 0 {
+		return false
+	}
+	if i[topic]--; i[topic] > 0 {
+		return false
+	}
+	delete(i, topic)
+	return true
+}
+
+// topics currently subscribed
+func (i interests) topics() []string {
+	result := make([]string, 0, len(i))
+	for topic := range i {
+		result = append(result, topic)
 	}
+	return result
 }
@@ -0,0 +1,125 @@
+package channels
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/channeltest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// nodes of a channel made by config
+func nodes(config func(t *testing.T, node int) interface{}) channeltest.Factory {
+	return func(t *testing.T, n int) []loadr.Channel {
+		result := make([]loadr.Channel, 0, n)
+		for i := 0; i < n; i++ {
+			result = append(result, New(config(t, i)))
+		}
+		return result
+	}
+}
+
+func TestConformance(t *testing.T) {
+	redisConfig := func(t *testing.T) RedisConfig {
+		return RedisConfig{
+			Address:             miniredis.RunT(t).Addr(),
+			HealthCheckInterval: 50 * time.Millisecond,
+			MinBackoff:          10 * time.Millisecond,
+			MaxBackoff:          50 * time.Millisecond,
+		}
+	}
+
+	t.Run("in memory", func(t *testing.T) {
+		channeltest.Run(t, func(t *testing.T, n int) []loadr.Channel {
+			broker := NewBroker()
+			t.Cleanup(func() { _ = broker.Close() })
+			return nodes(func(*testing.T, int) interface{} { return InMemoryConfig{Broker: broker} })(t, n)
+		}, channeltest.Options{})
+	})
+
+	t.Run("in memory private", func(t *testing.T) {
+		channeltest.Run(t, nodes(func(*testing.T, int) interface{} {
+			return nil
+		}), channeltest.Options{SingleNode: true})
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		channeltest.Run(t, func(t *testing.T, n int) []loadr.Channel {
+			config := redisConfig(t)
+			return nodes(func(*testing.T, int) interface{} { return config })(t, n)
+		}, channeltest.Options{})
+	})
+
+	t.Run("redis sharded", func(t *testing.T) {
+		channeltest.Run(t, func(t *testing.T, n int) []loadr.Channel {
+			config := redisConfig(t)
+			config.Shards = 4
+			return nodes(func(*testing.T, int) interface{} { return config })(t, n)
+		}, channeltest.Options{})
+	})
+
+	t.Run("redis stream", func(t *testing.T) {
+		channeltest.Run(t, func(t *testing.T, n int) []loadr.Channel {
+			config := redisConfig(t)
+			return nodes(func(_ *testing.T, node int) interface{} {
+				return RedisStreamConfig{RedisConfig: config, Node: string(rune('a' + node)), Block: 50 * time.Millisecond}
+			})(t, n)
+		}, channeltest.Options{})
+	})
+
+	t.Run("peer", func(t *testing.T) {
+		channeltest.Run(t, func(t *testing.T, n int) []loadr.Channel {
+			listeners := make([]net.Listener, 0, n)
+			peers := make([]string, 0, n)
+			for i := 0; i < n; i++ {
+				listener := listen(t, "127.0.0.1:0")
+				listeners = append(listeners, listener)
+				peers = append(peers, listener.Addr().String())
+			}
+			result := make([]loadr.Channel, 0, n)
+			for _, listener := range listeners {
+				result = append(result, newTestPeer(listener, peers...))
+			}
+			return result
+		}, channeltest.Options{})
+	})
+
+	t.Run("nats", func(t *testing.T) {
+		channeltest.Run(t, func(t *testing.T, n int) []loadr.Channel {
+			url := runNatsServer(t, server.RANDOM_PORT, false).ClientURL()
+			return nodes(func(*testing.T, int) interface{} { return NatsConfig{URL: url} })(t, n)
+		}, channeltest.Options{})
+	})
+
+	t.Run("nats jetstream", func(t *testing.T) {
+		channeltest.Run(t, func(t *testing.T, n int) []loadr.Channel {
+			url := runNatsServer(t, server.RANDOM_PORT, true).ClientURL()
+			return nodes(func(*testing.T, int) interface{} { return NatsConfig{URL: url, JetStream: true, PerToken: true} })(t, n)
+		}, channeltest.Options{})
+	})
+
+	// Brokers not available in process, see the channels' own tests for the variables
+	t.Run("amqp", func(t *testing.T) {
+		url := os.Getenv("LOADR_TEST_AMQP")
+		if url == "" {
+			t.Skip("LOADR_TEST_AMQP not set")
+		}
+		channeltest.Run(t, nodes(func(*testing.T, int) interface{} {
+			return AmqpConfig{URL: url, Exchange: "loadr-test-conformance", Topic: true}
+		}), channeltest.Options{})
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("LOADR_TEST_POSTGRES")
+		if dsn == "" {
+			t.Skip("LOADR_TEST_POSTGRES not set")
+		}
+		channeltest.Run(t, nodes(func(*testing.T, int) interface{} {
+			return PostgresConfig{DSN: dsn, Channel: "loadr_test_conformance", PayloadTable: "loadr_test_conformance_payloads"}
+		}), channeltest.Options{})
+	})
+}
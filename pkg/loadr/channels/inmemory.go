@@ -1,22 +1,111 @@
 package channels
 
-import "github.com/Sinea/loadr/pkg/loadr"
+import (
+	"context"
+	"sync"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+)
+
+// DefaultInMemoryBuffer of progresses a node may fall behind by
+const DefaultInMemoryBuffer = 1024
+
+// InMemoryConfig of a channel between nodes running in one process
+type InMemoryConfig struct {
+	// Broker shared by the nodes, a private one when nil so progresses only
+	// reach the node pushing them
+	Broker *Broker
+	// Buffer of progresses the node may fall behind by, DefaultInMemoryBuffer
+	// when 0. The oldest are dropped when it falls further behind.
+	Buffer int
+}
+
+// Broker fans the progresses pushed on one of its channels out to all of them,
+// giving nodes in one process the behavior of nodes sharing a message broker
+type Broker struct {
+	lock     sync.RWMutex
+	channels map[*inMemory]struct{}
+	closed   bool
+}
+
+// NewBroker with no channels attached yet
+func NewBroker() *Broker {
+	return &Broker{channels: make(map[*inMemory]struct{})}
+}
+
+// Close the broker and the channels attached to it
+func (b *Broker) Close() error {
+	b.lock.Lock()
+	b.closed = true
+	channels := b.channels
+	b.channels = make(map[*inMemory]struct{})
+	b.lock.Unlock()
+
+	for c := range channels {
+		c.closeOnce.Do(func() {
+			close(c.done)
+		})
+	}
+	return nil
+}
+
+// attach a channel, it is closed right away if the broker is
+func (b *Broker) attach(c *inMemory) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		c.closeOnce.Do(func() {
+			close(c.done)
+		})
+		return
+	}
+	b.channels[c] = struct{}{}
+}
+
+func (b *Broker) detach(c *inMemory) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.channels, c)
+}
+
+// publish a progress to every channel attached, without waiting for any
+func (b *Broker) publish(p loadr.MetaProgress) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for c := range b.channels {
+		c.offer(p)
+	}
+}
 
 type inMemory struct {
-	out    chan loadr.MetaProgress
-	errors chan error
+	broker    *Broker
+	out       chan loadr.MetaProgress
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func (c *inMemory) Errors() <-chan error {
 	return c.errors
 }
 
+// Close detaches the channel from its broker
 func (c *inMemory) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.broker.detach(c)
+	})
 	return nil
 }
 
-func (c *inMemory) Push(progress loadr.MetaProgress) error {
-	c.out <- progress
+// Push never blocks, nodes that fell behind lose their oldest progresses
+func (c *inMemory) Push(_ context.Context, progress loadr.MetaProgress) error {
+	select {
+	case <-c.done:
+		return &loadr.Error{Message: "in memory channel closed", Code: loadr.ChannelCloseError}
+	default:
+	}
+	c.broker.publish(progress)
 	return nil
 }
 
@@ -24,9 +113,44 @@ func (c *inMemory) Progresses() <-chan loadr.MetaProgress {
 	return c.out
 }
 
-func newInMemoryChannel() loadr.Channel {
-	return &inMemory{
-		errors: make(chan error),
-		out:    make(chan loadr.MetaProgress),
+// offer a progress, dropping the oldest one buffered while the buffer is full
+func (c *inMemory) offer(p loadr.MetaProgress) {
+	for {
+		select {
+		case c.out <- p:
+			return
+		default:
+		}
+		select {
+		case <-c.out:
+			c.overflow()
+		default:
+		}
+	}
+}
+
+// overflow reports a dropped progress unless one is reported already
+func (c *inMemory) overflow() {
+	select {
+	case c.errors <- &loadr.Error{Message: "in memory channel fell behind, dropped progresses", Code: loadr.ChannelOverflowError}:
+	default:
+	}
+}
+
+func newInMemoryChannel(config InMemoryConfig) loadr.Channel {
+	if config.Broker == nil {
+		config.Broker = NewBroker()
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = DefaultInMemoryBuffer
+	}
+	c := &inMemory{
+		broker: config.Broker,
+		// Overflows are reported without blocking pushes, pending ones coalesce
+		errors: make(chan error, 1),
+		out:    make(chan loadr.MetaProgress, config.Buffer),
+		done:   make(chan struct{}),
 	}
+	config.Broker.attach(c)
+	return c
 }
@@ -0,0 +1,39 @@
+package channels
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryChannel_Overflow(t *testing.T) {
+	broker := NewBroker()
+	fast := New(InMemoryConfig{Broker: broker, Buffer: 2})
+	slow := New(InMemoryConfig{Broker: broker, Buffer: 2})
+
+	// Nobody reads slow, pushing doesn't wait for it
+	for _, token := range []loadr.Token{"a", "b", "c"} {
+		assert.NoError(t, fast.Push(context.Background(), loadr.MetaProgress{Token: token}))
+		assert.Equal(t, token, (<-fast.Progresses()).Token)
+	}
+
+	expectError(t, slow, loadr.ChannelOverflowError)
+	assert.Equal(t, loadr.Token("b"), (<-slow.Progresses()).Token, "the oldest progress is dropped")
+	assert.Equal(t, loadr.Token("c"), (<-slow.Progresses()).Token)
+}
+
+func TestInMemoryChannel_Close(t *testing.T) {
+	broker := NewBroker()
+	a := New(InMemoryConfig{Broker: broker})
+	b := New(InMemoryConfig{Broker: broker})
+
+	assert.NoError(t, b.Close())
+	assert.NoError(t, a.Push(context.Background(), loadr.MetaProgress{Token: "x"}))
+	assert.Len(t, b.Progresses(), 0, "closed channels leave the broker")
+
+	assert.NoError(t, broker.Close())
+	assert.Error(t, a.Push(context.Background(), loadr.MetaProgress{Token: "x"}), "closing the broker closes its channels")
+	assert.Error(t, New(InMemoryConfig{Broker: broker}).Push(context.Background(), loadr.MetaProgress{Token: "x"}))
+}
@@ -0,0 +1,217 @@
+package channels
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+)
+
+// outBuffer of channels delivering their own progresses as they push them,
+// so Push doesn't wait on the reader
+const outBuffer = 64
+
+// Reconnection backoff defaults
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// lifecycle of a channel that reads in the background: its errors, whether it
+// is connected, whether it was closed and the node its messages originate from
+type lifecycle struct {
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+	connected int32
+	origin    string
+	codec     codec.Codec
+	// delay smoothed in nanoseconds
+	delay int64
+}
+
+func (l *lifecycle) Errors() <-chan error {
+	return l.errors
+}
+
+// IsConnected reports whether the channel is currently connected and receiving progresses
+func (l *lifecycle) IsConnected() bool {
+	return atomic.LoadInt32(&l.connected) == 1
+}
+
+// setConnected updates the connection state and reports transitions on Errors()
+func (l *lifecycle) setConnected(connected bool, message string) {
+	var state int32
+	code := uint(loadr.ChannelDisconnectedError)
+	if connected {
+		state = 1
+		code = loadr.ChannelReconnectedError
+	}
+	if atomic.SwapInt32(&l.connected, state) != state {
+		l.emit(&loadr.Error{Message: message, Code: code})
+	}
+}
+
+// emit an error unless the channel is closed
+func (l *lifecycle) emit(err error) {
+	select {
+	case l.errors <- err:
+	case <-l.done:
+	}
+}
+
+// encode a progress pushed by this node
+func (l *lifecycle) encode(ctx context.Context, p loadr.MetaProgress) ([]byte, error) {
+	return l.codec.EncodeEnvelope(envelope.New(ctx, l.origin, p))
+}
+
+// receive a message and deliver its progress, unless it was pushed by this
+// node which delivered it already
+func (l *lifecycle) receive(out chan<- loadr.MetaProgress, data []byte) {
+	e, err := l.codec.DecodeEnvelope(data)
+	if err != nil {
+		l.emit(&loadr.Error{
+			Message: fmt.Sprintf("error unmarshalling progress: %s", err),
+			Code:    loadr.ChannelUnmarshalError,
+		})
+		return
+	}
+	l.accept(out, e)
+}
+
+// accept a decoded envelope, delivering its progress
+func (l *lifecycle) accept(out chan<- loadr.MetaProgress, e *envelope.Envelope) {
+	// Other types come from newer nodes and aren't meant for this one
+	if !e.IsProgress() || (e.Origin != "" && e.Origin == l.origin) {
+		return
+	}
+	l.observeDelay(e.Delay(time.Now()))
+	l.deliver(out, e.MetaProgress)
+}
+
+// PropagationDelay smoothed over the last progresses received from other nodes
+func (l *lifecycle) PropagationDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.delay))
+}
+
+func (l *lifecycle) observeDelay(d time.Duration) {
+	// Clocks of other nodes may be ahead
+	if d < 0 {
+		d = 0
+	}
+	for {
+		old := atomic.LoadInt64(&l.delay)
+		smoothed := old + (int64(d)-old)/8
+		if old == 0 {
+			smoothed = int64(d)
+		}
+		if atomic.CompareAndSwapInt64(&l.delay, old, smoothed) {
+			return
+		}
+	}
+}
+
+// deliver a progress unless the channel is closed
+func (l *lifecycle) deliver(out chan<- loadr.MetaProgress, p loadr.MetaProgress) {
+	select {
+	case out <- p:
+	case <-l.done:
+	}
+}
+
+// sleep for a while, returns false if the channel got closed meanwhile
+func (l *lifecycle) sleep(d time.Duration) bool {
+	select {
+	case <-l.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (l *lifecycle) isClosed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// close the lifecycle once, running f right after marking it closed
+func (l *lifecycle) close(f func()) {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		f()
+	})
+}
+
+// newLifecycle encoding messages with c, JSON when nil
+func newLifecycle(c codec.Codec) *lifecycle {
+	if c == nil {
+		c = codec.JSON
+	}
+	return &lifecycle{
+		codec:  c,
+		errors: make(chan error),
+		done:   make(chan struct{}),
+		origin: newNodeID(""),
+		// Unknown until the first connection attempt, so either outcome gets reported
+		connected: -1,
+	}
+}
+
+// backoffBounds defaults unset reconnection backoff bounds, a max below the min is raised to it
+func backoffBounds(low, high time.Duration) (time.Duration, time.Duration) {
+	if low <= 0 {
+		low = DefaultMinBackoff
+	}
+	if high <= 0 {
+		high = DefaultMaxBackoff
+	}
+	if high < low {
+		high = low
+	}
+	return low, high
+}
+
+// backoff grows exponentially between min and max
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+// next delay to wait
+func (b *backoff) next() time.Duration {
+	d := b.current
+	if d < b.min {
+		d = b.min
+	}
+	if b.current = d * 2; b.current > b.max {
+		b.current = b.max
+	}
+	return d
+}
+
+func (b *backoff) reset() {
+	b.current = b.min
+}
+
+// newNodeID unique to this run, a restarted node must not be taken for its previous run
+func newNodeID(name string) string {
+	bytes := make([]byte, 6)
+	_, _ = rand.Read(bytes)
+	if name = strings.TrimSpace(name); name == "" {
+		return hex.EncodeToString(bytes)
+	}
+	return name + "-" + hex.EncodeToString(bytes)
+}
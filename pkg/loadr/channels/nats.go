@@ -0,0 +1,319 @@
+package channels
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/nats-io/nats.go"
+)
+
+// NATS defaults
+const (
+	DefaultNatsSubject       = "loadr"
+	DefaultNatsStream        = "LOADR"
+	DefaultNatsStreamMaxMsgs = 10000
+	DefaultNatsReconnectWait = time.Second
+)
+
+// NatsConfig for a channel over NATS, or NATS JetStream
+type NatsConfig struct {
+	// URL of the NATS servers, comma separated, defaults to nats.DefaultURL
+	URL string
+	// Subject progresses are published on
+	Subject string
+	// PerToken publishes every token on its own subject under Subject,
+	// otherwise all progresses share Subject
+	PerToken bool
+	// Shards spreads tokens over this many subjects under Subject instead of one per token
+	Shards int
+	// Interest only subscribes to the subjects of the tokens the node has subscribers
+	// for, instead of every subject. Only useful with PerToken or Shards.
+	Interest bool
+	// Queue group the node subscribes in. Each progress is delivered to a single
+	// node of the group, so only set it when nodes don't serve clients themselves.
+	Queue string
+	// JetStream publishes to a stream and waits for the server's acknowledgement
+	JetStream bool
+	// Stream name used with JetStream, created when missing
+	Stream string
+	// StreamMaxMsgs kept by a stream created by the channel
+	StreamMaxMsgs int64
+	// ReconnectWait between reconnection attempts, the client reconnects forever
+	ReconnectWait time.Duration
+	// Options passed to the NATS client, e.g. for credentials or TLS
+	Options []nats.Option
+	// Codec of the messages, JSON when nil
+	Codec codec.Codec
+}
+
+type natsChannel struct {
+	*lifecycle
+	connection   *nats.Conn
+	jetStream    nats.JetStreamContext
+	lock         sync.Mutex
+	subscription *nats.Subscription
+	interests    interests
+	subjects     map[string]*nats.Subscription
+	out          chan loadr.MetaProgress
+	config       NatsConfig
+}
+
+func (n *natsChannel) Close() error {
+	n.close(func() {
+		if n.connection != nil {
+			n.connection.Close()
+		}
+	})
+	return nil
+}
+
+func (n *natsChannel) Push(ctx context.Context, p loadr.MetaProgress) error {
+	if n.connection == nil {
+		return &loadr.Error{Message: "nats channel not connected", Code: loadr.ChannelDisconnectedError}
+	}
+	bytes, err := n.encode(ctx, p)
+	if err != nil {
+		return err
+	}
+	subject := n.subject(p.Token)
+	if n.jetStream != nil {
+		_, err = n.jetStream.Publish(subject, bytes, nats.Context(ctx))
+	} else {
+		err = n.connection.Publish(subject, bytes)
+	}
+	if err != nil {
+		return err
+	}
+	n.deliver(n.out, p)
+	return nil
+}
+
+func (n *natsChannel) Progresses() <-chan loadr.MetaProgress {
+	return n.out
+}
+
+// Subscribe to the subject of a token, only needed with Interest
+func (n *natsChannel) Subscribe(token loadr.Token) error {
+	if !n.config.Interest {
+		return nil
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	subject := n.subject(token)
+	if !n.interests.add(subject) {
+		return nil
+	}
+	if n.connection == nil || (n.config.JetStream && n.jetStream == nil) {
+		n.interests.remove(subject)
+		return &loadr.Error{Message: "nats channel not connected", Code: loadr.ChannelDisconnectedError}
+	}
+	subscription, err := n.doSubscribe(subject)
+	if err == nil {
+		err = n.connection.Flush()
+	}
+	if err != nil {
+		n.interests.remove(subject)
+		if subscription != nil {
+			_ = subscription.Unsubscribe()
+		}
+		return &loadr.Error{
+			Message: fmt.Sprintf("error subscribing to '%s': %s", subject, err),
+			Code:    loadr.ChannelSubscribeError,
+		}
+	}
+	n.subjects[subject] = subscription
+	return nil
+}
+
+// Unsubscribe from the subject of a token once no other token needs it
+func (n *natsChannel) Unsubscribe(token loadr.Token) error {
+	if !n.config.Interest {
+		return nil
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	subject := n.subject(token)
+	if !n.interests.remove(subject) {
+		return nil
+	}
+	subscription := n.subjects[subject]
+	delete(n.subjects, subject)
+	if subscription == nil {
+		return nil
+	}
+	return subscription.Unsubscribe()
+}
+
+// subject a token's progresses are published on
+func (n *natsChannel) subject(token loadr.Token) string {
+	switch {
+	case n.config.Shards > 0:
+		return n.config.Subject + "." + strconv.Itoa(shard(token, n.config.Shards))
+	case n.config.PerToken:
+		return n.config.Subject + "." + topicToken(token)
+	default:
+		return n.config.Subject
+	}
+}
+
+// subscription subject matching every published progress
+func (n *natsChannel) subscriptionSubject() string {
+	if !n.config.PerToken && n.config.Shards <= 0 {
+		return n.config.Subject
+	}
+	return n.config.Subject + ".>"
+}
+
+// subscribe once connected, creating the JetStream stream when needed
+func (n *natsChannel) subscribe() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// Subscriptions by interest are made as tokens get subscribers, the client
+	// keeps them across reconnections
+	if n.config.Interest || n.subscription != nil || n.connection == nil || n.isClosed() {
+		return
+	}
+	if n.config.JetStream && n.jetStream == nil {
+		return
+	}
+	subscription, err := n.doSubscribe(n.subscriptionSubject())
+	if err == nil {
+		// Make sure the server registered the subscription before reporting it
+		if err = n.connection.Flush(); err != nil {
+			_ = subscription.Unsubscribe()
+		}
+	}
+	if err != nil {
+		n.emit(&loadr.Error{
+			Message: fmt.Sprintf("error subscribing: %s", err),
+			Code:    loadr.ChannelSubscribeError,
+		})
+		return
+	}
+	n.subscription = subscription
+}
+
+func (n *natsChannel) doSubscribe(subject string) (*nats.Subscription, error) {
+	if n.jetStream == nil {
+		if n.config.Queue != "" {
+			return n.connection.QueueSubscribe(subject, n.config.Queue, n.handle)
+		}
+		return n.connection.Subscribe(subject, n.handle)
+	}
+
+	if err := n.ensureStream(); err != nil {
+		return nil, err
+	}
+	options := []nats.SubOpt{nats.DeliverNew(), nats.AckNone()}
+	if n.config.Queue != "" {
+		return n.jetStream.QueueSubscribe(subject, n.config.Queue, n.handle, options...)
+	}
+	return n.jetStream.Subscribe(subject, n.handle, options...)
+}
+
+func (n *natsChannel) ensureStream() error {
+	_, err := n.jetStream.StreamInfo(n.config.Stream)
+	if err == nats.ErrStreamNotFound {
+		_, err = n.jetStream.AddStream(&nats.StreamConfig{
+			Name:     n.config.Stream,
+			Subjects: []string{n.subscriptionSubject()},
+			MaxMsgs:  n.config.StreamMaxMsgs,
+		})
+	}
+	return err
+}
+
+func (n *natsChannel) handle(message *nats.Msg) {
+	n.receive(n.out, message.Data)
+}
+
+// connected is called by the client whenever it (re)connects
+func (n *natsChannel) connected(connection *nats.Conn) {
+	n.subscribe()
+	n.setConnected(true, fmt.Sprintf("connected to nats at %s", connection.ConnectedUrl()))
+}
+
+func (n *natsChannel) disconnected(_ *nats.Conn, err error) {
+	if n.isClosed() {
+		return
+	}
+	n.setConnected(false, fmt.Sprintf("disconnected from nats: %v", err))
+}
+
+func (n *natsChannel) asyncError(_ *nats.Conn, _ *nats.Subscription, err error) {
+	n.emit(&loadr.Error{
+		Message: fmt.Sprintf("nats error: %s", err),
+		Code:    loadr.ChannelSubscribeError,
+	})
+}
+
+func newNatsChannel(config NatsConfig) loadr.Channel {
+	if strings.TrimSpace(config.URL) == "" {
+		config.URL = nats.DefaultURL
+	}
+	if strings.TrimSpace(config.Subject) == "" {
+		config.Subject = DefaultNatsSubject
+	}
+	if strings.TrimSpace(config.Stream) == "" {
+		config.Stream = DefaultNatsStream
+	}
+	if config.StreamMaxMsgs <= 0 {
+		config.StreamMaxMsgs = DefaultNatsStreamMaxMsgs
+	}
+	if config.ReconnectWait <= 0 {
+		config.ReconnectWait = DefaultNatsReconnectWait
+	}
+
+	result := &natsChannel{
+		lifecycle: newLifecycle(config.Codec),
+		config:    config,
+		out:       make(chan loadr.MetaProgress, outBuffer),
+		interests: make(interests),
+		subjects:  make(map[string]*nats.Subscription),
+	}
+
+	options := append([]nats.Option{
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(config.ReconnectWait),
+		nats.RetryOnFailedConnect(true),
+		nats.ConnectHandler(result.connected),
+		nats.ReconnectHandler(result.connected),
+		nats.DisconnectErrHandler(result.disconnected),
+		nats.ErrorHandler(result.asyncError),
+	}, config.Options...)
+
+	// Connection callbacks wait for the connection to be set up
+	result.lock.Lock()
+	defer result.lock.Unlock()
+
+	// With RetryOnFailedConnect the client keeps connecting in the background
+	// instead of failing, so errors here are about the options themselves
+	connection, err := nats.Connect(config.URL, options...)
+	if err != nil {
+		go result.emit(&loadr.Error{
+			Message: fmt.Sprintf("error connecting to nats: %s", err),
+			Code:    loadr.ChannelSubscribeError,
+		})
+		return result
+	}
+	result.connection = connection
+
+	if config.JetStream {
+		if result.jetStream, err = connection.JetStream(); err != nil {
+			go result.emit(&loadr.Error{
+				Message: fmt.Sprintf("error getting jetstream context: %s", err),
+				Code:    loadr.ChannelSubscribeError,
+			})
+		}
+	}
+	return result
+}
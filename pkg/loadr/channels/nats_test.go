@@ -0,0 +1,110 @@
+package channels
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func runNatsServer(t *testing.T, port int, jetStream bool) *server.Server {
+	options := &server.Options{Host: "127.0.0.1", Port: port, NoLog: true, NoSigs: true, JetStream: jetStream}
+	if jetStream {
+		options.StoreDir = t.TempDir()
+	}
+	s, err := server.NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+func TestNatsChannel_Modes(t *testing.T) {
+	cases := map[string]NatsConfig{
+		"core":                {},
+		"core per token":      {PerToken: true},
+		"jetstream":           {JetStream: true},
+		"jetstream per token": {JetStream: true, PerToken: true},
+		"msgpack":             {Codec: codec.MsgPack},
+		"protobuf":            {Codec: codec.Protobuf},
+	}
+
+	for name, config := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := runNatsServer(t, server.RANDOM_PORT, config.JetStream)
+			config.URL = s.ClientURL()
+
+			a := newNatsChannel(config)
+			defer a.Close() // nolint: errcheck
+			b := newNatsChannel(config)
+			defer b.Close() // nolint: errcheck
+			expectError(t, a, loadr.ChannelReconnectedError)
+			expectError(t, b, loadr.ChannelReconnectedError)
+
+			progress := loadr.MetaProgress{Token: "tenant/x.y", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+			assert.NoError(t, a.Push(context.Background(), progress))
+			expectProgress(t, a, progress)
+			expectProgress(t, b, progress)
+		})
+	}
+}
+
+func TestNatsChannel_Reconnect(t *testing.T) {
+	s := runNatsServer(t, server.RANDOM_PORT, false)
+	port := s.Addr().(*net.TCPAddr).Port
+	c := newNatsChannel(NatsConfig{URL: s.ClientURL(), ReconnectWait: 10 * time.Millisecond})
+	defer c.Close() // nolint: errcheck
+	expectError(t, c, loadr.ChannelReconnectedError)
+	assert.True(t, c.(loadr.ConnectionChecker).IsConnected())
+
+	s.Shutdown()
+	expectError(t, c, loadr.ChannelDisconnectedError)
+	assert.False(t, c.(loadr.ConnectionChecker).IsConnected())
+
+	runNatsServer(t, port, false)
+	expectError(t, c, loadr.ChannelReconnectedError)
+
+	progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, c.Push(context.Background(), progress))
+	expectProgress(t, c, progress)
+}
+
+func TestNatsChannel_Interest(t *testing.T) {
+	cases := map[string]NatsConfig{
+		"per token": {Interest: true, PerToken: true},
+		"shards":    {Interest: true, Shards: 1024},
+		"jetstream": {Interest: true, PerToken: true, JetStream: true},
+	}
+
+	for name, config := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := runNatsServer(t, server.RANDOM_PORT, config.JetStream)
+			config.URL = s.ClientURL()
+
+			a := newNatsChannel(config)
+			defer a.Close() // nolint: errcheck
+			b := newNatsChannel(config)
+			defer b.Close() // nolint: errcheck
+			expectError(t, a, loadr.ChannelReconnectedError)
+			expectError(t, b, loadr.ChannelReconnectedError)
+			assert.NoError(t, b.(loadr.TokenSubscriber).Subscribe("x"))
+
+			other := loadr.MetaProgress{Token: "y", Progress: loadr.Progress{Stage: "a", Progress: 0.1}}
+			progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+			assert.NoError(t, a.Push(context.Background(), other))
+			assert.NoError(t, a.Push(context.Background(), progress))
+			expectProgress(t, b, progress)
+			assert.NoError(t, b.(loadr.TokenSubscriber).Unsubscribe("x"))
+		})
+	}
+}
@@ -0,0 +1,695 @@
+package channels
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+)
+
+// Peer to peer defaults
+const (
+	DefaultPeerAddress         = ":9190"
+	DefaultPeerRefreshInterval = 30 * time.Second
+	DefaultPeerDialTimeout     = 5 * time.Second
+	DefaultPeerWriteTimeout    = 10 * time.Second
+	DefaultPeerQueueSize       = 1024
+	DefaultPeerSeenSize        = 16384
+)
+
+// errSelf is returned when dialing an address that turns out to be this node
+var errSelf = errors.New("peer is this node")
+
+// errUnauthenticated is returned for peers that don't prove they know the secret
+var errUnauthenticated = errors.New("peer failed to authenticate")
+
+// PeerConfig for a brokerless channel where nodes forward progresses to each other
+type PeerConfig struct {
+	// Address other nodes connect to
+	Address string
+	// Listener already bound to Address, used instead of listening on it
+	Listener net.Listener
+	// Peers addresses, this node's own address may be listed
+	Peers []string
+	// DNS name resolving to the addresses of all nodes, e.g. a headless service
+	DNS string
+	// Port of the nodes found through DNS, defaults to the port of Address
+	Port int
+	// Node name, only used to make this node recognizable in messages
+	Node string
+	// RefreshInterval at which DNS is resolved again
+	RefreshInterval time.Duration
+	// DialTimeout for connecting and greeting a peer
+	DialTimeout time.Duration
+	// WriteTimeout for a single progress sent to a peer
+	WriteTimeout time.Duration
+	// QueueSize of progresses buffered for an unreachable peer, the oldest are dropped first
+	QueueSize int
+	// SeenSize of the window of message ids remembered to drop duplicates
+	SeenSize int
+	// MinBackoff and MaxBackoff bound the delay between reconnection attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Secret shared by the nodes. Peers prove they know it when connecting and
+	// sign every message with it, anyone else is rejected. Nodes refuse to
+	// listen on other than a loopback address without one.
+	Secret []byte
+	// Codec of the messages, JSON when nil
+	Codec codec.Codec
+}
+
+// peerHello is the first line exchanged on every connection, in both directions
+type peerHello struct {
+	Node  string `json:"node"`
+	Nonce []byte `json:"nonce,omitempty"`
+}
+
+// peerProof follows the hellos when nodes share a secret, in both directions
+type peerProof struct {
+	MAC []byte `json:"mac"`
+}
+
+// peerMessage is an envelope forwarded between nodes, one JSON document per line
+type peerMessage struct {
+	ID       string          `json:"id"`
+	Envelope json.RawMessage `json:"envelope,omitempty"`
+	// Data of the envelope encoded with a binary codec, instead of Envelope
+	Data []byte `json:"data,omitempty"`
+	// MAC of the message with the connection's key when nodes share a secret
+	MAC []byte `json:"mac,omitempty"`
+}
+
+// peerSession of an authenticated connection: messages are signed with a key
+// derived from both ends' nonces, and numbered so none can be replayed
+type peerSession struct {
+	node     string
+	key      []byte
+	sequence uint64
+}
+
+// sign the next message of the session, does nothing without a secret
+func (s *peerSession) sign(message *peerMessage) {
+	if s.key == nil {
+		return
+	}
+	message.MAC = s.mac(message)
+	s.sequence++
+}
+
+// verify the next message of the session
+func (s *peerSession) verify(message *peerMessage) bool {
+	if s.key == nil {
+		return true
+	}
+	if !hmac.Equal(message.MAC, s.mac(message)) {
+		return false
+	}
+	s.sequence++
+	return true
+}
+
+func (s *peerSession) mac(message *peerMessage) []byte {
+	h := hmac.New(sha256.New, s.key)
+	_ = binary.Write(h, binary.BigEndian, s.sequence)
+	_ = binary.Write(h, binary.BigEndian, uint32(len(message.ID)))
+	h.Write([]byte(message.ID))
+	h.Write(message.Envelope)
+	if len(message.Data) > 0 {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(message.Data)))
+		h.Write(message.Data)
+	}
+	return h.Sum(nil)
+}
+
+type peerChannel struct {
+	*lifecycle
+	config   PeerConfig
+	sequence uint64
+	seen     *seenSet
+	out      chan loadr.MetaProgress
+
+	lock     sync.Mutex
+	listener net.Listener
+	peers    map[string]*peer
+	inbound  map[net.Conn]struct{}
+	// refused to start, reported by Push
+	refused error
+}
+
+func (c *peerChannel) Close() error {
+	var err error
+	c.close(func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.listener != nil {
+			err = c.listener.Close()
+		}
+		for _, p := range c.peers {
+			p.stop()
+		}
+		for conn := range c.inbound {
+			_ = conn.Close()
+		}
+	})
+	return err
+}
+
+// Push a progress to this node and queue it for every peer, queueing never blocks
+func (c *peerChannel) Push(ctx context.Context, p loadr.MetaProgress) error {
+	if c.isClosed() {
+		return &loadr.Error{Message: "peer channel closed", Code: loadr.ChannelCloseError}
+	}
+
+	if c.refused != nil {
+		return c.refused
+	}
+
+	data, err := c.encode(ctx, p)
+	if err != nil {
+		return err
+	}
+	message := peerMessage{ID: c.origin + ":" + strconv.FormatUint(atomic.AddUint64(&c.sequence, 1), 10)}
+	if c.codec.Binary() {
+		message.Data = data
+	} else {
+		message.Envelope = data
+	}
+	c.seen.add(message.ID)
+
+	c.lock.Lock()
+	for _, peer := range c.peers {
+		peer.enqueue(message)
+	}
+	c.lock.Unlock()
+
+	c.deliver(c.out, p)
+	return nil
+}
+
+func (c *peerChannel) Progresses() <-chan loadr.MetaProgress {
+	return c.out
+}
+
+// listen for peers until closed, retrying when the address can't be bound
+func (c *peerChannel) listen() {
+	retry := &backoff{min: c.config.MinBackoff, max: c.config.MaxBackoff}
+
+	listener := c.config.Listener
+	for {
+		var err error
+		if listener == nil {
+			listener, err = net.Listen("tcp", c.config.Address)
+		}
+		if err != nil {
+			delay := retry.next()
+			c.setConnected(false, fmt.Sprintf("error listening on %s, retrying in %s: %s", c.config.Address, delay, err))
+			if !c.sleep(delay) {
+				return
+			}
+			continue
+		}
+
+		c.lock.Lock()
+		if c.isClosed() {
+			c.lock.Unlock()
+			_ = listener.Close()
+			return
+		}
+		c.listener = listener
+		c.lock.Unlock()
+		retry.reset()
+
+		c.setConnected(true, fmt.Sprintf("listening for peers on %s", listener.Addr()))
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			go c.serve(conn)
+		}
+		if c.isClosed() {
+			return
+		}
+		listener = nil
+	}
+}
+
+// serve an inbound connection, delivering the progresses it carries
+func (c *peerChannel) serve(conn net.Conn) {
+	c.lock.Lock()
+	if c.isClosed() {
+		c.lock.Unlock()
+		_ = conn.Close()
+		return
+	}
+	c.inbound[conn] = struct{}{}
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.inbound, conn)
+		c.lock.Unlock()
+		_ = conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	session, err := c.greet(conn, reader, false)
+	if err != nil {
+		if err == errUnauthenticated {
+			c.reject(conn)
+		}
+		return
+	}
+
+	decoder := json.NewDecoder(reader)
+	for {
+		message := peerMessage{}
+		if err := decoder.Decode(&message); err != nil {
+			var syntax *json.SyntaxError
+			if errors.As(err, &syntax) && !c.isClosed() {
+				c.emit(&loadr.Error{
+					Message: fmt.Sprintf("error unmarshalling progress from %s: %s", conn.RemoteAddr(), err),
+					Code:    loadr.ChannelUnmarshalError,
+				})
+			}
+			return
+		}
+		if !session.verify(&message) {
+			c.reject(conn)
+			return
+		}
+		if (message.Envelope == nil && message.Data == nil) || !c.seen.add(message.ID) {
+			continue
+		}
+		if message.Data != nil {
+			c.receive(c.out, message.Data)
+			continue
+		}
+		e := &envelope.Envelope{}
+		if err := json.Unmarshal(message.Envelope, e); err != nil {
+			c.emit(&loadr.Error{
+				Message: fmt.Sprintf("error unmarshalling progress from %s: %s", conn.RemoteAddr(), err),
+				Code:    loadr.ChannelUnmarshalError,
+			})
+			continue
+		}
+		c.accept(c.out, e)
+	}
+}
+
+// reject a connection that failed to authenticate
+func (c *peerChannel) reject(conn net.Conn) {
+	if c.isClosed() {
+		return
+	}
+	c.emit(&loadr.Error{
+		Message: fmt.Sprintf("rejected peer %s: %s", conn.RemoteAddr(), errUnauthenticated),
+		Code:    loadr.ChannelPeerError,
+	})
+}
+
+// greet the other end of a connection. With a secret both ends prove they
+// know it, the session signs the messages the dialing end sends.
+func (c *peerChannel) greet(conn net.Conn, reader *bufio.Reader, dialing bool) (*peerSession, error) {
+	_ = conn.SetDeadline(time.Now().Add(c.config.DialTimeout))
+	defer conn.SetDeadline(time.Time{}) // nolint: errcheck
+
+	hello := peerHello{Node: c.origin}
+	if c.config.Secret != nil {
+		hello.Nonce = make([]byte, 16)
+		if _, err := rand.Read(hello.Nonce); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(hello); err != nil {
+		return nil, err
+	}
+	other := peerHello{}
+	if err := readLine(reader, &other); err != nil {
+		return nil, err
+	}
+	session := &peerSession{node: other.Node}
+	if c.config.Secret == nil {
+		return session, nil
+	}
+	if len(other.Nonce) == 0 {
+		return nil, errUnauthenticated
+	}
+
+	// Each end signs the other's nonce, so proofs can't be replayed
+	if err := json.NewEncoder(conn).Encode(peerProof{MAC: c.proof(other.Nonce, hello.Nonce, hello.Node)}); err != nil {
+		return nil, err
+	}
+	proof := peerProof{}
+	if err := readLine(reader, &proof); err != nil {
+		return nil, errUnauthenticated
+	}
+	if !hmac.Equal(proof.MAC, c.proof(hello.Nonce, other.Nonce, other.Node)) {
+		return nil, errUnauthenticated
+	}
+
+	// Messages go from the dialing end to the other one
+	sender, receiver := other.Nonce, hello.Nonce
+	if dialing {
+		sender, receiver = hello.Nonce, other.Nonce
+	}
+	session.key = c.mac([]byte("message"), sender, receiver)
+	return session, nil
+}
+
+// proof that a node knows the secret, over the nonce it was challenged with
+func (c *peerChannel) proof(challenge, nonce []byte, node string) []byte {
+	return c.mac([]byte("hello"), challenge, nonce, []byte(node))
+}
+
+// mac of length prefixed parts with the secret
+func (c *peerChannel) mac(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, c.config.Secret)
+	for _, part := range parts {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(part)))
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// readLine of JSON into v
+func readLine(reader *bufio.Reader, v interface{}) error {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(line, v); err != nil {
+		return fmt.Errorf("invalid greeting: %s", err)
+	}
+	return nil
+}
+
+// dial a peer and greet it
+func (c *peerChannel) dial(address string) (net.Conn, *peerSession, error) {
+	conn, err := net.DialTimeout("tcp", address, c.config.DialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := c.greet(conn, bufio.NewReader(conn), true)
+	if err == nil && session.node == c.origin {
+		err = errSelf
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, session, nil
+}
+
+// setPeers starts forwarding to new addresses and stops forwarding to the missing ones
+func (c *peerChannel) setPeers(addresses []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.isClosed() {
+		return
+	}
+
+	wanted := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		wanted[address] = true
+		if _, ok := c.peers[address]; !ok {
+			p := newPeer(c, address)
+			c.peers[address] = p
+			go p.run()
+		}
+	}
+	for address, p := range c.peers {
+		if !wanted[address] {
+			p.stop()
+			delete(c.peers, address)
+		}
+	}
+}
+
+// discover peers through DNS until closed, the static ones are always kept
+func (c *peerChannel) discover() {
+	for {
+		hosts, err := net.LookupHost(c.config.DNS)
+		if err != nil {
+			// Keep the peers known so far rather than dropping them all
+			c.emit(&loadr.Error{
+				Message: fmt.Sprintf("error resolving peers from '%s': %s", c.config.DNS, err),
+				Code:    loadr.ChannelPeerError,
+			})
+		} else {
+			addresses := append([]string{}, c.config.Peers...)
+			for _, host := range hosts {
+				addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(c.config.Port)))
+			}
+			c.setPeers(addresses)
+		}
+
+		if !c.sleep(c.config.RefreshInterval) {
+			return
+		}
+	}
+}
+
+// peer forwards progresses to another node over a persistent connection
+type peer struct {
+	channel  *peerChannel
+	address  string
+	queue    chan peerMessage
+	done     chan struct{}
+	stopOnce sync.Once
+	self     int32
+}
+
+// enqueue a message, dropping the oldest queued one when the peer lags behind
+func (p *peer) enqueue(message peerMessage) {
+	if atomic.LoadInt32(&p.self) == 1 {
+		return
+	}
+	for {
+		select {
+		case p.queue <- message:
+			return
+		default:
+		}
+		select {
+		case <-p.queue:
+		default:
+		}
+	}
+}
+
+func (p *peer) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+// run connects to the peer and sends it queued messages, reconnecting until stopped
+func (p *peer) run() {
+	retry := &backoff{min: p.channel.config.MinBackoff, max: p.channel.config.MaxBackoff}
+	var pending *peerMessage
+	failing := false
+
+	for {
+		conn, session, err := p.channel.dial(p.address)
+		if err == errSelf {
+			atomic.StoreInt32(&p.self, 1)
+			return
+		}
+		if err == nil {
+			retry.reset()
+			failing = false
+			pending, err = p.send(conn, session, pending)
+			_ = conn.Close()
+		}
+		if p.stopped() {
+			return
+		}
+
+		delay := retry.next()
+		if !failing {
+			// Only the first failure is reported, until the peer is reachable again
+			failing = true
+			p.channel.emit(&loadr.Error{
+				Message: fmt.Sprintf("peer %s unreachable, retrying: %s", p.address, err),
+				Code:    loadr.ChannelPeerError,
+			})
+		}
+		select {
+		case <-p.done:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send queued messages until the connection fails or the peer is stopped.
+// A message that couldn't be written is returned to be sent again.
+func (p *peer) send(conn net.Conn, session *peerSession, pending *peerMessage) (*peerMessage, error) {
+	// Nothing is ever sent back after the greeting, so a read only returns once the connection is gone
+	gone := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		if err == nil {
+			err = errors.New("unexpected data from peer")
+		}
+		gone <- err
+	}()
+
+	encoder := json.NewEncoder(conn)
+	for {
+		if pending == nil {
+			select {
+			case <-p.done:
+				return nil, nil
+			case err := <-gone:
+				return nil, err
+			case message := <-p.queue:
+				pending = &message
+			}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(p.channel.config.WriteTimeout))
+		session.sign(pending)
+		if err := encoder.Encode(pending); err != nil {
+			return pending, err
+		}
+		pending = nil
+	}
+}
+
+func (p *peer) stopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func newPeer(channel *peerChannel, address string) *peer {
+	return &peer{
+		channel: channel,
+		address: address,
+		queue:   make(chan peerMessage, channel.config.QueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// seenSet remembers the last ids added to it
+type seenSet struct {
+	lock  sync.Mutex
+	ids   map[string]struct{}
+	order []string
+	next  int
+}
+
+// add an id, returns false if it was already seen
+func (s *seenSet) add(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if evicted := s.order[s.next]; evicted != "" {
+		delete(s.ids, evicted)
+	}
+	s.order[s.next] = id
+	s.next = (s.next + 1) % len(s.order)
+	s.ids[id] = struct{}{}
+	return true
+}
+
+func newSeenSet(size int) *seenSet {
+	return &seenSet{
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+func newPeerChannel(config PeerConfig) loadr.Channel {
+	if strings.TrimSpace(config.Address) == "" {
+		config.Address = DefaultPeerAddress
+		if config.Listener != nil {
+			config.Address = config.Listener.Addr().String()
+		}
+	}
+	if config.Port <= 0 {
+		if _, port, err := net.SplitHostPort(config.Address); err == nil {
+			config.Port, _ = strconv.Atoi(port)
+		}
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultPeerRefreshInterval
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DefaultPeerDialTimeout
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultPeerWriteTimeout
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultPeerQueueSize
+	}
+	if config.SeenSize <= 0 {
+		config.SeenSize = DefaultPeerSeenSize
+	}
+	config.MinBackoff, config.MaxBackoff = backoffBounds(config.MinBackoff, config.MaxBackoff)
+
+	result := &peerChannel{
+		lifecycle: newLifecycle(config.Codec),
+		config:    config,
+		seen:      newSeenSet(config.SeenSize),
+		out:       make(chan loadr.MetaProgress, config.QueueSize),
+		peers:     make(map[string]*peer),
+		inbound:   make(map[net.Conn]struct{}),
+	}
+	result.origin = newNodeID(config.Node)
+
+	if config.Secret == nil && !loopback(config.Address) {
+		result.refused = &loadr.Error{
+			Message: fmt.Sprintf("refusing to accept peers on %s without a secret", config.Address),
+			Code:    loadr.ChannelPeerError,
+		}
+		if config.Listener != nil {
+			_ = config.Listener.Close()
+		}
+		go result.emit(result.refused)
+		return result
+	}
+
+	// Static peers are known right away so nothing pushed from now on misses them
+	result.setPeers(config.Peers)
+	go result.listen()
+	if config.DNS != "" {
+		go result.discover()
+	}
+
+	return result
+}
+
+// loopback reports whether an address only accepts connections from this host
+func loopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,170 @@
+package channels
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+	"github.com/stretchr/testify/assert"
+)
+
+func listen(t *testing.T, address string) net.Listener {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+// waitError skips errors until one with the code shows up, peers report
+// failures on their own schedule
+func waitError(t *testing.T, c loadr.Channel, code uint) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-c.Errors():
+			if e, ok := err.(*loadr.Error); ok && e.Code == code {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expected error code %d", code)
+		}
+	}
+}
+
+func newTestPeer(listener net.Listener, peers ...string) loadr.Channel {
+	return newPeerChannel(PeerConfig{
+		Listener:   listener,
+		Peers:      peers,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Secret:     []byte("secret"),
+	})
+}
+
+func TestPeerChannel_Broadcast(t *testing.T) {
+	listenerA, listenerB := listen(t, "127.0.0.1:0"), listen(t, "127.0.0.1:0")
+	portB := listenerB.Addr().(*net.TCPAddr).Port
+
+	// Every node lists all of them, b twice under different names
+	peers := []string{listenerA.Addr().String(), listenerB.Addr().String(), "localhost:" + strconv.Itoa(portB)}
+	a := newTestPeer(listenerA, peers...)
+	defer a.Close() // nolint: errcheck
+	b := newTestPeer(listenerB, peers...)
+	defer b.Close() // nolint: errcheck
+	waitError(t, a, loadr.ChannelReconnectedError)
+	waitError(t, b, loadr.ChannelReconnectedError)
+
+	progress := loadr.MetaProgress{Token: "tenant/x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, a.Push(context.Background(), progress))
+	expectProgress(t, a, progress)
+	expectProgress(t, b, progress)
+
+	select {
+	case p := <-b.Progresses():
+		t.Fatalf("duplicate progress %v", p)
+	case p := <-a.Progresses():
+		t.Fatalf("progress looped back %v", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPeerChannel_Codec(t *testing.T) {
+	listenerA, listenerB := listen(t, "127.0.0.1:0"), listen(t, "127.0.0.1:0")
+	peers := []string{listenerA.Addr().String(), listenerB.Addr().String()}
+	node := func(listener net.Listener) loadr.Channel {
+		return newPeerChannel(PeerConfig{
+			Listener:   listener,
+			Peers:      peers,
+			MinBackoff: 10 * time.Millisecond,
+			MaxBackoff: 50 * time.Millisecond,
+			Secret:     []byte("secret"),
+			Codec:      codec.MsgPack,
+		})
+	}
+	a := node(listenerA)
+	defer a.Close() // nolint: errcheck
+	b := node(listenerB)
+	defer b.Close() // nolint: errcheck
+	waitError(t, a, loadr.ChannelReconnectedError)
+	waitError(t, b, loadr.ChannelReconnectedError)
+
+	// Binary envelopes are signed and forwarded like JSON ones
+	progress := loadr.MetaProgress{Token: "tenant/x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, a.Push(context.Background(), progress))
+	expectProgress(t, b, progress)
+}
+
+func TestPeerChannel_PeerFailure(t *testing.T) {
+	listenerB := listen(t, "127.0.0.1:0")
+	addressB := listenerB.Addr().String()
+	a := newTestPeer(listen(t, "127.0.0.1:0"), addressB)
+	defer a.Close() // nolint: errcheck
+	b := newTestPeer(listenerB)
+	waitError(t, b, loadr.ChannelReconnectedError)
+
+	assert.NoError(t, b.Close())
+	waitError(t, a, loadr.ChannelPeerError)
+
+	// Queued while b is down, sent once it is back
+	progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, a.Push(context.Background(), progress))
+	expectProgress(t, a, progress)
+
+	b = newTestPeer(listen(t, addressB))
+	defer b.Close() // nolint: errcheck
+	waitError(t, b, loadr.ChannelReconnectedError)
+	expectProgress(t, b, progress)
+}
+
+func TestPeerChannel_Authentication(t *testing.T) {
+	listener := listen(t, "127.0.0.1:0")
+	a := newTestPeer(listener)
+	defer a.Close() // nolint: errcheck
+	waitError(t, a, loadr.ChannelReconnectedError)
+	progress := loadr.MetaProgress{Token: "tenant/x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+
+	// A node with another secret
+	intruder := newPeerChannel(PeerConfig{Listener: listen(t, "127.0.0.1:0"), Peers: []string{listener.Addr().String()}, Secret: []byte("guess")})
+	defer intruder.Close() // nolint: errcheck
+	assert.NoError(t, intruder.Push(context.Background(), progress))
+	waitError(t, a, loadr.ChannelPeerError)
+
+	// A client writing messages without authenticating
+	for _, greeting := range []string{`{"node":"intruder"}`, `{"node":"intruder","nonce":"AAAAAAAAAAAAAAAAAAAAAA=="}` + "\n" + `{"mac":"AAAA"}`} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		data, _ := json.Marshal(envelope.New(context.Background(), "intruder", progress))
+		message, _ := json.Marshal(peerMessage{ID: "intruder:1", Envelope: data})
+		_, err = conn.Write([]byte(greeting + "\n" + string(message) + "\n"))
+		assert.NoError(t, err)
+		waitError(t, a, loadr.ChannelPeerError)
+		_ = conn.Close()
+	}
+
+	select {
+	case p := <-a.Progresses():
+		t.Fatalf("progress from an unauthenticated peer %v", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestPeerChannel_RefusesInsecureAddress(t *testing.T) {
+	c := newPeerChannel(PeerConfig{Address: "0.0.0.0:0"})
+	defer c.Close() // nolint: errcheck
+	waitError(t, c, loadr.ChannelPeerError)
+	assert.Error(t, c.Push(context.Background(), loadr.MetaProgress{Token: "x"}))
+
+	local := newPeerChannel(PeerConfig{Address: "127.0.0.1:0"})
+	defer local.Close() // nolint: errcheck
+	waitError(t, local, loadr.ChannelReconnectedError)
+	assert.NoError(t, local.Push(context.Background(), loadr.MetaProgress{Token: "x"}))
+}
@@ -0,0 +1,250 @@
+package channels
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/lib/pq"
+)
+
+// PostgreSQL defaults
+const (
+	DefaultPostgresChannel      = "loadr"
+	DefaultPostgresPayloadTable = "loadr_payloads"
+	// DefaultPostgresMaxPayload stays under the 8000 bytes NOTIFY accepts by default
+	DefaultPostgresMaxPayload = 7900
+	// DefaultPostgresPayloadRetention long enough for every node to read a large payload
+	DefaultPostgresPayloadRetention = time.Minute
+	DefaultPostgresPingInterval     = 30 * time.Second
+)
+
+// payloadReference prefixes notifications whose progress was too large to be
+// sent inline and is stored in the payload table instead
+const payloadReference = "@"
+
+// PostgresConfig for a channel over PostgreSQL LISTEN/NOTIFY
+type PostgresConfig struct {
+	// DSN connection string, as understood by lib/pq
+	DSN string
+	// Channel notified and listened on
+	Channel string
+	// PayloadTable holds progresses too large to be sent as a notification payload
+	PayloadTable string
+	// MaxPayload size sent inline, larger progresses go through PayloadTable
+	MaxPayload int
+	// PayloadRetention after which stored payloads are deleted
+	PayloadRetention time.Duration
+	// PingInterval at which the listening connection is checked
+	PingInterval time.Duration
+	// MinBackoff and MaxBackoff bound the delay between reconnection attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Codec of the messages, JSON when nil. Notification payloads are text, so
+	// binary ones always go through PayloadTable.
+	Codec codec.Codec
+}
+
+type postgresChannel struct {
+	*lifecycle
+	db       *sql.DB
+	listener *pq.Listener
+	events   chan pq.ListenerEventType
+	out      chan loadr.MetaProgress
+	config   PostgresConfig
+	table    string
+
+	tableLock    sync.Mutex
+	tableCreated bool
+}
+
+func (p *postgresChannel) Close() error {
+	var err error
+	p.close(func() {
+		err = p.listener.Close()
+		if dbErr := p.db.Close(); err == nil {
+			err = dbErr
+		}
+	})
+	return err
+}
+
+// Push a progress as a notification, storing it aside when too large
+func (p *postgresChannel) Push(ctx context.Context, progress loadr.MetaProgress) error {
+	bytes, err := p.encode(ctx, progress)
+	if err != nil {
+		return err
+	}
+
+	payload := string(bytes)
+	if len(bytes) > p.config.MaxPayload || p.codec.Binary() {
+		if payload, err = p.store(ctx, bytes); err != nil {
+			return err
+		}
+	}
+
+	if _, err = p.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, p.config.Channel, payload); err != nil {
+		return err
+	}
+	p.deliver(p.out, progress)
+	return nil
+}
+
+func (p *postgresChannel) Progresses() <-chan loadr.MetaProgress {
+	return p.out
+}
+
+// store a large payload and return the reference to notify instead
+func (p *postgresChannel) store(ctx context.Context, bytes []byte) (string, error) {
+	if err := p.createTable(); err != nil {
+		return "", err
+	}
+
+	var id int64
+	row := p.db.QueryRowContext(ctx, `INSERT INTO `+p.table+` (payload) VALUES ($1) RETURNING id`, bytes)
+	if err := row.Scan(&id); err != nil {
+		return "", fmt.Errorf("error storing payload: %s", err)
+	}
+
+	// Cleaning up on write keeps the table small without a separate janitor
+	_, _ = p.db.ExecContext(ctx, `DELETE FROM `+p.table+` WHERE created_at < now() - $1::interval`,
+		fmt.Sprintf("%d milliseconds", p.config.PayloadRetention.Milliseconds()))
+
+	return payloadReference + strconv.FormatInt(id, 10), nil
+}
+
+// load a payload stored aside by another node
+func (p *postgresChannel) load(reference string) ([]byte, error) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(reference, payloadReference), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload reference '%s'", reference)
+	}
+	var bytes []byte
+	if err := p.db.QueryRow(`SELECT payload FROM `+p.table+` WHERE id = $1`, id).Scan(&bytes); err != nil {
+		return nil, fmt.Errorf("error loading payload %d: %s", id, err)
+	}
+	return bytes, nil
+}
+
+func (p *postgresChannel) createTable() error {
+	p.tableLock.Lock()
+	defer p.tableLock.Unlock()
+	if p.tableCreated {
+		return nil
+	}
+	_, err := p.db.Exec(`CREATE TABLE IF NOT EXISTS ` + p.table + ` (
+		id         bigserial PRIMARY KEY,
+		payload    bytea NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating payload table: %s", err)
+	}
+	p.tableCreated = true
+	return nil
+}
+
+// listen on the channel, the listener keeps listening across reconnections
+func (p *postgresChannel) listen() {
+	if err := p.listener.Listen(p.config.Channel); err != nil {
+		if !p.isClosed() {
+			p.emit(&loadr.Error{
+				Message: fmt.Sprintf("error listening on '%s': %s", p.config.Channel, err),
+				Code:    loadr.ChannelSubscribeError,
+			})
+		}
+		return
+	}
+	p.setConnected(true, fmt.Sprintf("listening on postgres channel '%s'", p.config.Channel))
+}
+
+// read notifications and connection events until closed
+func (p *postgresChannel) read() {
+	ticker := time.NewTicker(p.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case event := <-p.events:
+			switch event {
+			case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+				p.setConnected(false, "postgres listener disconnected")
+			case pq.ListenerEventReconnected:
+				p.setConnected(true, fmt.Sprintf("listening on postgres channel '%s'", p.config.Channel))
+			}
+		case <-ticker.C:
+			// A dead connection is only noticed when used
+			go p.listener.Ping() // nolint: errcheck
+		case notification := <-p.listener.Notify:
+			// nil is sent after a reconnection, notifications may have been lost meanwhile
+			if notification != nil {
+				p.handle(notification.Extra)
+			}
+		}
+	}
+}
+
+func (p *postgresChannel) handle(payload string) {
+	bytes := []byte(payload)
+	if strings.HasPrefix(payload, payloadReference) {
+		var err error
+		if bytes, err = p.load(payload); err != nil {
+			p.emit(&loadr.Error{Message: err.Error(), Code: loadr.ChannelUnmarshalError})
+			return
+		}
+	}
+	p.receive(p.out, bytes)
+}
+
+func newPostgresChannel(config PostgresConfig) loadr.Channel {
+	if strings.TrimSpace(config.Channel) == "" {
+		config.Channel = DefaultPostgresChannel
+	}
+	if strings.TrimSpace(config.PayloadTable) == "" {
+		config.PayloadTable = DefaultPostgresPayloadTable
+	}
+	if config.MaxPayload <= 0 {
+		config.MaxPayload = DefaultPostgresMaxPayload
+	}
+	if config.PayloadRetention <= 0 {
+		config.PayloadRetention = DefaultPostgresPayloadRetention
+	}
+	if config.PingInterval <= 0 {
+		config.PingInterval = DefaultPostgresPingInterval
+	}
+	config.MinBackoff, config.MaxBackoff = backoffBounds(config.MinBackoff, config.MaxBackoff)
+
+	// sql.Open only validates its arguments, lib/pq never fails here
+	db, _ := sql.Open("postgres", config.DSN)
+
+	result := &postgresChannel{
+		lifecycle: newLifecycle(config.Codec),
+		db:        db,
+		events:    make(chan pq.ListenerEventType, 16),
+		out:       make(chan loadr.MetaProgress, outBuffer),
+		config:    config,
+		table:     pq.QuoteIdentifier(config.PayloadTable),
+	}
+	// The callback runs on the listener's dispatching goroutine, hand events over
+	// to read so a slow consumer of Errors() doesn't hold notifications back
+	result.listener = pq.NewListener(config.DSN, config.MinBackoff, config.MaxBackoff,
+		func(event pq.ListenerEventType, err error) {
+			select {
+			case result.events <- event:
+			default:
+			}
+		})
+
+	go result.listen()
+	go result.read()
+
+	return result
+}
@@ -0,0 +1,41 @@
+package channels
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs against the database at LOADR_TEST_POSTGRES, e.g. postgres://postgres@localhost/loadr?sslmode=disable
+func TestPostgresChannel_PushAndReceive(t *testing.T) {
+	dsn := os.Getenv("LOADR_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("LOADR_TEST_POSTGRES not set")
+	}
+
+	// Binary payloads can't be notified, they are all stored aside
+	for _, c := range []codec.Codec{codec.JSON, codec.MsgPack} {
+		t.Run(c.Name(), func(t *testing.T) {
+			config := PostgresConfig{DSN: dsn, Channel: "loadr_test", PayloadTable: "loadr_test_payloads", Codec: c}
+			a := newPostgresChannel(config)
+			defer a.Close() // nolint: errcheck
+			b := newPostgresChannel(config)
+			defer b.Close() // nolint: errcheck
+			expectError(t, a, loadr.ChannelReconnectedError)
+			expectError(t, b, loadr.ChannelReconnectedError)
+
+			small := loadr.MetaProgress{Token: "tenant/x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+			large := loadr.MetaProgress{Token: "tenant/y", Progress: loadr.Progress{Stage: strings.Repeat("b", 10000), Progress: 1}}
+			for _, progress := range []loadr.MetaProgress{small, large} {
+				assert.NoError(t, a.Push(context.Background(), progress))
+				expectProgress(t, a, progress)
+				expectProgress(t, b, progress)
+			}
+		})
+	}
+}
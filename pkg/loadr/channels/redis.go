@@ -1,144 +1,444 @@
 package channels
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sinea/loadr/pkg/loadr"
-	"github.com/garyburd/redigo/redis"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/gomodule/redigo/redis"
 )
 
 const DefaultRedisQueue = "loadr"
 
+// Redis connection defaults
+const (
+	DefaultRedisMaxIdle             = 3
+	DefaultRedisIdleTimeout         = 4 * time.Minute
+	DefaultRedisHealthCheckInterval = 15 * time.Second
+	DefaultRedisDialTimeout         = 5 * time.Second
+	// DefaultRedisShards spread tokens over with Sharded and PerToken
+	DefaultRedisShards = 256
+)
+
 type RedisConfig struct {
 	Address string
 	Queue   *string
+	// Username and Password to authenticate with, Username is only needed with ACL users
+	Username string
+	Password string
+	// Database selected on connection, not supported by Cluster
+	Database int
+	// TLS configuration, connections are in plain text when nil
+	TLS *tls.Config
+	// DialTimeout bounds establishing connections
+	DialTimeout time.Duration
+	// SentinelAddresses of the Sentinels monitoring SentinelMaster, Address is
+	// ignored when set and connections follow the master across failovers
+	SentinelAddresses []string
+	SentinelMaster    string
+	// SentinelUsername and SentinelPassword authenticate with the Sentinels
+	SentinelUsername string
+	SentinelPassword string
+	// ClusterAddresses of some nodes of a Redis Cluster, Address is ignored when set
+	ClusterAddresses []string
+	// Sharded uses sharded pub/sub (SPUBLISH and SSUBSCRIBE, Redis 7+), so a
+	// Cluster only sends progresses to the nodes of their topic's slot rather than
+	// to all of them. It is best used with Shards, every topic has its own subscription.
+	// With PerToken that would be a connection per token, so tokens are spread over
+	// DefaultRedisShards topics instead unless Shards is set.
+	Sharded bool
+	// MaxIdle connections kept in the pool
+	MaxIdle int
+	// MaxActive connections allocated by the pool at once, 0 means unlimited
+	MaxActive int
+	// IdleTimeout after which idle connections are closed
+	IdleTimeout time.Duration
+	// HealthCheckInterval at which connections are checked with a PING
+	HealthCheckInterval time.Duration
+	// MinBackoff and MaxBackoff bound the delay between resubscription attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PerToken publishes every token on its own topic under Queue, nodes only
+	// receive the tokens they have subscribers for
+	PerToken bool
+	// Shards spreads tokens over this many topics under Queue instead of one per
+	// token, nodes receive the shards of the tokens they have subscribers for
+	Shards int
+	// Codec of the messages, JSON when nil. All nodes must use the same one,
+	// though JSON messages are still decoded while switching.
+	Codec codec.Codec
+}
+
+func (c *RedisConfig) setDefaults() {
+	if c.Queue == nil || strings.TrimSpace(*c.Queue) == "" {
+		t := DefaultRedisQueue
+		c.Queue = &t
+	}
+	if c.MaxIdle <= 0 {
+		c.MaxIdle = DefaultRedisMaxIdle
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = DefaultRedisIdleTimeout
+	}
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = DefaultRedisHealthCheckInterval
+	}
+	c.MinBackoff, c.MaxBackoff = backoffBounds(c.MinBackoff, c.MaxBackoff)
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = DefaultRedisDialTimeout
+	}
+	if c.Sharded && c.PerToken && c.Shards <= 0 {
+		c.Shards = DefaultRedisShards
+	}
 }
 
 type redisChannel struct {
-	pool      *redis.Pool
-	out       chan loadr.MetaProgress
-	errors    chan error
-	isRunning bool
-	config    RedisConfig
+	*lifecycle
+	connections  *redisConnections
+	out          chan loadr.MetaProgress
+	lock         sync.Mutex
+	subscription *redis.PubSubConn
+	// writeLock orders the commands sent on the subscription
+	writeLock sync.Mutex
+	interests interests
+	// shards subscribed to with Sharded, stopped by closing their channel
+	shards map[string]chan struct{}
+	// shardStates tells whether the reader of each shard, by its stop channel,
+	// is subscribed, the channel is only connected while all of them are
+	shardStates map[chan struct{}]bool
+	stateLock   sync.Mutex
+	config      RedisConfig
 }
 
 func (r *redisChannel) Close() error {
-	r.isRunning = false
-	return nil
+	r.close(func() {
+		r.lock.Lock()
+		if r.subscription != nil {
+			// Unblocks the reader
+			_ = r.subscription.Close()
+		}
+		for topic, stop := range r.shards {
+			close(stop)
+			delete(r.shards, topic)
+		}
+		r.lock.Unlock()
+	})
+	return r.connections.Close()
 }
 
-func (r *redisChannel) Push(p loadr.MetaProgress) error {
-	connection := r.pool.Get()
-	bytes, err := json.Marshal(p)
+func (r *redisChannel) Push(ctx context.Context, p loadr.MetaProgress) error {
+	bytes, err := r.encode(ctx, p)
 	if err != nil {
 		return err
 	}
-	if _, err := connection.Do("PUBLISH", r.config.Queue, bytes); err != nil {
+	if _, err := r.connections.do(ctx, r.publishCommand(), r.topic(p.Token), bytes); err != nil {
 		return err
 	}
+	r.deliver(r.out, p)
 	return nil
 }
 
-func (r *redisChannel) Progresses() <-chan loadr.MetaProgress {
-	return r.out
+func (r *redisChannel) publishCommand() string {
+	if r.config.Sharded {
+		return "SPUBLISH"
+	}
+	return "PUBLISH"
+}
+
+// Publication of a progress as Push would publish it
+func (r *redisChannel) Publication(ctx context.Context, p loadr.MetaProgress) (string, string, []byte, error) {
+	bytes, err := r.encode(ctx, p)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return r.publishCommand(), r.topic(p.Token), bytes, nil
+}
+
+// Published progress, delivered to this node's clients as Push would
+func (r *redisChannel) Published(p loadr.MetaProgress) {
+	r.deliver(r.out, p)
+}
+
+// Subscribe to the topic of a token, only needed with PerToken or Shards
+func (r *redisChannel) Subscribe(token loadr.Token) error {
+	return r.updateInterest(token, true)
+}
+
+// Unsubscribe from the topic of a token once no other token needs it
+func (r *redisChannel) Unsubscribe(token loadr.Token) error {
+	return r.updateInterest(token, false)
+}
+
+func (r *redisChannel) updateInterest(token loadr.Token, interested bool) error {
+	if !r.routed() {
+		return nil
+	}
+	topic := r.topic(token)
+
+	r.writeLock.Lock()
+	defer r.writeLock.Unlock()
+
+	r.lock.Lock()
+	var changed bool
+	if interested {
+		changed = r.interests.add(topic)
+	} else {
+		changed = r.interests.remove(topic)
+	}
+	subscription := r.subscription
+	if changed && r.config.Sharded {
+		r.setShard(topic, interested)
+	}
+	r.lock.Unlock()
+
+	if r.config.Sharded {
+		return nil
+	}
+
+	// Without a subscription the topic is subscribed to on the next one
+	if !changed || subscription == nil {
+		return nil
+	}
+	if interested {
+		return subscription.Subscribe(topic)
+	}
+	return subscription.Unsubscribe(topic)
+}
+
+// routed reports whether progresses are routed by token
+func (r *redisChannel) routed() bool {
+	return r.config.PerToken || r.config.Shards > 0
+}
+
+// topic a token's progresses are published on
+func (r *redisChannel) topic(token loadr.Token) string {
+	switch {
+	case r.config.Shards > 0:
+		return *r.config.Queue + ":" + strconv.Itoa(shard(token, r.config.Shards))
+	case r.config.PerToken:
+		return *r.config.Queue + ":" + topicToken(token)
+	default:
+		return *r.config.Queue
+	}
+}
+
+// RedisPool of the connections used by a Redis channel, nil for any other channel.
+// Other components can use it to share the channel's Redis connections.
+func RedisPool(channel loadr.Channel) RedisConnections {
+	switch r := channel.(type) {
+	case *redisChannel:
+		return r.connections
+	case *redisStream:
+		return r.connections
+	default:
+		return nil
+	}
+}
+
+// Publisher publishes progresses on behalf of a Redis channel, e.g. from a
+// script that also saves them
+type Publisher interface {
+	// Publication of a progress: the command, topic and message Push would publish
+	Publication(context.Context, loadr.MetaProgress) (command string, topic string, message []byte, err error)
+	// Published progress, delivered to this node's clients as Push would
+	Published(loadr.MetaProgress)
 }
 
-func (r *redisChannel) Errors() <-chan error {
-	return r.errors
+// RedisPublisher of a Redis pub/sub channel, nil for any other channel. Sharded
+// channels have none, a script can't publish on a topic in another slot.
+func RedisPublisher(channel loadr.Channel) Publisher {
+	if r, ok := channel.(*redisChannel); ok && !r.config.Sharded {
+		return r
+	}
+	return nil
+}
+
+func (r *redisChannel) Progresses() <-chan loadr.MetaProgress {
+	return r.out
 }
 
+// read subscribes and receives progresses, resubscribing with an exponential backoff until closed
 func (r *redisChannel) read() {
-	connection := r.pool.Get()
-	defer r.closeConnection(connection)
+	retry := &backoff{min: r.config.MinBackoff, max: r.config.MaxBackoff}
+
+	for {
+		subscribed, err := r.subscribeAndReceive()
+		if r.isClosed() {
+			return
+		}
+		if subscribed {
+			retry.reset()
+		}
 
+		delay := retry.next()
+		r.setConnected(false, fmt.Sprintf("redis subscription lost, retrying in %s: %s", delay, err))
+		if !r.sleep(delay) {
+			return
+		}
+	}
+}
+
+// subscribeAndReceive until the subscription fails. It reports whether the subscription succeeded.
+func (r *redisChannel) subscribeAndReceive() (bool, error) {
+	// The subscription gets its own connection, pooled ones try to unsubscribe
+	// cleanly when closed, which blocks on a dead connection
+	connection, err := r.connections.dial()
+	if err != nil {
+		return false, err
+	}
 	subscription, err := r.subscribe(connection, *r.config.Queue)
 
 	if err != nil {
-		r.errors <- &loadr.Error{
+		_ = connection.Close()
+		return false, &loadr.Error{
 			Message: fmt.Sprintf("error subscribing: %s", err),
 			Code:    loadr.ChannelSubscribeError,
 		}
-		return
 	}
 
-	r.receive(subscription)
+	// Interests changing meanwhile are sent on this subscription once it is set
+	r.writeLock.Lock()
+	r.lock.Lock()
+	if r.isClosed() {
+		r.lock.Unlock()
+		r.writeLock.Unlock()
+		r.closeSubscription(subscription)
+		return true, nil
+	}
+	r.subscription = subscription
+	topics := r.interests.topics()
+	r.lock.Unlock()
+	if len(topics) > 0 {
+		err = subscription.Subscribe(redis.Args{}.AddFlat(topics)...)
+	}
+	r.writeLock.Unlock()
+	if err != nil {
+		r.closeSubscription(subscription)
+		return true, err
+	}
+
+	r.setConnected(true, "redis subscription established")
+
+	return true, r.consume(subscription)
 }
 
-func (r *redisChannel) receive(subscription *redis.PubSubConn) {
+func (r *redisChannel) consume(subscription *redis.PubSubConn) error {
 	defer r.closeSubscription(subscription)
 
-	for r.isRunning {
-		r.readMessage(subscription)
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.healthCheck(subscription, stop)
+
+	// Pings are answered well within this, so a silent connection is a dead one
+	timeout := 2 * r.config.HealthCheckInterval
+	for {
+		if err := r.readMessage(subscription, timeout); err != nil {
+			return err
+		}
 	}
 }
 
-func (r *redisChannel) readMessage(subscription *redis.PubSubConn) {
-	if message, ok := subscription.Receive().(redis.Message); ok {
-		p := loadr.MetaProgress{}
-		if err := json.Unmarshal(message.Data, &p); err != nil {
-			r.errors <- &loadr.Error{
-				Message: fmt.Sprintf("error unmarshalling progress: %s", err),
-				Code:    loadr.ChannelUnmarshalError,
+// healthCheck pings the subscription so a dead connection is noticed by the reader.
+// A subscription to a former master is closed so the reader follows the failover.
+func (r *redisChannel) healthCheck(subscription *redis.PubSubConn, stop chan struct{}) {
+	ticker := time.NewTicker(r.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if r.connections.stale(subscription.Conn) {
+				_ = subscription.Close()
+				return
+			}
+			r.writeLock.Lock()
+			err := subscription.Ping("")
+			r.writeLock.Unlock()
+			if err != nil {
+				return
 			}
-		} else {
-			r.out <- p
 		}
 	}
 }
 
-func (r *redisChannel) closeSubscription(subscription *redis.PubSubConn) {
-	if err := subscription.Close(); err != nil {
-		r.errors <- &loadr.Error{
-			Message: fmt.Sprintf("error unsubscribing: %s", err),
-			Code:    loadr.ChannelCloseError,
+func (r *redisChannel) readMessage(subscription *redis.PubSubConn, timeout time.Duration) error {
+	var data []byte
+	switch message := subscription.ReceiveWithTimeout(timeout).(type) {
+	case redis.Message:
+		data = message.Data
+	case redis.Subscription:
+		if message.Count == 0 {
+			return fmt.Errorf("unsubscribed from '%s'", message.Channel)
 		}
+		return nil
+	case error:
+		return message
+	default:
+		return nil
 	}
+
+	r.receive(r.out, data)
+	return nil
 }
 
-func (r *redisChannel) closeConnection(connection redis.Conn) {
-	if err := connection.Close(); err != nil {
-		r.errors <- &loadr.Error{
-			Message: fmt.Sprintf("error closing connection: %s", err),
-			Code:    loadr.ChannelCloseError,
-		}
+func (r *redisChannel) closeSubscription(subscription *redis.PubSubConn) {
+	r.lock.Lock()
+	if r.subscription == subscription {
+		r.subscription = nil
 	}
+	r.lock.Unlock()
+
+	// The subscription is only closed once it failed or the channel is closing,
+	// an error here carries no news
+	_ = subscription.Close()
 }
 
+// subscribe to a queue and wait for the confirmation, so progresses pushed after it are received
 func (r *redisChannel) subscribe(connection redis.Conn, queue string) (*redis.PubSubConn, error) {
 	subscription := &redis.PubSubConn{Conn: connection}
 	if err := subscription.PSubscribe(queue); err != nil {
 		return nil, err
 	}
-	return subscription, nil
-}
-
-func newRedisPool(address string) *redis.Pool {
-	return &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", address)
-		},
+	switch reply := subscription.ReceiveWithTimeout(r.config.HealthCheckInterval).(type) {
+	case redis.Subscription:
+		return subscription, nil
+	case error:
+		return nil, reply
+	default:
+		return nil, fmt.Errorf("unexpected reply %v", reply)
 	}
 }
 
 func newRedisChannel(config RedisConfig) loadr.Channel {
-	pool := newRedisPool(config.Address)
-
-	if config.Queue == nil || strings.TrimSpace(*config.Queue) == "" {
-		t := DefaultRedisQueue
-		config.Queue = &t
-	}
+	config.setDefaults()
 
 	result := &redisChannel{
-		config:    config,
-		isRunning: true,
-		pool:      pool,
-		out:       make(chan loadr.MetaProgress),
-		errors:    make(chan error),
+		lifecycle:   newLifecycle(config.Codec),
+		config:      config,
+		out:         make(chan loadr.MetaProgress, outBuffer),
+		interests:   make(interests),
+		shards:      make(map[string]chan struct{}),
+		shardStates: make(map[chan struct{}]bool),
 	}
+	result.connections = newRedisConnections(&result.config)
 
-	go result.read()
+	switch {
+	case !config.Sharded:
+		go result.read()
+	case !result.routed():
+		// Every progress goes through the queue itself
+		result.lock.Lock()
+		result.setShard(*config.Queue, true)
+		result.lock.Unlock()
+	}
 
 	return result
 }
@@ -0,0 +1,357 @@
+package channels
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+// Cluster redirections followed by a single command
+const redisClusterAttempts = 3
+
+// RedisConnections hands out connections to the Redis deployment of a channel,
+// a single server, a master monitored by Sentinel or a Cluster. Connections of
+// a Cluster are routed by the first key of a command, or by the keys they are
+// bound to with Bind.
+type RedisConnections interface {
+	Get() redis.Conn
+	Close() error
+}
+
+// redisConnections to a single server, a Sentinel master or a Cluster
+type redisConnections struct {
+	config   *RedisConfig
+	pool     *redis.Pool
+	cluster  *redisc.Cluster
+	sentinel *sentinel
+}
+
+func (c *redisConnections) Get() redis.Conn {
+	if c.cluster != nil {
+		return c.cluster.Get()
+	}
+	return c.pool.Get()
+}
+
+func (c *redisConnections) Close() error {
+	if c.sentinel != nil {
+		c.sentinel.stop()
+	}
+	if c.cluster != nil {
+		return c.cluster.Close()
+	}
+	return c.pool.Close()
+}
+
+// dial a connection of its own, e.g. for a subscription. On a Cluster it is
+// bound to the node serving the keys, or to any node without keys.
+func (c *redisConnections) dial(keys ...string) (redis.Conn, error) {
+	switch {
+	case c.cluster != nil:
+		connection, err := c.cluster.Dial()
+		if err != nil {
+			return nil, err
+		}
+		if err := redisc.BindConn(connection, keys...); err != nil {
+			_ = connection.Close()
+			return nil, err
+		}
+		return connection, nil
+	case c.sentinel != nil:
+		return c.sentinel.dial()
+	default:
+		return c.pool.Dial()
+	}
+}
+
+// EachNode runs fn on a connection to every master, only one outside of a Cluster
+func (c *redisConnections) EachNode(fn func(redis.Conn) error) error {
+	if c.cluster != nil {
+		return c.cluster.EachNode(false, func(_ string, connection redis.Conn) error {
+			return fn(connection)
+		})
+	}
+	connection := c.pool.Get()
+	defer connection.Close() // nolint: errcheck
+	return fn(connection)
+}
+
+// stale reports whether a connection doesn't go to the current master anymore
+func (c *redisConnections) stale(connection redis.Conn) bool {
+	return c.sentinel != nil && c.sentinel.stale(connection)
+}
+
+// do runs a command on a pooled connection. Pooled connections can be stale after
+// Redis restarts or fails over, so connection errors are retried once on a fresh
+// one. Cluster redirections are followed.
+func (c *redisConnections) do(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	do := func() (interface{}, error) {
+		connection := c.Get()
+		defer connection.Close() // nolint: errcheck
+		if c.cluster == nil {
+			return redis.DoContext(connection, ctx, command, args...)
+		}
+		// Cluster connections don't take a context, only a timeout
+		if deadline, ok := ctx.Deadline(); ok {
+			return redis.DoWithTimeout(connection, time.Until(deadline), command, args...)
+		}
+		retry, err := redisc.RetryConn(connection, redisClusterAttempts, c.config.MinBackoff)
+		if err != nil {
+			return nil, err
+		}
+		return retry.Do(command, args...)
+	}
+
+	reply, err := do()
+	if !c.retryable(err) || ctx.Err() != nil {
+		return reply, err
+	}
+	if c.sentinel != nil {
+		c.sentinel.refresh()
+	}
+	return do()
+}
+
+// retryable errors are the connection's rather than the command's, or come
+// from a master that became a replica
+func (c *redisConnections) retryable(err error) bool {
+	var redisErr redis.Error
+	if err == nil {
+		return false
+	}
+	if errors.As(err, &redisErr) {
+		return strings.HasPrefix(string(redisErr), "READONLY")
+	}
+	return true
+}
+
+// bind a connection to the Cluster node serving keys, a no-op for other deployments
+func bind(connection redis.Conn, keys ...string) error {
+	if _, ok := connection.(interface{ Bind(...string) error }); !ok {
+		return nil
+	}
+	return redisc.BindConn(connection, keys...)
+}
+
+// dialOptions for servers of the deployment
+func (c *RedisConfig) dialOptions() []redis.DialOption {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(c.DialTimeout),
+		redis.DialUsername(c.Username),
+		redis.DialPassword(c.Password),
+		redis.DialDatabase(c.Database),
+	}
+	if c.TLS != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(c.TLS))
+	}
+	return options
+}
+
+// sentinelDialOptions for the Sentinels, which have credentials of their own
+func (c *RedisConfig) sentinelDialOptions() []redis.DialOption {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(c.DialTimeout),
+		redis.DialReadTimeout(c.DialTimeout),
+		redis.DialWriteTimeout(c.DialTimeout),
+		redis.DialUsername(c.SentinelUsername),
+		redis.DialPassword(c.SentinelPassword),
+	}
+	if c.TLS != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(c.TLS))
+	}
+	return options
+}
+
+func newRedisPool(config *RedisConfig, dial func() (redis.Conn, error), stale func(redis.Conn) bool) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     config.MaxIdle,
+		MaxActive:   config.MaxActive,
+		IdleTimeout: config.IdleTimeout,
+		Wait:        true,
+		Dial:        dial,
+		TestOnBorrow: func(connection redis.Conn, lastUsed time.Time) error {
+			if stale != nil && stale(connection) {
+				return errors.New("connection to a former master")
+			}
+			if time.Since(lastUsed) < config.HealthCheckInterval {
+				return nil
+			}
+			_, err := connection.Do("PING")
+			return err
+		},
+	}
+}
+
+// NewRedisConnections to the deployment described by config, for components
+// that don't share a Redis channel's. Only the connection settings are used.
+func NewRedisConnections(config RedisConfig) RedisConnections {
+	config.setDefaults()
+	return newRedisConnections(&config)
+}
+
+func newRedisConnections(config *RedisConfig) *redisConnections {
+	result := &redisConnections{config: config}
+
+	switch {
+	case len(config.ClusterAddresses) > 0:
+		result.cluster = &redisc.Cluster{
+			StartupNodes: config.ClusterAddresses,
+			DialOptions:  config.dialOptions(),
+			CreatePool: func(address string, options ...redis.DialOption) (*redis.Pool, error) {
+				return newRedisPool(config, func() (redis.Conn, error) {
+					return redis.Dial("tcp", address, options...)
+				}, nil), nil
+			},
+		}
+		// Slots are loaded again on the first redirection if this fails
+		_ = result.cluster.Refresh()
+	case len(config.SentinelAddresses) > 0:
+		result.sentinel = newSentinel(config)
+		result.pool = newRedisPool(config, result.sentinel.dial, result.sentinel.stale)
+	default:
+		result.pool = newRedisPool(config, func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.Address, config.dialOptions()...)
+		}, nil)
+	}
+
+	return result
+}
+
+// sentinel discovers the master of a Sentinel monitored deployment
+type sentinel struct {
+	config *RedisConfig
+	lock   sync.RWMutex
+	master string
+	done   chan struct{}
+	once   sync.Once
+}
+
+// conn as returned by redis.Dial
+type conn interface {
+	redis.ConnWithTimeout
+	redis.ConnWithContext
+}
+
+// masterConn remembers the master it was dialed to
+type masterConn struct {
+	conn
+	address string
+}
+
+// dial the current master, making sure it really is one
+func (s *sentinel) dial() (redis.Conn, error) {
+	address, err := s.resolve()
+	if err != nil {
+		return nil, err
+	}
+	dialed, err := redis.Dial("tcp", address, s.config.dialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	// Connections returned by Dial support timeouts and contexts
+	connection := dialed.(conn)
+	role, err := redis.Values(connection.Do("ROLE"))
+	if err == nil {
+		if len(role) == 0 {
+			err = fmt.Errorf("empty role reply from %s", address)
+		} else if name, _ := redis.String(role[0], nil); name != "master" {
+			err = fmt.Errorf("%s is not a master", address)
+		}
+	}
+	if err != nil {
+		_ = connection.Close()
+		return nil, err
+	}
+	return &masterConn{conn: connection, address: address}, nil
+}
+
+// stale reports whether a connection was dialed to another master than the current one
+func (s *sentinel) stale(connection redis.Conn) bool {
+	if c, ok := connection.(*masterConn); ok {
+		return c.address != s.current()
+	}
+	return false
+}
+
+func (s *sentinel) current() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.master
+}
+
+// resolve the master address by asking the Sentinels in turn
+func (s *sentinel) resolve() (string, error) {
+	failures := make([]string, 0, len(s.config.SentinelAddresses))
+	for _, address := range s.config.SentinelAddresses {
+		master, err := s.ask(address)
+		if err == nil {
+			s.lock.Lock()
+			s.master = master
+			s.lock.Unlock()
+			return master, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", address, err))
+	}
+	return "", fmt.Errorf("no sentinel knows master '%s' (%s)", s.config.SentinelMaster, strings.Join(failures, ", "))
+}
+
+func (s *sentinel) ask(address string) (string, error) {
+	connection, err := redis.Dial("tcp", address, s.config.sentinelDialOptions()...)
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close() // nolint: errcheck
+
+	reply, err := redis.Strings(connection.Do("SENTINEL", "get-master-addr-by-name", s.config.SentinelMaster))
+	if err == redis.ErrNil {
+		return "", errors.New("unknown master")
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected reply %v", reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// refresh the master address, errors leave the last known one in place
+func (s *sentinel) refresh() {
+	_, _ = s.resolve()
+}
+
+// watch for failovers until stopped
+func (s *sentinel) watch() {
+	ticker := time.NewTicker(s.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.refresh()
+		}
+	}
+}
+
+func (s *sentinel) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+func newSentinel(config *RedisConfig) *sentinel {
+	s := &sentinel{
+		config: config,
+		done:   make(chan struct{}),
+	}
+	go s.watch()
+	return s
+}
@@ -0,0 +1,188 @@
+package channels
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSentinel answers master address queries with whichever server is master
+type fakeSentinel struct {
+	lock   sync.Mutex
+	master *miniredis.Miniredis
+}
+
+func (f *fakeSentinel) failover(master *miniredis.Miniredis) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.master = master
+}
+
+func (f *fakeSentinel) role(self *miniredis.Miniredis) server.Cmd {
+	return func(c *server.Peer, cmd string, args []string) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		role := "slave"
+		if f.master == self {
+			role = "master"
+		}
+		c.WriteLen(1)
+		c.WriteBulk(role)
+	}
+}
+
+func newFakeSentinel(t *testing.T, servers ...*miniredis.Miniredis) (*miniredis.Miniredis, *fakeSentinel) {
+	f := &fakeSentinel{master: servers[0]}
+	for _, s := range servers {
+		assert.NoError(t, s.Server().Register("ROLE", f.role(s)))
+	}
+
+	sentinel := miniredis.RunT(t)
+	assert.NoError(t, sentinel.Server().Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if len(args) != 2 || args[1] != "mymaster" {
+			c.WriteNull()
+			return
+		}
+		host, port, _ := net.SplitHostPort(f.master.Addr())
+		c.WriteStrings([]string{host, port})
+	}))
+	return sentinel, f
+}
+
+func TestRedisChannel_Auth(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("loadr", "secret")
+
+	c := newRedisChannel(RedisConfig{Address: server.Addr(), Username: "loadr", Password: "secret"})
+	defer c.Close() // nolint: errcheck
+	expectError(t, c, loadr.ChannelReconnectedError)
+
+	progress := loadr.MetaProgress{Token: "x"}
+	assert.NoError(t, c.Push(context.Background(), progress))
+	expectProgress(t, c, progress)
+
+	denied := newRedisChannel(RedisConfig{Address: server.Addr(), Username: "loadr", Password: "wrong"})
+	defer denied.Close() // nolint: errcheck
+	expectError(t, denied, loadr.ChannelDisconnectedError)
+	assert.Error(t, denied.Push(context.Background(), progress))
+}
+
+func TestRedisChannel_SentinelFailover(t *testing.T) {
+	first, second := miniredis.RunT(t), miniredis.RunT(t)
+	sentinel, f := newFakeSentinel(t, first, second)
+
+	c := newRedisChannel(RedisConfig{
+		// Unreachable Sentinels are skipped
+		SentinelAddresses:   []string{"127.0.0.1:1", sentinel.Addr()},
+		SentinelMaster:      "mymaster",
+		HealthCheckInterval: 50 * time.Millisecond,
+		MinBackoff:          10 * time.Millisecond,
+		MaxBackoff:          50 * time.Millisecond,
+	})
+	defer c.Close() // nolint: errcheck
+	expectError(t, c, loadr.ChannelReconnectedError)
+	assert.Equal(t, 1, first.PubSubNumPat())
+
+	progress := loadr.MetaProgress{Token: "x"}
+	assert.NoError(t, c.Push(context.Background(), progress))
+	expectProgress(t, c, progress)
+
+	f.failover(second)
+
+	// The subscription follows the master
+	expectError(t, c, loadr.ChannelDisconnectedError)
+	expectError(t, c, loadr.ChannelReconnectedError)
+	assert.Equal(t, 1, second.PubSubNumPat())
+
+	assert.NoError(t, c.Push(context.Background(), progress))
+	expectProgress(t, c, progress)
+}
+
+func TestRedisChannel_UnknownSentinelMaster(t *testing.T) {
+	sentinel, _ := newFakeSentinel(t, miniredis.RunT(t))
+
+	c := newRedisChannel(RedisConfig{SentinelAddresses: []string{sentinel.Addr()}, SentinelMaster: "other"})
+	defer c.Close() // nolint: errcheck
+	expectError(t, c, loadr.ChannelDisconnectedError)
+	assert.Error(t, c.Push(context.Background(), loadr.MetaProgress{Token: "x"}))
+}
+
+// testClusterRouting pushes a progress on one node until another one subscribed
+// to its token receives it
+func testClusterRouting(t *testing.T, config RedisConfig) {
+	a, b := newRedisChannel(config), newRedisChannel(config)
+	defer a.Close() // nolint: errcheck
+	defer b.Close() // nolint: errcheck
+	go func() {
+		for range a.Errors() {
+		}
+	}()
+
+	progress := loadr.MetaProgress{Token: "x"}
+	assert.NoError(t, b.(loadr.TokenSubscriber).Subscribe(progress.Token))
+	expectError(t, b, loadr.ChannelReconnectedError)
+
+	// The subscription may not be confirmed yet
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, a.Push(context.Background(), progress))
+		select {
+		case p := <-b.Progresses():
+			return assert.Equal(t, progress, p)
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRedisChannel_Cluster(t *testing.T) {
+	server := miniredis.RunT(t)
+	testClusterRouting(t, RedisConfig{ClusterAddresses: []string{server.Addr()}, Shards: 4})
+}
+
+// Sharded pub/sub needs a real Redis 7 Cluster, e.g. LOADR_TEST_REDIS_CLUSTER=127.0.0.1:7000,127.0.0.1:7001
+func TestRedisChannel_ShardedCluster(t *testing.T) {
+	addresses := splitTestList(os.Getenv("LOADR_TEST_REDIS_CLUSTER"))
+	if len(addresses) == 0 {
+		t.Skip("LOADR_TEST_REDIS_CLUSTER not set")
+	}
+	testClusterRouting(t, RedisConfig{ClusterAddresses: addresses, Shards: 16, Sharded: true})
+}
+
+func TestRedisStream_Cluster(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	writer := newRedisStream(RedisStreamConfig{RedisConfig: RedisConfig{ClusterAddresses: []string{server.Addr()}}})
+	defer writer.Close() // nolint: errcheck
+	reader := newRedisStream(RedisStreamConfig{
+		RedisConfig: RedisConfig{ClusterAddresses: []string{server.Addr()}},
+		Node:        "reader",
+		Block:       50 * time.Millisecond,
+	})
+	defer reader.Close() // nolint: errcheck
+	expectError(t, reader, loadr.ChannelReconnectedError)
+
+	progress := loadr.MetaProgress{Token: "x"}
+	assert.NoError(t, writer.Push(context.Background(), progress))
+	expectProgress(t, reader, progress)
+}
+
+func splitTestList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
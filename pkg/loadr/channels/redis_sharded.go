@@ -0,0 +1,161 @@
+package channels
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// setShard starts or stops reading a topic with sharded pub/sub, r.lock must be held
+func (r *redisChannel) setShard(topic string, on bool) {
+	stop, running := r.shards[topic]
+	switch {
+	case on && !running && !r.isClosed():
+		stop = make(chan struct{})
+		r.shards[topic] = stop
+		go r.readShard(topic, stop)
+	case !on && running:
+		close(stop)
+		delete(r.shards, topic)
+	}
+}
+
+// readShard subscribes to a topic on the node serving its slot and receives its
+// progresses, resubscribing with an exponential backoff until stopped
+func (r *redisChannel) readShard(topic string, stop chan struct{}) {
+	retry := &backoff{min: r.config.MinBackoff, max: r.config.MaxBackoff}
+	defer r.shardStopped(stop, fmt.Sprintf("redis subscription to '%s' stopped", topic))
+
+	for {
+		subscribed, err := r.receiveShard(topic, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if subscribed {
+			retry.reset()
+		}
+
+		delay := retry.next()
+		r.shardConnected(stop, false, fmt.Sprintf("redis subscription to '%s' lost, retrying in %s: %s", topic, delay, err))
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// receiveShard until the subscription fails or the topic is stopped. It reports
+// whether the subscription succeeded.
+func (r *redisChannel) receiveShard(topic string, stop chan struct{}) (bool, error) {
+	connection, err := r.connections.dial(topic)
+	if err != nil {
+		return false, err
+	}
+
+	// Closing the connection unblocks the reader once stopped
+	var once sync.Once
+	closeConnection := func() { once.Do(func() { _ = connection.Close() }) }
+	defer closeConnection()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		closeConnection()
+	}()
+
+	if _, err := connection.Do("SSUBSCRIBE", topic); err != nil {
+		return false, fmt.Errorf("error subscribing to '%s': %s", topic, err)
+	}
+	r.shardConnected(stop, true, fmt.Sprintf("redis subscription to '%s' established", topic))
+
+	go r.pingShard(connection, done)
+
+	// Pings are answered well within this, so a silent connection is a dead one
+	timeout := 2 * r.config.HealthCheckInterval
+	for {
+		reply, err := redis.ReceiveWithTimeout(connection, timeout)
+		if err != nil {
+			return true, err
+		}
+		data, err := shardMessage(reply)
+		if err != nil {
+			return true, err
+		}
+		if data != nil {
+			r.receive(r.out, data)
+		}
+	}
+}
+
+// shardConnected records whether the reader of a shard is subscribed
+func (r *redisChannel) shardConnected(stop chan struct{}, connected bool, message string) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	r.shardStates[stop] = connected
+	r.reportShards(message)
+}
+
+// shardStopped forgets the reader of a shard, it no longer counts towards the state
+func (r *redisChannel) shardStopped(stop chan struct{}, message string) {
+	r.stateLock.Lock()
+	defer r.stateLock.Unlock()
+	delete(r.shardStates, stop)
+	r.reportShards(message)
+}
+
+// reportShards connected once every shard is subscribed, r.stateLock must be held
+func (r *redisChannel) reportShards(message string) {
+	connected := true
+	for _, subscribed := range r.shardStates {
+		connected = connected && subscribed
+	}
+	r.setConnected(connected, message)
+}
+
+// pingShard so a dead connection is noticed by the reader
+func (r *redisChannel) pingShard(connection redis.Conn, done chan struct{}) {
+	ticker := time.NewTicker(r.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := connection.Send("PING"); err != nil {
+				return
+			}
+			if err := connection.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// shardMessage extracts the data of a sharded pub/sub reply, nil for other replies.
+// The subscription ends when the slot of its topic moves to another node.
+func shardMessage(reply interface{}) ([]byte, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil || len(values) < 3 {
+		// Pongs
+		return nil, nil
+	}
+	kind, _ := redis.String(values[0], nil)
+	switch kind {
+	case "smessage":
+		return redis.Bytes(values[2], nil)
+	case "sunsubscribe":
+		channel, _ := redis.String(values[1], nil)
+		return nil, fmt.Errorf("unsubscribed from '%s'", channel)
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,238 @@
+package channels
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Redis stream defaults
+const (
+	DefaultRedisStream       = "loadr"
+	DefaultRedisStreamMaxLen = 10000
+	DefaultRedisStreamBlock  = 5 * time.Second
+	DefaultRedisStreamCount  = 100
+)
+
+// progressField of a stream entry holding the marshalled progress
+const progressField = "p"
+
+// RedisStreamConfig for a channel built on a Redis stream. Unlike pub/sub, entries
+// stay in the stream so nodes catch up on what they missed while disconnected.
+type RedisStreamConfig struct {
+	// RedisConfig connection settings, its Queue is not used
+	RedisConfig
+	// Stream key, defaults to DefaultRedisStream
+	Stream string
+	// MaxLen the stream is approximately capped at
+	MaxLen int64
+	// Node name under which this node's last read ID is persisted so it catches up after
+	// a restart. When empty the node only reads entries added after it started.
+	Node string
+	// Block time of a single read
+	Block time.Duration
+	// Count of entries read at once
+	Count int
+}
+
+type redisStream struct {
+	*lifecycle
+	connections *redisConnections
+	out         chan loadr.MetaProgress
+	lastID      string
+	config      RedisStreamConfig
+}
+
+func (r *redisStream) Close() error {
+	r.close(func() {})
+	return r.connections.Close()
+}
+
+func (r *redisStream) Push(ctx context.Context, p loadr.MetaProgress) error {
+	bytes, err := r.encode(ctx, p)
+	if err != nil {
+		return err
+	}
+	if _, err := r.connections.do(ctx, "XADD", r.config.Stream, "MAXLEN", "~", r.config.MaxLen, "*", progressField, bytes); err != nil {
+		return err
+	}
+	r.deliver(r.out, p)
+	return nil
+}
+
+func (r *redisStream) Progresses() <-chan loadr.MetaProgress {
+	return r.out
+}
+
+// read the stream from the last read ID, reconnecting with an exponential backoff until closed
+func (r *redisStream) read() {
+	retry := &backoff{min: r.config.MinBackoff, max: r.config.MaxBackoff}
+
+	for !r.isClosed() {
+		err := r.readBatch()
+		if err == nil {
+			retry.reset()
+			continue
+		}
+		if r.isClosed() {
+			return
+		}
+
+		delay := retry.next()
+		r.setConnected(false, fmt.Sprintf("redis stream unreachable, retrying in %s: %s", delay, err))
+		if !r.sleep(delay) {
+			return
+		}
+	}
+}
+
+// readBatch of entries after the last read ID and deliver them
+func (r *redisStream) readBatch() error {
+	if r.lastID == "" {
+		id, err := r.startID()
+		if err != nil {
+			return err
+		}
+		r.lastID = id
+	}
+
+	connection := r.connections.Get()
+	defer connection.Close() // nolint: errcheck
+	// XREAD names its key after its options, a Cluster can't tell where it goes
+	if err := bind(connection, r.config.Stream); err != nil {
+		return err
+	}
+
+	reply, err := redis.DoWithTimeout(connection, r.config.Block+r.config.HealthCheckInterval,
+		"XREAD", "COUNT", r.config.Count, "BLOCK", int64(r.config.Block/time.Millisecond),
+		"STREAMS", r.config.Stream, r.lastID)
+	if err != nil {
+		return err
+	}
+	r.setConnected(true, "redis stream reachable")
+	if reply == nil {
+		// Nothing arrived while blocking
+		return nil
+	}
+
+	entries, err := streamEntries(reply)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		r.lastID = entry.id
+		r.receive(r.out, entry.data)
+	}
+
+	if r.config.Node != "" && len(entries) > 0 {
+		_, err = r.connections.do(context.Background(), "HSET", r.nodesKey(), r.config.Node, r.lastID)
+	}
+	return err
+}
+
+// startID to read from: where this node left off, or the current end of the stream
+func (r *redisStream) startID() (string, error) {
+	if r.config.Node != "" {
+		id, err := redis.String(r.connections.do(context.Background(), "HGET", r.nodesKey(), r.config.Node))
+		if err == nil {
+			return id, nil
+		}
+		if err != redis.ErrNil {
+			return "", err
+		}
+	}
+
+	// Resolve the end of the stream to an explicit ID, "$" would skip whatever
+	// gets added between two reads
+	reply, err := r.connections.do(context.Background(), "XREVRANGE", r.config.Stream, "+", "-", "COUNT", 1)
+	if err != nil {
+		return "", err
+	}
+	entries, err := redis.Values(reply, nil)
+	if err != nil || len(entries) == 0 {
+		return "0-0", err
+	}
+	last, err := redis.Values(entries[0], nil)
+	if err != nil || len(last) == 0 {
+		return "", fmt.Errorf("unexpected stream entry %v", entries[0])
+	}
+	return redis.String(last[0], nil)
+}
+
+// nodesKey of the hash holding each node's last read ID
+func (r *redisStream) nodesKey() string {
+	return r.config.Stream + ":nodes"
+}
+
+type streamEntry struct {
+	id   string
+	data []byte
+}
+
+// streamEntries of an XREAD reply on a single stream
+func streamEntries(reply interface{}) ([]streamEntry, error) {
+	streams, err := redis.Values(reply, nil)
+	if err != nil || len(streams) == 0 {
+		return nil, err
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected stream reply %v", streams[0])
+	}
+	items, err := redis.Values(stream[1], nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]streamEntry, 0, len(items))
+	for _, item := range items {
+		fields, err := redis.Values(item, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", item)
+		}
+		id, err := redis.String(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		values, err := redis.StringMap(fields[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, streamEntry{id: id, data: []byte(values[progressField])})
+	}
+	return entries, nil
+}
+
+func newRedisStream(config RedisStreamConfig) loadr.Channel {
+	config.setDefaults()
+	if strings.TrimSpace(config.Stream) == "" {
+		config.Stream = DefaultRedisStream
+	}
+	if config.MaxLen <= 0 {
+		config.MaxLen = DefaultRedisStreamMaxLen
+	}
+	if config.Block <= 0 {
+		config.Block = DefaultRedisStreamBlock
+	}
+	if config.Count <= 0 {
+		config.Count = DefaultRedisStreamCount
+	}
+
+	result := &redisStream{
+		lifecycle: newLifecycle(config.Codec),
+		config:    config,
+		out:       make(chan loadr.MetaProgress, outBuffer),
+	}
+	result.connections = newRedisConnections(&result.config.RedisConfig)
+	if config.Node != "" {
+		result.origin = newNodeID(config.Node)
+	}
+
+	go result.read()
+
+	return result
+}
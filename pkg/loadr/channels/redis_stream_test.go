@@ -0,0 +1,61 @@
+package channels
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStream(address, node string) loadr.Channel {
+	return newRedisStream(RedisStreamConfig{
+		RedisConfig: RedisConfig{
+			Address:             address,
+			HealthCheckInterval: 50 * time.Millisecond,
+			MinBackoff:          10 * time.Millisecond,
+			MaxBackoff:          50 * time.Millisecond,
+		},
+		Node:  node,
+		Block: 50 * time.Millisecond,
+	})
+}
+
+func TestRedisStream_PushAndReceive(t *testing.T) {
+	server := miniredis.RunT(t)
+	a := newTestStream(server.Addr(), "")
+	defer a.Close() // nolint: errcheck
+	b := newTestStream(server.Addr(), "")
+	defer b.Close() // nolint: errcheck
+	expectError(t, a, loadr.ChannelReconnectedError)
+	expectError(t, b, loadr.ChannelReconnectedError)
+
+	progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, a.Push(context.Background(), progress))
+	expectProgress(t, a, progress)
+	expectProgress(t, b, progress)
+}
+
+func TestRedisStream_CatchUpAfterRestart(t *testing.T) {
+	server := miniredis.RunT(t)
+	node := newTestStream(server.Addr(), "node")
+	expectError(t, node, loadr.ChannelReconnectedError)
+
+	first := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.1}}
+	assert.NoError(t, node.Push(context.Background(), first))
+	expectProgress(t, node, first)
+	assert.NoError(t, node.Close())
+
+	// Published while the node is down
+	other := newTestStream(server.Addr(), "")
+	defer other.Close() // nolint: errcheck
+	missed := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "b", Progress: 0.2}}
+	assert.NoError(t, other.Push(context.Background(), missed))
+
+	restarted := newTestStream(server.Addr(), "node")
+	defer restarted.Close() // nolint: errcheck
+	expectError(t, restarted, loadr.ChannelReconnectedError)
+	expectProgress(t, restarted, missed)
+}
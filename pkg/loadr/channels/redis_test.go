@@ -0,0 +1,243 @@
+package channels
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func expectError(t *testing.T, c loadr.Channel, code uint) {
+	select {
+	case err := <-c.Errors():
+		if assert.IsType(t, &loadr.Error{}, err) {
+			assert.Equal(t, code, err.(*loadr.Error).Code, err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected error code %d", code)
+	}
+}
+
+func expectProgress(t *testing.T, c loadr.Channel, expected loadr.MetaProgress) {
+	select {
+	case p := <-c.Progresses():
+		assert.Equal(t, expected, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected progress")
+	}
+}
+
+func TestRedisChannel_Reconnect(t *testing.T) {
+	server := miniredis.RunT(t)
+	c := newRedisChannel(RedisConfig{
+		Address:             server.Addr(),
+		HealthCheckInterval: 50 * time.Millisecond,
+		MinBackoff:          10 * time.Millisecond,
+		MaxBackoff:          50 * time.Millisecond,
+	})
+	defer c.Close() // nolint: errcheck
+
+	expectError(t, c, loadr.ChannelReconnectedError)
+	assert.True(t, c.(loadr.ConnectionChecker).IsConnected())
+
+	progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, c.Push(context.Background(), progress))
+	expectProgress(t, c, progress)
+
+	server.Close()
+	expectError(t, c, loadr.ChannelDisconnectedError)
+	assert.False(t, c.(loadr.ConnectionChecker).IsConnected())
+
+	assert.NoError(t, server.Restart())
+	expectError(t, c, loadr.ChannelReconnectedError)
+	assert.True(t, c.(loadr.ConnectionChecker).IsConnected())
+
+	assert.NoError(t, c.Push(context.Background(), progress))
+	expectProgress(t, c, progress)
+}
+
+func TestRedisChannel_PushReleasesConnections(t *testing.T) {
+	server := miniredis.RunT(t)
+	c := newRedisChannel(RedisConfig{Address: server.Addr(), MaxActive: 2})
+	defer c.Close() // nolint: errcheck
+	expectError(t, c, loadr.ChannelReconnectedError)
+
+	done := make(chan struct{})
+	go func() {
+		for range c.Progresses() {
+		}
+	}()
+	go func() {
+		// With a single free connection in the pool this would block if Push leaked them
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, c.Push(context.Background(), loadr.MetaProgress{Token: "x"}))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push blocked on the pool")
+	}
+}
+
+func TestRedisChannel_PerToken(t *testing.T) {
+	server := miniredis.RunT(t)
+	for name, config := range map[string]RedisConfig{"per token": {PerToken: true}, "shards": {Shards: 1024}} {
+		t.Run(name, func(t *testing.T) {
+			config.Address = server.Addr()
+			a := newRedisChannel(config)
+			defer a.Close() // nolint: errcheck
+			b := newRedisChannel(config)
+			defer b.Close() // nolint: errcheck
+			expectError(t, a, loadr.ChannelReconnectedError)
+			expectError(t, b, loadr.ChannelReconnectedError)
+
+			topic := b.(*redisChannel).topic("x")
+			assert.NoError(t, b.(loadr.TokenSubscriber).Subscribe("x"))
+			assert.Eventually(t, func() bool {
+				return server.PubSubNumSub(topic)[topic] == 1
+			}, 5*time.Second, 10*time.Millisecond)
+
+			other := loadr.MetaProgress{Token: "y", Progress: loadr.Progress{Stage: "a", Progress: 0.1}}
+			progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+			assert.NoError(t, a.Push(context.Background(), other))
+			assert.NoError(t, a.Push(context.Background(), progress))
+			expectProgress(t, b, progress)
+
+			assert.NoError(t, b.(loadr.TokenSubscriber).Unsubscribe("x"))
+			assert.Eventually(t, func() bool {
+				return server.PubSubNumSub(topic)[topic] == 0
+			}, 5*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestRedisChannel_SharedShard(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := RedisConfig{Address: server.Addr(), Shards: 4}
+	a := newRedisChannel(config)
+	defer a.Close() // nolint: errcheck
+	b := newRedisChannel(config)
+	defer b.Close() // nolint: errcheck
+	expectError(t, a, loadr.ChannelReconnectedError)
+	expectError(t, b, loadr.ChannelReconnectedError)
+
+	// Two tokens on one shard and a third one elsewhere
+	var x, y, z loadr.Token = "x", "", ""
+	for i := 0; y == "" || z == ""; i++ {
+		token := loadr.Token(strconv.Itoa(i))
+		if shard(token, config.Shards) == shard(x, config.Shards) {
+			if y == "" {
+				y = token
+			}
+		} else if z == "" {
+			z = token
+		}
+	}
+	subscriber := b.(loadr.TokenSubscriber)
+	topic := b.(*redisChannel).topic(x)
+	assert.NoError(t, subscriber.Subscribe(x))
+	assert.NoError(t, subscriber.Subscribe(y))
+	assert.Eventually(t, func() bool {
+		return server.PubSubNumSub(topic)[topic] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Unsubscribing y leaves the shard to x, z's subscription tells it was handled
+	assert.NoError(t, subscriber.Unsubscribe(y))
+	assert.NoError(t, subscriber.Subscribe(z))
+	other := b.(*redisChannel).topic(z)
+	assert.Eventually(t, func() bool {
+		return server.PubSubNumSub(other)[other] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, server.PubSubNumSub(topic)[topic])
+
+	progress := loadr.MetaProgress{Token: x, Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, a.Push(context.Background(), progress))
+	expectProgress(t, b, progress)
+}
+
+func TestRedisChannel_Envelopes(t *testing.T) {
+	server := miniredis.RunT(t)
+	a := newRedisChannel(RedisConfig{Address: server.Addr()})
+	defer a.Close() // nolint: errcheck
+	expectError(t, a, loadr.ChannelReconnectedError)
+
+	// Delivered right away, the copy coming back from Redis is skipped
+	progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	assert.NoError(t, a.Push(context.Background(), progress))
+	expectProgress(t, a, progress)
+
+	// Nodes that predate envelopes publish bare progresses
+	legacy := loadr.MetaProgress{Token: "y", Progress: loadr.Progress{Stage: "b", Progress: 1}}
+	data, _ := json.Marshal(legacy)
+	server.Publish(DefaultRedisQueue, string(data))
+	expectProgress(t, a, legacy)
+
+	select {
+	case p := <-a.Progresses():
+		t.Fatalf("unexpected progress %v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisChannel_Trace(t *testing.T) {
+	server := miniredis.RunT(t)
+	c := newRedisChannel(RedisConfig{Address: server.Addr()})
+	defer c.Close() // nolint: errcheck
+
+	trace := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+	_, _, message, err := c.(*redisChannel).Publication(loadr.WithTrace(context.Background(), trace), progress)
+	assert.NoError(t, err)
+	e, err := envelope.Decode(message)
+	assert.NoError(t, err)
+	assert.Equal(t, trace, e.Trace)
+	assert.Equal(t, progress, e.MetaProgress)
+}
+
+func TestRedisConfig_ShardedPerToken(t *testing.T) {
+	// A sharded subscription per token would take a connection per token
+	config := RedisConfig{Sharded: true, PerToken: true}
+	config.setDefaults()
+	assert.Equal(t, DefaultRedisShards, config.Shards)
+
+	config = RedisConfig{Sharded: true, PerToken: true, Shards: 8}
+	config.setDefaults()
+	assert.Equal(t, 8, config.Shards)
+
+	config = RedisConfig{PerToken: true}
+	config.setDefaults()
+	assert.Equal(t, 0, config.Shards, "unsharded pub/sub subscribes to every token on one connection")
+}
+
+func TestRedisChannel_ShardStates(t *testing.T) {
+	r := &redisChannel{lifecycle: newLifecycle(nil), shardStates: make(map[chan struct{}]bool)}
+	a, b := make(chan struct{}), make(chan struct{})
+
+	go r.shardConnected(a, true, "a up")
+	expectError(t, r, loadr.ChannelReconnectedError)
+
+	// One shard down is enough to be disconnected
+	go r.shardConnected(b, false, "b down")
+	expectError(t, r, loadr.ChannelDisconnectedError)
+	r.shardConnected(a, true, "a still up")
+	assert.False(t, r.IsConnected())
+
+	go r.shardConnected(b, true, "b up")
+	expectError(t, r, loadr.ChannelReconnectedError)
+	go r.shardConnected(a, false, "a down")
+	expectError(t, r, loadr.ChannelDisconnectedError)
+
+	// Stopped shards don't count anymore
+	go r.shardStopped(a, "a stopped")
+	expectError(t, r, loadr.ChannelReconnectedError)
+	assert.True(t, r.IsConnected())
+}
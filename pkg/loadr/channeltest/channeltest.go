@@ -0,0 +1,312 @@
+// Package channeltest runs a standard behavioral suite against loadr.Channel
+// implementations: delivery to the pushing node and to the others, ordering,
+// concurrent pushes, error reporting and close semantics.
+package channeltest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Timeout waiting for a progress or for the nodes to reach each other
+const Timeout = 10 * time.Second
+
+// Factory makes n channels reaching each other, like the nodes of one deployment
+type Factory func(t *testing.T, n int) []loadr.Channel
+
+// Options of the suite
+type Options struct {
+	// SingleNode channels only deliver to the node progresses are pushed on,
+	// tests needing several nodes are skipped
+	SingleNode bool
+}
+
+// run of the suite, tokens are unique to it
+var run int64
+
+// Run the suite against the channels made by factory
+func Run(t *testing.T, factory Factory, options Options) {
+	tests := []struct {
+		name  string
+		nodes int
+		test  func(*testing.T, []*Node, loadr.Token)
+	}{
+		{"LocalDelivery", 1, testLocalDelivery},
+		{"Ordering", 1, testOrdering},
+		{"Concurrency", 1, testConcurrency},
+		{"Broadcast", 2, testBroadcast},
+		{"OrderingAcrossNodes", 2, testOrdering},
+		{"ConcurrencyAcrossNodes", 2, testConcurrency},
+		{"Close", 1, testClose},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if test.nodes > 1 && options.SingleNode {
+				t.Skip("single node channel")
+			}
+			prefix := loadr.Token(fmt.Sprintf("channeltest-%d-%d-%s/", time.Now().UnixNano(), atomic.AddInt64(&run, 1), test.name))
+			channels := factory(t, test.nodes)
+			require.Len(t, channels, test.nodes)
+			nodes := make([]*Node, 0, len(channels))
+			for _, c := range channels {
+				nodes = append(nodes, Watch(c))
+			}
+			defer func() {
+				for _, n := range nodes {
+					n.Close() // nolint: errcheck
+				}
+			}()
+
+			test.test(t, nodes, prefix)
+			for _, n := range nodes {
+				n.ExpectLoadrErrors(t)
+			}
+		})
+	}
+}
+
+// Node watches a channel, collecting its progresses and errors in the background
+type Node struct {
+	loadr.Channel
+	lock       sync.Mutex
+	progresses []loadr.MetaProgress
+	errors     []error
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// Watch a channel until the node is closed
+func Watch(c loadr.Channel) *Node {
+	n := &Node{Channel: c, done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case p := <-c.Progresses():
+				n.lock.Lock()
+				n.progresses = append(n.progresses, p)
+				n.lock.Unlock()
+			case err := <-c.Errors():
+				n.lock.Lock()
+				n.errors = append(n.errors, err)
+				n.lock.Unlock()
+			case <-n.done:
+				return
+			}
+		}
+	}()
+	return n
+}
+
+// Close the channel and stop watching it
+func (n *Node) Close() error {
+	err := n.Channel.Close()
+	n.closeOnce.Do(func() {
+		close(n.done)
+	})
+	return err
+}
+
+// Received progresses of a token, in the order they were received, without probes
+func (n *Node) Received(token loadr.Token) []loadr.Progress {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	var result []loadr.Progress
+	for _, p := range n.progresses {
+		if p.Token == token && p.Progress.Stage != probe {
+			result = append(result, p.Progress)
+		}
+	}
+	return result
+}
+
+// Reported errors so far, the channel's own stream is read by the node
+func (n *Node) Reported() []error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]error(nil), n.errors...)
+}
+
+// Expect count progresses of a token to be received
+func (n *Node) Expect(t *testing.T, token loadr.Token, count int) []loadr.Progress {
+	t.Helper()
+	var received []loadr.Progress
+	ok := assert.Eventually(t, func() bool {
+		received = n.Received(token)
+		return len(received) >= count
+	}, Timeout, 5*time.Millisecond, "expected %d progresses of %s", count, token)
+	if !ok {
+		return received
+	}
+	// Give duplicates a chance to show up
+	time.Sleep(50 * time.Millisecond)
+	received = n.Received(token)
+	assert.Len(t, received, count, "progresses of %s delivered once", token)
+	return received
+}
+
+// ExpectLoadrErrors checks that the errors reported are *loadr.Error, carrying a code
+func (n *Node) ExpectLoadrErrors(t *testing.T) {
+	t.Helper()
+	for _, err := range n.Reported() {
+		assert.IsType(t, &loadr.Error{}, err, "errors are reported as *loadr.Error")
+	}
+}
+
+// probe stage of the progresses pushed by Connect
+const probe = "channeltest-probe"
+
+// probed reports whether a node received a probe of a token
+func (n *Node) probed(token loadr.Token) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, p := range n.progresses {
+		if p.Token == token && p.Progress.Stage == probe {
+			return true
+		}
+	}
+	return false
+}
+
+// Connect waits for the nodes to reach each other on tokens: nodes are
+// subscribed to them when their channel routes by token, then probes are
+// pushed on the first node until every node received one for every token.
+// Received leaves probes out.
+func Connect(t *testing.T, nodes []*Node, tokens ...loadr.Token) {
+	t.Helper()
+	for _, n := range nodes {
+		Subscribe(t, n, tokens...)
+	}
+	require.Eventually(t, func() bool {
+		connected := true
+		for _, token := range tokens {
+			reached := true
+			for _, n := range nodes {
+				reached = reached && n.probed(token)
+			}
+			if !reached {
+				connected = false
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				_ = nodes[0].Push(ctx, loadr.MetaProgress{Token: token, Progress: loadr.Progress{Stage: probe}})
+				cancel()
+			}
+		}
+		return connected
+	}, Timeout, 100*time.Millisecond, "nodes don't reach each other")
+}
+
+// Subscribe a node to tokens if its channel routes by token
+func Subscribe(t *testing.T, n *Node, tokens ...loadr.Token) {
+	t.Helper()
+	subscriber, ok := n.Channel.(loadr.TokenSubscriber)
+	if !ok {
+		return
+	}
+	for _, token := range tokens {
+		require.NoError(t, subscriber.Subscribe(token))
+	}
+}
+
+func progress(i int) loadr.Progress {
+	return loadr.Progress{Stage: fmt.Sprintf("s%d", i), Progress: float32(i%100) / 100}
+}
+
+func testLocalDelivery(t *testing.T, nodes []*Node, prefix loadr.Token) {
+	a := nodes[0]
+	p := loadr.MetaProgress{Token: prefix + "x", Progress: progress(1)}
+	Connect(t, nodes, p.Token)
+	require.NoError(t, a.Push(context.Background(), p))
+	assert.Equal(t, []loadr.Progress{p.Progress}, a.Expect(t, p.Token, 1))
+}
+
+// push count progresses of a token from a node, in order
+func push(t *testing.T, n *Node, token loadr.Token, count int) []loadr.Progress {
+	pushed := make([]loadr.Progress, 0, count)
+	for i := 0; i < count; i++ {
+		p := progress(i)
+		require.NoError(t, n.Push(context.Background(), loadr.MetaProgress{Token: token, Progress: p}))
+		pushed = append(pushed, p)
+	}
+	return pushed
+}
+
+// testOrdering pushes on the first node, the last one must receive in order
+func testOrdering(t *testing.T, nodes []*Node, prefix loadr.Token) {
+	token := prefix + "x"
+	Connect(t, nodes, token)
+	pushed := push(t, nodes[0], token, 50)
+	for _, n := range nodes {
+		assert.Equal(t, pushed, n.Expect(t, token, len(pushed)), "progresses of a token keep their order")
+	}
+}
+
+// testConcurrency pushes from several goroutines on the first node, each on a
+// token of its own, and expects every node to receive them all
+func testConcurrency(t *testing.T, nodes []*Node, prefix loadr.Token) {
+	const workers, pushes = 4, 25
+	tokens := make([]loadr.Token, 0, workers)
+	for w := 0; w < workers; w++ {
+		tokens = append(tokens, prefix+loadr.Token(fmt.Sprintf("w%d", w)))
+	}
+	Connect(t, nodes, tokens...)
+
+	var wait sync.WaitGroup
+	for _, token := range tokens {
+		token := token
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; i < pushes; i++ {
+				assert.NoError(t, nodes[0].Push(context.Background(), loadr.MetaProgress{Token: token, Progress: progress(i)}))
+			}
+		}()
+	}
+	wait.Wait()
+	for _, n := range nodes {
+		for _, token := range tokens {
+			n.Expect(t, token, pushes)
+		}
+	}
+}
+
+func testBroadcast(t *testing.T, nodes []*Node, prefix loadr.Token) {
+	a, b := nodes[0], nodes[1]
+	x, y := prefix+"x", prefix+"y"
+	Connect(t, nodes, x, y)
+
+	require.NoError(t, a.Push(context.Background(), loadr.MetaProgress{Token: x, Progress: progress(1)}))
+	assert.Equal(t, []loadr.Progress{progress(1)}, b.Expect(t, x, 1))
+	assert.Equal(t, []loadr.Progress{progress(1)}, a.Expect(t, x, 1), "the pushing node gets its progress once")
+
+	require.NoError(t, b.Push(context.Background(), loadr.MetaProgress{Token: y, Progress: progress(2)}))
+	assert.Equal(t, []loadr.Progress{progress(2)}, a.Expect(t, y, 1))
+	assert.Equal(t, []loadr.Progress{progress(2)}, b.Expect(t, y, 1))
+}
+
+func testClose(t *testing.T, nodes []*Node, prefix loadr.Token) {
+	a := nodes[0]
+	assert.NoError(t, a.Close())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Push(ctx, loadr.MetaProgress{Token: prefix + "x", Progress: progress(1)})
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err, "pushing on a closed channel fails")
+	case <-time.After(2 * time.Second):
+		t.Error("pushing on a closed channel blocks")
+	}
+
+	assert.NotPanics(t, func() { _ = a.Close() }, "closing twice")
+}
@@ -1,33 +1,120 @@
 package clients
 
 import (
+	"sync"
 	"time"
 
 	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
 	"github.com/gorilla/websocket"
 )
 
 type client struct {
-	socket *websocket.Conn
+	socket    *websocket.Conn
+	config    *Config
+	codec     codec.Codec
+	release   func()
+	gone      func()
+	writeLock sync.Mutex
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
+// IsAlive until the connection is closed or stops answering pings
 func (c *client) IsAlive() bool {
-	if err := c.socket.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+	select {
+	case <-c.done:
 		return false
+	default:
+		return true
 	}
-	if _, _, err := c.socket.ReadMessage(); err != nil {
-		if _, ok := err.(*websocket.CloseError); ok {
-			return false
-		}
-	}
-
-	return true
 }
 
 func (c *client) Write(progress *loadr.Progress) error {
-	return c.socket.WriteJSON(progress)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	data, err := c.codec.EncodeProgress(progress)
+	if err != nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if c.codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	if err := c.socket.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout)); err != nil {
+		return err
+	}
+	return c.socket.WriteMessage(messageType, data)
 }
 
 func (c *client) Close() error {
-	return c.socket.Close()
+	err := websocket.ErrCloseSent
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.release()
+		deadline := time.Now().Add(c.config.WriteTimeout)
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		_ = c.socket.WriteControl(websocket.CloseMessage, message, deadline)
+		err = c.socket.Close()
+	})
+	return err
+}
+
+// run the heartbeat until the connection dies, then report it gone
+func (c *client) run() {
+	go c.ping()
+	c.read()
+	if c.IsAlive() {
+		_ = c.Close()
+		c.gone()
+	}
+}
+
+// read and discard incoming messages so control frames (pongs, close) get processed
+func (c *client) read() {
+	extend := func(string) error {
+		return c.socket.SetReadDeadline(time.Now().Add(c.config.PongTimeout))
+	}
+	if err := extend(""); err != nil {
+		return
+	}
+	c.socket.SetPongHandler(extend)
+
+	for {
+		if _, _, err := c.socket.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// ping the other end periodically, the pongs keep the read deadline moving
+func (c *client) ping() {
+	ticker := time.NewTicker(c.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(c.config.WriteTimeout)
+			if err := c.socket.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				// Closing the socket unblocks the reader which reports the client gone
+				_ = c.socket.Close()
+				return
+			}
+		}
+	}
+}
+
+func newClient(socket *websocket.Conn, config *Config, encoding codec.Codec, release, gone func()) *client {
+	return &client{
+		socket:  socket,
+		config:  config,
+		codec:   encoding,
+		release: release,
+		gone:    gone,
+		done:    make(chan struct{}),
+	}
 }
@@ -3,70 +3,255 @@ package clients
 import (
 	"log"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/Sinea/loadr/pkg/loadr/internal/httpserver"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo"
 )
 
+// TicketParam query parameter carrying the subscription ticket
+const TicketParam = "ticket"
+
+// disconnectedBuffer of subscriptions reported disconnected but not yet read
+const disconnectedBuffer = 256
+
+// Heartbeat defaults
+const (
+	DefaultPingInterval = 30 * time.Second
+	DefaultPongTimeout  = 60 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// Config for the client listener
+type Config struct {
+	loadr.NetConfig
+	// Tickets verifies subscription tickets, any client may subscribe when nil
+	Tickets loadr.TicketVerifier
+	// AllowedOrigins browser origins allowed to connect, "*" allows any.
+	// When empty only same origin pages may connect.
+	AllowedOrigins []string
+	// MaxConnections open at once on this listener, 0 means unlimited
+	MaxConnections int
+	// MaxConnectionsPerIP open at once from a single address, 0 means unlimited
+	MaxConnectionsPerIP int
+	// TrustedProxies addresses or CIDR ranges of the proxies in front of the
+	// listener. Only their X-Forwarded-For and X-Real-IP headers are honoured,
+	// connections count against the address they come from otherwise.
+	TrustedProxies []string
+	// MaxSubscribersPerToken open at once for a single token, 0 means unlimited
+	MaxSubscribersPerToken int
+	// PingInterval at which clients are pinged
+	PingInterval time.Duration
+	// PongTimeout after which a client that didn't answer a ping is considered dead
+	PongTimeout time.Duration
+	// WriteTimeout for a single message to a client
+	WriteTimeout time.Duration
+	// Codecs clients may ask for with a websocket subprotocol, all of them when empty.
+	// Clients that don't ask get JSON.
+	Codecs []codec.Codec
+}
+
 type clientListener struct {
-	config   loadr.NetConfig
-	endpoint *echo.Echo
-	upgrader websocket.Upgrader
-	logger   *log.Logger
-	clients  chan *loadr.Subscription
+	config       Config
+	lock         sync.Mutex
+	endpoint     *echo.Echo
+	connected    map[*client]struct{}
+	done         chan struct{}
+	upgrader     websocket.Upgrader
+	limiter      *limiter
+	logger       *log.Logger
+	clients      chan *loadr.Subscription
+	disconnected chan *loadr.Subscription
 }
 
 func (c *clientListener) Wait() <-chan *loadr.Subscription {
-	if c.endpoint == nil {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.endpoint == nil && !c.isClosed() {
 		c.endpoint = echo.New()
 		c.endpoint.GET("/:token", c.websocketHandler)
-		go startServer(c.endpoint, c.config)
+		go httpserver.Start(c.endpoint, c.config.NetConfig)
 	}
 	return c.clients
 }
 
+// Disconnected subscriptions whose connection died
+func (c *clientListener) Disconnected() <-chan *loadr.Subscription {
+	return c.disconnected
+}
+
+// Close the listener and the connections it accepted
 func (c *clientListener) Close() error {
-	err := c.endpoint.Close()
+	c.lock.Lock()
+	if !c.isClosed() {
+		close(c.done)
+	}
+	endpoint := c.endpoint
 	c.endpoint = nil
-	return err
+	connected := make([]*client, 0, len(c.connected))
+	for client := range c.connected {
+		connected = append(connected, client)
+	}
+	c.lock.Unlock()
+
+	// Closing a client untracks it
+	for _, client := range connected {
+		_ = client.Close()
+	}
+	if endpoint == nil {
+		return nil
+	}
+	return endpoint.Close()
+}
+
+// track a connection until it is closed, returns false once the listener is closed
+func (c *clientListener) track(client *client) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.isClosed() {
+		return false
+	}
+	c.connected[client] = struct{}{}
+	return true
+}
+
+func (c *clientListener) isClosed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *clientListener) untrack(client *client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.connected, client)
 }
 
 func (c *clientListener) websocketHandler(ctx echo.Context) error {
 	token := loadr.Token(ctx.Param("token"))
-	connection, err := c.upgrader.Upgrade(ctx.Response(), ctx.Request(), nil)
+	var tenant loadr.Tenant
+
+	if c.config.Tickets != nil {
+		ticket := ctx.QueryParam(TicketParam)
+		if ticket == "" {
+			return ctx.NoContent(http.StatusUnauthorized)
+		}
+		t, err := c.config.Tickets.Verify(ticket, token)
+		if err != nil {
+			c.logger.Printf("rejecting subscription to '%s': %s\n", token, err)
+			return ctx.NoContent(http.StatusForbidden)
+		}
+		tenant = t
+	}
+	token = tenant.Token(token)
+
+	if !c.limiter.checkOrigin(ctx.Request()) {
+		c.logger.Printf("rejecting subscription from origin '%s'\n", ctx.Request().Header.Get("Origin"))
+		return ctx.NoContent(http.StatusForbidden)
+	}
+
+	ip := c.limiter.clientIP(ctx.Request())
+	status, release := c.limiter.acquire(ip, token)
+	if release == nil {
+		c.logger.Printf("rejecting subscription to '%s' from %s: connection limit reached\n", token, ip)
+		return ctx.NoContent(status)
+	}
+
+	encoding, header := c.negotiate(ctx.Request())
+	connection, err := c.upgrader.Upgrade(ctx.Response(), ctx.Request(), header)
 
 	if err != nil {
+		release()
 		c.logger.Printf("error upgrading protocol: %s\n", err)
 		return ctx.NoContent(http.StatusInternalServerError)
 	}
 
-	c.clients <- &loadr.Subscription{
-		Token: token,
-		Client: &client{
-			socket: connection,
-		},
+	subscription := &loadr.Subscription{Token: token}
+	var client *client
+	client = newClient(connection, &c.config, encoding, func() {
+		c.untrack(client)
+		release()
+	}, func() {
+		c.disconnect(subscription)
+	})
+	subscription.Client = client
+	if !c.track(client) {
+		_ = client.Close()
+		return nil
+	}
+
+	select {
+	case c.clients <- subscription:
+	case <-c.done:
+		_ = client.Close()
+		return nil
 	}
+	go client.run()
 
 	return nil
 }
 
-func New(config loadr.NetConfig, logger *log.Logger) loadr.ClientListener {
-	return &clientListener{
-		clients:  make(chan *loadr.Subscription),
-		config:   config,
-		logger:   logger,
-		upgrader: websocket.Upgrader{},
+// disconnect reports a subscription whose connection died without waiting for a reader, there
+// is none once the service stopped. Dropped reports are swept by the service's cleanup.
+func (c *clientListener) disconnect(subscription *loadr.Subscription) {
+	select {
+	case c.disconnected <- subscription:
+	default:
 	}
 }
 
-func startServer(server *echo.Echo, config loadr.NetConfig) {
-	var err error
-	if config.KeyFile != "" && config.CertFile != "" {
-		err = server.StartTLS(config.Address, config.CertFile, config.KeyFile)
-	} else {
-		err = server.Start(config.Address)
+// negotiate the codec of a connection: the first subprotocol the client asked
+// for that names an allowed codec, JSON when there is none
+func (c *clientListener) negotiate(r *http.Request) (codec.Codec, http.Header) {
+	for _, subprotocol := range websocket.Subprotocols(r) {
+		encoding, err := codec.BySubprotocol(subprotocol)
+		if err != nil {
+			continue
+		}
+		for _, allowed := range c.config.Codecs {
+			if allowed == encoding {
+				return encoding, http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+			}
+		}
+	}
+	return codec.JSON, nil
+}
+
+func New(config Config, logger *log.Logger) loadr.ClientListener {
+	if config.PingInterval <= 0 {
+		config.PingInterval = DefaultPingInterval
+	}
+	if config.PongTimeout <= 0 {
+		config.PongTimeout = DefaultPongTimeout
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	if len(config.Codecs) == 0 {
+		config.Codecs = codec.All
+	}
+
+	result := &clientListener{
+		clients:      make(chan *loadr.Subscription),
+		disconnected: make(chan *loadr.Subscription, disconnectedBuffer),
+		connected:    make(map[*client]struct{}),
+		done:         make(chan struct{}),
+		config:       config,
+		logger:       logger,
+	}
+	result.limiter = newLimiter(&result.config)
+	if _, invalid := parseProxies(config.TrustedProxies); len(invalid) > 0 {
+		logger.Printf("ignoring invalid trusted proxies: %s\n", strings.Join(invalid, ", "))
 	}
+	result.upgrader = websocket.Upgrader{CheckOrigin: result.limiter.checkOrigin}
 
-	server.Logger.Fatal(err)
+	return result
 }
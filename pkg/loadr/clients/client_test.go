@@ -0,0 +1,174 @@
+package clients
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/codec"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+// serve a single websocket connection wrapped in a client
+func serve(t *testing.T, config *Config) (*client, *websocket.Conn, chan struct{}) {
+	clients := make(chan *client, 1)
+	gone := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		c := newClient(socket, config, codec.JSON, func() {}, func() { gone <- struct{}{} })
+		go c.run()
+		clients <- c
+	}))
+	t.Cleanup(server.Close)
+
+	remote, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = remote.Close() })
+
+	return <-clients, remote, gone
+}
+
+func TestClient_RemoteClose(t *testing.T) {
+	config := &Config{PingInterval: time.Hour, PongTimeout: time.Hour, WriteTimeout: time.Second}
+	c, remote, gone := serve(t, config)
+
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	assert.NoError(t, remote.WriteMessage(websocket.CloseMessage, message))
+
+	select {
+	case <-gone:
+	case <-time.After(time.Second):
+		t.Fatal("client not reported gone")
+	}
+	assert.False(t, c.IsAlive())
+}
+
+func TestClient_MissingPong(t *testing.T) {
+	config := &Config{PingInterval: 10 * time.Millisecond, PongTimeout: 50 * time.Millisecond, WriteTimeout: time.Second}
+	c, _, gone := serve(t, config)
+
+	// The remote never reads, so pings are never answered
+	select {
+	case <-gone:
+	case <-time.After(time.Second):
+		t.Fatal("client not reported gone")
+	}
+	assert.False(t, c.IsAlive())
+}
+
+func TestClient_AnsweredPings(t *testing.T) {
+	config := &Config{PingInterval: 10 * time.Millisecond, PongTimeout: 50 * time.Millisecond, WriteTimeout: time.Second}
+	c, remote, gone := serve(t, config)
+
+	// Reading lets the default ping handler answer with pongs
+	go func() {
+		for {
+			if _, _, err := remote.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-gone:
+		t.Fatal("live client reported gone")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.True(t, c.IsAlive())
+	assert.NoError(t, c.Close())
+	assert.False(t, c.IsAlive())
+}
+
+func TestClientListener_Codecs(t *testing.T) {
+	listener := New(Config{}, log.New(io.Discard, "", 0)).(*clientListener)
+	endpoint := echo.New()
+	endpoint.GET("/:token", listener.websocketHandler)
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+
+	progress := &loadr.Progress{Stage: "a", Progress: 0.5}
+	cases := map[string]struct {
+		subprotocols []string
+		codec        codec.Codec
+		messageType  int
+	}{
+		"none":        {nil, codec.JSON, websocket.TextMessage},
+		"msgpack":     {[]string{"loadr.msgpack", "loadr.json"}, codec.MsgPack, websocket.BinaryMessage},
+		"protobuf":    {[]string{"loadr.protobuf"}, codec.Protobuf, websocket.BinaryMessage},
+		"unsupported": {[]string{"loadr.xml"}, codec.JSON, websocket.TextMessage},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: c.subprotocols}
+			remote, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/x", nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer remote.Close() // nolint: errcheck
+
+			subscription := <-listener.clients
+			defer subscription.Client.Close() // nolint: errcheck
+			assert.NoError(t, subscription.Client.Write(progress))
+
+			messageType, data, err := remote.ReadMessage()
+			assert.NoError(t, err)
+			assert.Equal(t, c.messageType, messageType)
+			expected, _ := c.codec.EncodeProgress(progress)
+			assert.Equal(t, expected, data)
+		})
+	}
+}
+
+func TestClientListener_SpoofedForwardedFor(t *testing.T) {
+	listener := New(Config{MaxConnectionsPerIP: 1}, log.New(io.Discard, "", 0)).(*clientListener)
+	endpoint := echo.New()
+	endpoint.GET("/:token", listener.websocketHandler)
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/x"
+
+	remote, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"1.1.1.1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer remote.Close() // nolint: errcheck
+	subscription := <-listener.clients
+	defer subscription.Client.Close() // nolint: errcheck
+
+	// A new forwarded address doesn't make a new client
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {"2.2.2.2"}, "X-Real-Ip": {"3.3.3.3"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+	}
+}
+
+func TestClientListener_DisconnectWithoutReader(t *testing.T) {
+	listener := New(Config{}, log.New(io.Discard, "", 0)).(*clientListener)
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		for i := 0; i <= disconnectedBuffer; i++ {
+			listener.disconnect(&loadr.Subscription{Token: "x"})
+		}
+	}()
+
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("reporting a disconnection blocked without a reader")
+	}
+	assert.Equal(t, loadr.Token("x"), (<-listener.Disconnected()).Token)
+}
@@ -0,0 +1,155 @@
+package clients
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+)
+
+// limiter keeps track of open connections to enforce the listener's limits
+type limiter struct {
+	config   *Config
+	proxies  []*net.IPNet
+	lock     sync.Mutex
+	total    int
+	perIP    map[string]int
+	perToken map[loadr.Token]int
+}
+
+// acquire a connection slot for an IP and token. It returns the HTTP status to
+// reject the request with, or a release func to call once the connection closes.
+func (l *limiter) acquire(ip string, token loadr.Token) (int, func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.config.MaxConnections > 0 && l.total >= l.config.MaxConnections {
+		return http.StatusServiceUnavailable, nil
+	}
+	if l.config.MaxConnectionsPerIP > 0 && l.perIP[ip] >= l.config.MaxConnectionsPerIP {
+		return http.StatusTooManyRequests, nil
+	}
+	if l.config.MaxSubscribersPerToken > 0 && l.perToken[token] >= l.config.MaxSubscribersPerToken {
+		return http.StatusTooManyRequests, nil
+	}
+
+	l.total++
+	l.perIP[ip]++
+	l.perToken[token]++
+
+	once := sync.Once{}
+	return http.StatusOK, func() {
+		once.Do(func() { l.release(ip, token) })
+	}
+}
+
+func (l *limiter) release(ip string, token loadr.Token) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	if l.perToken[token]--; l.perToken[token] <= 0 {
+		delete(l.perToken, token)
+	}
+}
+
+// clientIP of a request: the address it comes from, or the one a trusted proxy
+// forwarded it for. Forwarding headers from anyone else are ignored, they
+// would let clients pick the address their connections count against.
+func (l *limiter) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !l.trusted(ip) {
+		return ip
+	}
+
+	// The closest address that isn't a trusted proxy, proxies append to the list
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addresses := strings.Split(forwarded, ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			ip = strings.TrimSpace(addresses[i])
+			if !l.trusted(ip) {
+				break
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-Ip")); real != "" {
+		return real
+	}
+	return ip
+}
+
+// trusted reports whether an address belongs to a trusted proxy
+func (l *limiter) trusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range l.proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin against the allowed origins, or require the same origin when none are configured.
+// Requests without an Origin header don't come from browsers and are allowed.
+func (l *limiter) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(l.config.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range l.config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProxies addresses and CIDR ranges, returns the entries that are neither
+func parseProxies(proxies []string) ([]*net.IPNet, []string) {
+	var result []*net.IPNet
+	var invalid []string
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil {
+				bits := 8 * len(ip.To16())
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		} else if _, network, err := net.ParseCIDR(proxy); err == nil {
+			result = append(result, network)
+			continue
+		}
+		invalid = append(invalid, proxy)
+	}
+	return result, invalid
+}
+
+func newLimiter(config *Config) *limiter {
+	proxies, _ := parseProxies(config.TrustedProxies)
+	return &limiter{
+		config:   config,
+		proxies:  proxies,
+		perIP:    make(map[string]int),
+		perToken: make(map[loadr.Token]int),
+	}
+}
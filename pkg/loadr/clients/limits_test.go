@@ -0,0 +1,81 @@
+package clients
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Acquire(t *testing.T) {
+	l := newLimiter(&Config{MaxConnections: 3, MaxConnectionsPerIP: 2, MaxSubscribersPerToken: 1})
+
+	_, first := l.acquire("1.1.1.1", "a")
+	assert.NotNil(t, first)
+
+	status, release := l.acquire("1.1.1.1", "a")
+	assert.Nil(t, release)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	_, second := l.acquire("1.1.1.1", "b")
+	assert.NotNil(t, second)
+
+	status, release = l.acquire("1.1.1.1", "c")
+	assert.Nil(t, release)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+
+	_, third := l.acquire("2.2.2.2", "c")
+	assert.NotNil(t, third)
+
+	status, release = l.acquire("3.3.3.3", "d")
+	assert.Nil(t, release)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	first()
+	first()
+	_, release = l.acquire("3.3.3.3", "a")
+	assert.NotNil(t, release)
+	assert.Equal(t, 3, l.total)
+}
+
+func TestLimiter_CheckOrigin(t *testing.T) {
+	request := func(origin string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "http://loadr.local/x", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+
+	sameOrigin := newLimiter(&Config{})
+	assert.True(t, sameOrigin.checkOrigin(request("")))
+	assert.True(t, sameOrigin.checkOrigin(request("http://loadr.local")))
+	assert.False(t, sameOrigin.checkOrigin(request("http://evil.local")))
+
+	allowed := newLimiter(&Config{AllowedOrigins: []string{"https://app.local"}})
+	assert.True(t, allowed.checkOrigin(request("https://app.local")))
+	assert.False(t, allowed.checkOrigin(request("http://loadr.local")))
+
+	wildcard := newLimiter(&Config{AllowedOrigins: []string{"*"}})
+	assert.True(t, wildcard.checkOrigin(request("http://evil.local")))
+}
+
+func TestLimiter_ClientIP(t *testing.T) {
+	request := func(remote string, header http.Header) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "http://loadr.local/x", nil)
+		r.RemoteAddr = remote
+		r.Header = header
+		return r
+	}
+	spoofed := http.Header{"X-Forwarded-For": {"6.6.6.6"}, "X-Real-Ip": {"7.7.7.7"}}
+
+	direct := newLimiter(&Config{})
+	assert.Equal(t, "1.1.1.1", direct.clientIP(request("1.1.1.1:1234", spoofed)), "headers of untrusted peers are ignored")
+
+	proxied := newLimiter(&Config{TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}})
+	assert.Equal(t, "1.1.1.1", proxied.clientIP(request("1.1.1.1:1234", spoofed)))
+	assert.Equal(t, "2.2.2.2", proxied.clientIP(request("10.1.2.3:1234", http.Header{"X-Forwarded-For": {"6.6.6.6, 2.2.2.2, 192.168.1.1"}})),
+		"the closest untrusted address a client can't forge")
+	assert.Equal(t, "7.7.7.7", proxied.clientIP(request("192.168.1.1:1234", http.Header{"X-Real-Ip": {"7.7.7.7"}})))
+	assert.Equal(t, "10.1.2.3", proxied.clientIP(request("10.1.2.3:1234", http.Header{})))
+}
@@ -0,0 +1,306 @@
+// Package clustertest starts loadr nodes in one process, with their backend and
+// clients listeners on ephemeral ports and sharing an in-memory store and channel,
+// to test what happens across nodes without deploying them.
+package clustertest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/backend"
+	"github.com/Sinea/loadr/pkg/loadr/channels"
+	"github.com/Sinea/loadr/pkg/loadr/clients"
+	"github.com/Sinea/loadr/pkg/loadr/stores"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Timeout waiting for a progress or a connection
+const Timeout = 5 * time.Second
+
+// Cluster of nodes sharing a store and a channel
+type Cluster struct {
+	t      *testing.T
+	store  loadr.Store
+	broker *channels.Broker
+	nodes  []*Node
+}
+
+// Start a cluster of n nodes, they are killed when the test ends
+func Start(t *testing.T, n int) *Cluster {
+	store, err := stores.New(nil)
+	require.NoError(t, err)
+	c := &Cluster{
+		t:      t,
+		store:  store,
+		broker: channels.NewBroker(),
+	}
+	for i := 0; i < n; i++ {
+		node := &Node{
+			cluster:        c,
+			name:           fmt.Sprintf("node%d", i),
+			backendAddress: "127.0.0.1:0",
+			clientsAddress: "127.0.0.1:0",
+		}
+		node.start()
+		c.nodes = append(c.nodes, node)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Kill()
+		}
+		assert.NoError(t, c.broker.Close())
+	})
+	return c
+}
+
+// Node i of the cluster
+func (c *Cluster) Node(i int) *Node {
+	return c.nodes[i]
+}
+
+// Nodes of the cluster
+func (c *Cluster) Nodes() []*Node {
+	return c.nodes
+}
+
+// Store shared by the nodes
+func (c *Cluster) Store() loadr.Store {
+	return c.store
+}
+
+// Node of a cluster, a Service with its listeners
+type Node struct {
+	cluster        *Cluster
+	name           string
+	backendAddress string
+	clientsAddress string
+
+	lock     sync.Mutex
+	service  loadr.Service
+	channel  loadr.Channel
+	backend  loadr.BackendListener
+	clients  loadr.ClientListener
+	draining chan struct{}
+}
+
+// start the node on its addresses, ephemeral ports are kept across restarts
+func (n *Node) start() {
+	t := n.cluster.t
+	backendListener, err := net.Listen("tcp", n.backendAddress)
+	require.NoError(t, err)
+	clientsListener, err := net.Listen("tcp", n.clientsAddress)
+	require.NoError(t, err)
+	n.backendAddress = backendListener.Addr().String()
+	n.clientsAddress = clientsListener.Addr().String()
+
+	logger := log.New(io.Discard, "", 0)
+	n.channel = channels.New(channels.InMemoryConfig{Broker: n.cluster.broker})
+	n.service = loadr.New(n.cluster.store, n.channel, logger)
+	n.backend, err = backend.New(backend.Config{NetConfig: loadr.NetConfig{Listener: backendListener}})
+	require.NoError(t, err)
+	n.clients = clients.New(clients.Config{NetConfig: loadr.NetConfig{Listener: clientsListener}, AllowedOrigins: []string{"*"}}, logger)
+	n.service.Run(n.backend, n.clients)
+
+	// Nobody else reads the service's errors
+	n.draining = make(chan struct{})
+	go func(service loadr.Service, done chan struct{}) {
+		for {
+			select {
+			case err := <-service.Errors():
+				t.Logf("%s: %s", n.name, err)
+			case <-done:
+				return
+			}
+		}
+	}(n.service, n.draining)
+}
+
+// Running reports whether the node is running
+func (n *Node) Running() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.service != nil
+}
+
+// Kill the node: its service stops, its listeners close and it leaves the
+// channel. Connected clients get disconnected.
+func (n *Node) Kill() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.service == nil {
+		return
+	}
+	n.service.Stop()
+	close(n.draining)
+	assert.NoError(n.cluster.t, n.clients.Close())
+	assert.NoError(n.cluster.t, n.backend.Close())
+	assert.NoError(n.cluster.t, n.channel.Close())
+	n.service = nil
+}
+
+// Restart a killed node on the same addresses
+func (n *Node) Restart() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.service != nil {
+		return
+	}
+	n.start()
+}
+
+// subscribers of a tenant on the node
+func (n *Node) subscribers(tenant loadr.Tenant) int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.service == nil {
+		return 0
+	}
+	return n.service.Stats(tenant).Subscribers
+}
+
+// BackendURL of the node's backend listener
+func (n *Node) BackendURL() string {
+	return "http://" + n.backendAddress
+}
+
+// ClientsURL of the node's clients listener
+func (n *Node) ClientsURL() string {
+	return "ws://" + n.clientsAddress
+}
+
+// Post a progress to the node's backend with the Broadcast guarantee, returns
+// the response status
+func (n *Node) Post(token loadr.Token, progress loadr.Progress) (int, error) {
+	body, err := json.Marshal(backend.UpdateProgressRequest{Guarantee: loadr.Broadcast, Progress: progress})
+	if err != nil {
+		return 0, err
+	}
+	client := http.Client{Timeout: Timeout}
+	response, err := client.Post(n.BackendURL()+"/"+string(token), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	_ = response.Body.Close()
+	return response.StatusCode, nil
+}
+
+// MustPost a progress to the node's backend, failing the test unless it is accepted
+func (n *Node) MustPost(token loadr.Token, progress loadr.Progress) {
+	t := n.cluster.t
+	t.Helper()
+	status, err := n.Post(token, progress)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status, "posting to %s", n.name)
+}
+
+// Subscribe a websocket client to a token on the node. Returns once the node
+// handled the subscription, so progresses posted afterwards are received once.
+func (n *Node) Subscribe(token loadr.Token) *Subscriber {
+	t := n.cluster.t
+	t.Helper()
+	before := n.subscribers(token.Tenant())
+	dialer := websocket.Dialer{HandshakeTimeout: Timeout}
+	connection, _, err := dialer.Dial(n.ClientsURL()+"/"+string(token), nil)
+	require.NoError(t, err, "subscribing on %s", n.name)
+	require.Eventually(t, func() bool {
+		return n.subscribers(token.Tenant()) > before
+	}, Timeout, 5*time.Millisecond, "subscription not handled by %s", n.name)
+
+	s := &Subscriber{
+		t:          t,
+		connection: connection,
+		progresses: make(chan loadr.Progress, channels.DefaultInMemoryBuffer),
+		closed:     make(chan struct{}),
+	}
+	go s.read()
+	t.Cleanup(func() { _ = connection.Close() })
+	return s
+}
+
+// Subscriber is a websocket client of a node
+type Subscriber struct {
+	t          *testing.T
+	connection *websocket.Conn
+	progresses chan loadr.Progress
+	closed     chan struct{}
+}
+
+// read progresses until the connection closes
+func (s *Subscriber) read() {
+	defer close(s.closed)
+	for {
+		_, data, err := s.connection.ReadMessage()
+		if err != nil {
+			return
+		}
+		var p loadr.Progress
+		if err := json.Unmarshal(data, &p); err != nil {
+			s.t.Errorf("unexpected message %q: %s", data, err)
+			return
+		}
+		s.progresses <- p
+	}
+}
+
+// Expect the next progress the subscriber receives
+func (s *Subscriber) Expect(expected loadr.Progress) {
+	s.t.Helper()
+	select {
+	case p := <-s.progresses:
+		assert.Equal(s.t, expected, p)
+	case <-s.closed:
+		// Progresses received before the connection closed come first
+		select {
+		case p := <-s.progresses:
+			assert.Equal(s.t, expected, p)
+		default:
+			s.t.Errorf("connection closed while expecting %v", expected)
+		}
+	case <-time.After(Timeout):
+		s.t.Errorf("timeout expecting %v", expected)
+	}
+}
+
+// ExpectNothing received for a while
+func (s *Subscriber) ExpectNothing(d time.Duration) {
+	s.t.Helper()
+	select {
+	case p := <-s.progresses:
+		s.t.Errorf("unexpected progress %v", p)
+	case <-time.After(d):
+	}
+}
+
+// ExpectClosed connection, progresses received meanwhile are skipped
+func (s *Subscriber) ExpectClosed() {
+	s.t.Helper()
+	select {
+	case <-s.closed:
+	case <-time.After(Timeout):
+		s.t.Error("connection still open")
+	}
+}
+
+// Close the connection
+func (s *Subscriber) Close() error {
+	return s.connection.Close()
+}
+
+// Expect every subscriber to receive a progress next
+func Expect(expected loadr.Progress, subscribers ...*Subscriber) {
+	for _, s := range subscribers {
+		s.t.Helper()
+		s.Expect(expected)
+	}
+}
@@ -0,0 +1,56 @@
+package clustertest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCluster_CrossNodeDelivery(t *testing.T) {
+	c := Start(t, 3)
+	subscribers := []*Subscriber{c.Node(0).Subscribe("x"), c.Node(1).Subscribe("x"), c.Node(2).Subscribe("x")}
+	other := c.Node(2).Subscribe("y")
+
+	for i, node := range c.Nodes() {
+		p := loadr.Progress{Stage: "step", Progress: float32(i+1) / 4}
+		node.MustPost("x", p)
+		Expect(p, subscribers...)
+	}
+	other.ExpectNothing(100 * time.Millisecond)
+}
+
+func TestCluster_KillRestart(t *testing.T) {
+	c := Start(t, 2)
+	a, b := c.Node(0), c.Node(1)
+	first := loadr.Progress{Stage: "a", Progress: 0.25}
+	a.MustPost("x", first)
+
+	onB := b.Subscribe("x")
+	onB.Expect(first)
+	b.Kill()
+	onB.ExpectClosed()
+	assert.False(t, b.Running())
+	_, err := b.Post("x", first)
+	assert.Error(t, err, "a killed node doesn't accept posts")
+
+	// The survivor keeps serving and storing
+	onA := a.Subscribe("x")
+	onA.Expect(first)
+	second := loadr.Progress{Stage: "b", Progress: 0.5}
+	a.MustPost("x", second)
+	onA.Expect(second)
+
+	// A restarted node serves the stored progress and receives new ones
+	b.Restart()
+	onB = b.Subscribe("x")
+	onB.Expect(second)
+	third := loadr.Progress{Stage: "c", Progress: 1}
+	status, err := b.Post("x", third)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	Expect(third, onA, onB)
+}
@@ -0,0 +1,103 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+)
+
+// SubprotocolPrefix of the websocket subprotocols clients pick a codec with, e.g. loadr.msgpack
+const SubprotocolPrefix = "loadr."
+
+// Codec encodes what nodes send each other over a channel and what they send to clients
+type Codec interface {
+	// Name identifying the codec in configuration
+	Name() string
+	// Binary reports whether payloads are binary, otherwise they are text
+	Binary() bool
+	// ContentType of payloads, for transports that label them
+	ContentType() string
+	EncodeEnvelope(*envelope.Envelope) ([]byte, error)
+	DecodeEnvelope([]byte) (*envelope.Envelope, error)
+	EncodeProgress(*loadr.Progress) ([]byte, error)
+}
+
+// Codecs available
+var (
+	JSON     Codec = jsonCodec{}
+	MsgPack  Codec = msgpackCodec{}
+	Protobuf Codec = protobufCodec{}
+)
+
+// All codecs, JSON first
+var All = []Codec{JSON, MsgPack, Protobuf}
+
+// ByName finds a codec, an empty name is JSON
+func ByName(name string) (Codec, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return JSON, nil
+	}
+	for _, c := range All {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec '%s'", name)
+}
+
+// Subprotocol clients request to receive progresses encoded with a codec
+func Subprotocol(c Codec) string {
+	return SubprotocolPrefix + c.Name()
+}
+
+// BySubprotocol finds the codec of a negotiated subprotocol, none is JSON
+func BySubprotocol(subprotocol string) (Codec, error) {
+	if subprotocol == "" {
+		return JSON, nil
+	}
+	if !strings.HasPrefix(subprotocol, SubprotocolPrefix) {
+		return nil, fmt.Errorf("unknown subprotocol '%s'", subprotocol)
+	}
+	return ByName(strings.TrimPrefix(subprotocol, SubprotocolPrefix))
+}
+
+// decodeJSON envelopes found on a channel that isn't JSON, sent by nodes still
+// using JSON while a cluster switches codecs. A JSON envelope starts with '{',
+// which neither binary codec starts an envelope with.
+func decodeJSON(data []byte) (*envelope.Envelope, bool, error) {
+	if len(data) == 0 || data[0] != '{' {
+		return nil, false, nil
+	}
+	e, err := envelope.Decode(data)
+	return e, true, err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) EncodeEnvelope(e *envelope.Envelope) ([]byte, error) {
+	return envelope.Encode(e)
+}
+
+func (jsonCodec) DecodeEnvelope(data []byte) (*envelope.Envelope, error) {
+	return envelope.Decode(data)
+}
+
+func (jsonCodec) EncodeProgress(p *loadr.Progress) ([]byte, error) {
+	return json.Marshal(p)
+}
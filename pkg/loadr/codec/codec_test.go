@@ -0,0 +1,86 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var progress = loadr.MetaProgress{Token: "tenant/x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+
+func TestCodecs_Envelope(t *testing.T) {
+	for _, c := range All {
+		t.Run(c.Name(), func(t *testing.T) {
+			ctx := loadr.WithTrace(context.Background(), "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+			e := envelope.New(ctx, "node", progress)
+			data, err := c.EncodeEnvelope(e)
+			assert.NoError(t, err)
+
+			decoded, err := c.DecodeEnvelope(data)
+			assert.NoError(t, err)
+			assert.True(t, e.Time.Equal(decoded.Time))
+			decoded.Time = e.Time
+			assert.Equal(t, e, decoded)
+		})
+	}
+}
+
+func TestCodecs_DecodeJSON(t *testing.T) {
+	data, _ := envelope.Encode(envelope.New(context.Background(), "node", progress))
+	legacy, _ := json.Marshal(progress)
+
+	for _, c := range All {
+		for _, message := range [][]byte{data, legacy} {
+			e, err := c.DecodeEnvelope(message)
+			assert.NoError(t, err, c.Name())
+			assert.Equal(t, progress, e.MetaProgress, c.Name())
+		}
+	}
+}
+
+func TestCodecs_Progress(t *testing.T) {
+	data, err := JSON.EncodeProgress(&progress.Progress)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"stage":"a","progress":0.5}`, string(data))
+
+	data, err = Protobuf.EncodeProgress(&progress.Progress)
+	assert.NoError(t, err)
+	p := loadr.Progress{}
+	assert.NoError(t, consumeProgress(data, &p))
+	assert.Equal(t, progress.Progress, p)
+}
+
+func TestProtobuf_UnknownFields(t *testing.T) {
+	data, _ := Protobuf.EncodeEnvelope(&envelope.Envelope{Version: 2, Type: "other", Time: time.Now()})
+	data = protowire.AppendTag(data, 99, protowire.BytesType)
+	data = protowire.AppendString(data, "from a newer node")
+
+	e, err := Protobuf.DecodeEnvelope(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, e.Version)
+	assert.False(t, e.IsProgress())
+
+	_, err = Protobuf.DecodeEnvelope([]byte{0x0a, 0xff})
+	assert.Error(t, err)
+}
+
+func TestBySubprotocol(t *testing.T) {
+	c, err := BySubprotocol("")
+	assert.NoError(t, err)
+	assert.Equal(t, JSON, c)
+
+	c, err = BySubprotocol(Subprotocol(MsgPack))
+	assert.NoError(t, err)
+	assert.Equal(t, MsgPack, c)
+
+	_, err = BySubprotocol("chat")
+	assert.Error(t, err)
+	_, err = ByName("xml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,58 @@
+package codec
+
+import (
+	"bytes"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackCodec encodes the same fields as JSON, under the same names
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) EncodeEnvelope(e *envelope.Envelope) ([]byte, error) {
+	return marshalMsgPack(e)
+}
+
+func (msgpackCodec) DecodeEnvelope(data []byte) (*envelope.Envelope, error) {
+	if e, ok, err := decodeJSON(data); ok {
+		return e, err
+	}
+	e := &envelope.Envelope{}
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	if err := decoder.Decode(e); err != nil {
+		return nil, err
+	}
+	if e.Version == 0 {
+		e.Type = envelope.TypeProgress
+	}
+	return e, nil
+}
+
+func (msgpackCodec) EncodeProgress(p *loadr.Progress) ([]byte, error) {
+	return marshalMsgPack(p)
+}
+
+func marshalMsgPack(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,163 @@
+package codec
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/envelope"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers, see loadr.proto
+const (
+	envelopeVersion  protowire.Number = 1
+	envelopeType     protowire.Number = 2
+	envelopeOrigin   protowire.Number = 3
+	envelopeTime     protowire.Number = 4
+	envelopeTrace    protowire.Number = 5
+	envelopeToken    protowire.Number = 6
+	envelopeProgress protowire.Number = 7
+
+	progressStage    protowire.Number = 1
+	progressProgress protowire.Number = 2
+)
+
+// protobufCodec encodes the messages described by loadr.proto
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Binary() bool {
+	return true
+}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufCodec) EncodeEnvelope(e *envelope.Envelope) ([]byte, error) {
+	var b []byte
+	b = protowire.AppendTag(b, envelopeVersion, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(e.Version))
+	b = appendString(b, envelopeType, e.Type)
+	b = appendString(b, envelopeOrigin, e.Origin)
+	if !e.Time.IsZero() {
+		b = protowire.AppendTag(b, envelopeTime, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(e.Time.UnixNano()))
+	}
+	b = appendString(b, envelopeTrace, e.Trace)
+	b = appendString(b, envelopeToken, string(e.Token))
+	b = protowire.AppendTag(b, envelopeProgress, protowire.BytesType)
+	b = protowire.AppendBytes(b, appendProgress(nil, &e.Progress))
+	return b, nil
+}
+
+func (protobufCodec) DecodeEnvelope(data []byte) (*envelope.Envelope, error) {
+	if e, ok, err := decodeJSON(data); ok {
+		return e, err
+	}
+	e := &envelope.Envelope{}
+	err := consumeFields(data, func(number protowire.Number, kind protowire.Type, value []byte) (int, error) {
+		switch {
+		case number == envelopeVersion && kind == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(value)
+			e.Version = int(v)
+			return n, nil
+		case number == envelopeType && kind == protowire.BytesType:
+			return consumeString(value, &e.Type)
+		case number == envelopeOrigin && kind == protowire.BytesType:
+			return consumeString(value, &e.Origin)
+		case number == envelopeTime && kind == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(value)
+			e.Time = time.Unix(0, int64(v)).UTC()
+			return n, nil
+		case number == envelopeTrace && kind == protowire.BytesType:
+			return consumeString(value, &e.Trace)
+		case number == envelopeToken && kind == protowire.BytesType:
+			var token string
+			n, err := consumeString(value, &token)
+			e.Token = loadr.Token(token)
+			return n, err
+		case number == envelopeProgress && kind == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(value)
+			if n < 0 {
+				return n, nil
+			}
+			return n, consumeProgress(v, &e.Progress)
+		}
+		return protowire.ConsumeFieldValue(number, kind, value), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if e.Version == 0 {
+		e.Type = envelope.TypeProgress
+	}
+	return e, nil
+}
+
+func (protobufCodec) EncodeProgress(p *loadr.Progress) ([]byte, error) {
+	return appendProgress(nil, p), nil
+}
+
+func appendProgress(b []byte, p *loadr.Progress) []byte {
+	b = appendString(b, progressStage, p.Stage)
+	b = protowire.AppendTag(b, progressProgress, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(p.Progress))
+}
+
+func consumeProgress(data []byte, p *loadr.Progress) error {
+	return consumeFields(data, func(number protowire.Number, kind protowire.Type, value []byte) (int, error) {
+		switch {
+		case number == progressStage && kind == protowire.BytesType:
+			return consumeString(value, &p.Stage)
+		case number == progressProgress && kind == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(value)
+			p.Progress = math.Float32frombits(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(number, kind, value), nil
+	})
+}
+
+// consumeFields calls field for every field of a message, with the bytes
+// following the field's tag. field returns how many of them the value took.
+func consumeFields(data []byte, field func(protowire.Number, protowire.Type, []byte) (int, error)) error {
+	for len(data) > 0 {
+		number, kind, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n, err := field(number, kind, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func appendString(b []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func consumeString(data []byte, value *string) (int, error) {
+	v, n := protowire.ConsumeString(data)
+	if n < 0 {
+		return n, errors.New("invalid string")
+	}
+	*value = v
+	return n, nil
+}
@@ -0,0 +1,33 @@
+package loadr
+
+import "context"
+
+type guaranteeKey struct{}
+
+// WithGuarantee a progress is set with, so stores can save it in the background
+// when it is below Storage
+func WithGuarantee(ctx context.Context, guarantee uint) context.Context {
+	return context.WithValue(ctx, guaranteeKey{}, guarantee)
+}
+
+// GuaranteeOf a progress being set, Storage when the context doesn't carry one
+func GuaranteeOf(ctx context.Context) uint {
+	if guarantee, ok := ctx.Value(guaranteeKey{}).(uint); ok {
+		return guarantee
+	}
+	return Storage
+}
+
+type traceKey struct{}
+
+// WithTrace context of the request setting a progress, a W3C traceparent,
+// so channels forward it to the other nodes
+func WithTrace(ctx context.Context, traceparent string) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceparent)
+}
+
+// TraceOf a progress being set, empty when the context doesn't carry one
+func TraceOf(ctx context.Context) string {
+	trace, _ := ctx.Value(traceKey{}).(string)
+	return trace
+}
@@ -0,0 +1,80 @@
+package envelope
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+)
+
+// Version of the envelopes encoded by this build
+const Version = 1
+
+// Message types
+const (
+	TypeProgress = "progress"
+)
+
+// Envelope wraps a progress sent over a channel with what nodes need to know about it.
+// The progress fields stay at the top level, where unversioned messages had them,
+// so nodes that predate envelopes still decode the progress.
+type Envelope struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	// Origin node that pushed the progress
+	Origin string `json:"origin,omitempty"`
+	// Time the progress was pushed at
+	Time time.Time `json:"time"`
+	// Trace context of the update, a W3C traceparent, when known
+	Trace string `json:"trace,omitempty"`
+	loadr.MetaProgress
+}
+
+// IsProgress reports whether the envelope carries a progress
+func (e *Envelope) IsProgress() bool {
+	return e.Type == TypeProgress
+}
+
+// Delay between the time the progress was pushed and now
+func (e *Envelope) Delay(now time.Time) time.Duration {
+	if e.Time.IsZero() {
+		return 0
+	}
+	return now.Sub(e.Time)
+}
+
+// New envelope for a progress pushed now by origin, with the trace context of ctx
+func New(ctx context.Context, origin string, progress loadr.MetaProgress) *Envelope {
+	return &Envelope{
+		Version:      Version,
+		Type:         TypeProgress,
+		Origin:       origin,
+		Time:         time.Now().UTC(),
+		Trace:        loadr.TraceOf(ctx),
+		MetaProgress: progress,
+	}
+}
+
+// Encode an envelope
+func Encode(e *Envelope) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode an envelope of any version. Messages without a version are bare
+// progresses from nodes that predate envelopes. Newer versions are decoded as
+// far as this build understands them, their unknown fields are ignored.
+func Decode(data []byte) (*Envelope, error) {
+	e := &Envelope{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	if e.Version < 0 {
+		return nil, fmt.Errorf("invalid envelope version %d", e.Version)
+	}
+	if e.Version == 0 {
+		e.Type = TypeProgress
+	}
+	return e, nil
+}
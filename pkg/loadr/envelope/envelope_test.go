@@ -0,0 +1,55 @@
+package envelope
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+)
+
+var progress = loadr.MetaProgress{Token: "tenant/x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}}
+
+func TestEncodeDecode(t *testing.T) {
+	trace := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	data, err := Encode(New(loadr.WithTrace(context.Background(), trace), "node", progress))
+	assert.NoError(t, err)
+
+	e, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, Version, e.Version)
+	assert.True(t, e.IsProgress())
+	assert.Equal(t, "node", e.Origin)
+	assert.Equal(t, trace, e.Trace)
+	assert.Equal(t, progress, e.MetaProgress)
+	assert.False(t, e.Time.IsZero())
+}
+
+func TestDecode_Unversioned(t *testing.T) {
+	data, _ := json.Marshal(progress)
+
+	e, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, e.Version)
+	assert.True(t, e.IsProgress())
+	assert.Equal(t, progress, e.MetaProgress)
+}
+
+func TestDecode_ByUnversionedNodes(t *testing.T) {
+	data, _ := Encode(New(context.Background(), "node", progress))
+
+	p := loadr.MetaProgress{}
+	assert.NoError(t, json.Unmarshal(data, &p))
+	assert.Equal(t, progress, p)
+}
+
+func TestDecode_NewerVersion(t *testing.T) {
+	e, err := Decode([]byte(`{"v":7,"type":"other","origin":"node","unknown":true,"Token":"x"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, e.Version)
+	assert.False(t, e.IsProgress())
+
+	_, err = Decode([]byte(`{"v":-1}`))
+	assert.Error(t, err)
+}
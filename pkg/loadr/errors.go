@@ -1,5 +1,26 @@
 package loadr
 
+// ErrNotFound is returned by stores for unknown tokens, match it with errors.Is
+var ErrNotFound = &Error{Code: NotFoundError, Message: "progress not found"}
+
+// ErrConflict is returned by versioned stores when a conditional set's condition isn't met
+var ErrConflict = &Error{Code: ConflictError, Message: "progress version mismatch"}
+
+// ErrUnsupported is returned for conditional sets on stores without versions
+var ErrUnsupported = &Error{Code: UnsupportedError, Message: "store doesn't keep progress versions"}
+
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// Unwrap the error that caused this one
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error with the same code, so errors.Is
+// matches codes whatever the message
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
@@ -0,0 +1,42 @@
+// Package httpserver starts the echo servers of the backend and clients
+// listeners on their NetConfig.
+package httpserver
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/labstack/echo"
+)
+
+// Start a server on the configured listener or address, with TLS when a
+// certificate is configured. It returns once the server is closed.
+func Start(server *echo.Echo, config loadr.NetConfig) {
+	var err error
+	if config.KeyFile != "" && config.CertFile != "" {
+		if config.Listener != nil {
+			server.TLSListener, err = tlsListener(config)
+		}
+		if err == nil {
+			err = server.StartTLS(config.Address, config.CertFile, config.KeyFile)
+		}
+	} else {
+		server.Listener = config.Listener
+		err = server.Start(config.Address)
+	}
+
+	if err != http.ErrServerClosed {
+		server.Logger.Fatal(err)
+	}
+}
+
+// tlsListener serving TLS on the configured listener
+func tlsListener(config loadr.NetConfig) (net.Listener, error) {
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(config.Listener, &tls.Config{Certificates: []tls.Certificate{certificate}}), nil
+}
@@ -1,25 +1,128 @@
 package loadr
 
-import "time"
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr/ratelimit"
+)
 
 const (
 	_ uint = iota
 	Storage
 	Broadcast
 
+	// Error codes are part of the API, new ones take the next free value
+
 	// Channel error codes
-	ChannelCloseError = 1 + iota
-	ChannelSubscribeError
-	ChannelUnmarshalError
+	ChannelCloseError        = 4
+	ChannelSubscribeError    = 5
+	ChannelUnmarshalError    = 6
+	ChannelDisconnectedError = 11
+	ChannelReconnectedError  = 12
+	ChannelPeerError         = 13
+	ChannelOverflowError     = 19
+
+	// Ticket error codes
+	TicketInvalidError = 7
+	TicketExpiredError = 8
+	TicketScopeError   = 9
+
+	// Service error codes
+	QuotaExceededError = 10
+	ValidationError    = 14
+	StorageError       = 20
+	BroadcastError     = 21
+
+	// Store error codes
+	NotFoundError    = 15
+	FlushError       = 16
+	ConflictError    = 17
+	UnsupportedError = 18
 )
 
+// TenantSeparator separates the tenant from the token inside a namespaced token
+const TenantSeparator = "/"
+
 type Error struct {
 	Code    uint
 	Message string
+	// Err that caused the error, if any
+	Err error
 }
 
 type Token string
 
+// Tenant the token is namespaced under, empty for the default tenant
+func (t Token) Tenant() Tenant {
+	if i := strings.Index(string(t), TenantSeparator); i >= 0 {
+		return Tenant(t[:i])
+	}
+	return ""
+}
+
+// Tenant namespace isolating a group of tokens from other tenants
+type Tenant string
+
+// Token namespaced under the tenant. Tokens of the default tenant are left untouched.
+func (t Tenant) Token(token Token) Token {
+	if t == "" {
+		return token
+	}
+	return Token(string(t) + TenantSeparator + string(token))
+}
+
+// DefaultTokenIdleTimeout after which a token without updates stops being active
+const DefaultTokenIdleTimeout = 10 * time.Minute
+
+// TenantLimits quotas enforced per tenant, zero values mean unlimited
+type TenantLimits struct {
+	// MaxTokens active tokens, counted per node. Tokens are active until they
+	// are deleted or go without updates for TokenIdleTimeout.
+	MaxTokens int
+	// TokenIdleTimeout DefaultTokenIdleTimeout when 0
+	TokenIdleTimeout time.Duration
+	// Updates rate limit on progress updates
+	Updates ratelimit.Limit
+	// MaxSubscribers concurrent subscribers, counted per node
+	MaxSubscribers int
+}
+
+// TenantStats usage statistics of a tenant on this node
+type TenantStats struct {
+	Tokens      int    `json:"tokens"`
+	Subscribers int    `json:"subscribers"`
+	Updates     uint64 `json:"updates"`
+	Rejected    uint64 `json:"rejected"`
+}
+
+// Version of a progress, incremented every time it is set
+type Version uint64
+
+// Versions with a special meaning for conditional sets
+const (
+	// NoVersion of a missing progress, setting at it only creates the progress
+	NoVersion Version = 0
+	// AnyVersion of an existing progress, setting at it only updates the progress
+	AnyVersion Version = math.MaxUint64
+)
+
+// Matches reports whether a progress at current, NoVersion when missing, meets
+// the condition of a set at this version
+func (v Version) Matches(current Version) bool {
+	switch v {
+	case NoVersion:
+		return current == NoVersion
+	case AnyVersion:
+		return current != NoVersion
+	default:
+		return current == v
+	}
+}
+
 // Subscription represents a client subscription on a token
 type Subscription struct {
 	Token  Token
@@ -43,6 +146,9 @@ type NetConfig struct {
 	Address  string
 	CertFile string
 	KeyFile  string
+	// Listener accepting connections instead of listening on Address, e.g. one
+	// bound to an ephemeral port
+	Listener net.Listener
 }
 
 // ErrorProvider stream of errors
@@ -50,10 +156,24 @@ type ErrorProvider interface {
 	Errors() <-chan error
 }
 
+// StatsProvider usage statistics per tenant
+type StatsProvider interface {
+	Stats(Tenant) TenantStats
+}
+
+// ConnectionChecker reports whether a component is currently connected to the service backing it
+type ConnectionChecker interface {
+	IsConnected() bool
+}
+
 // ProgressHandler handle progress operations
 type ProgressHandler interface {
-	Delete(Token) error
-	Set(Token, *Progress, uint) error
+	StatsProvider
+	Get(context.Context, Token) (*Progress, Version, error)
+	Delete(context.Context, Token) error
+	Set(context.Context, Token, *Progress, uint) error
+	// SetIfVersion sets a progress only if it is at the version, see VersionedStore
+	SetIfVersion(context.Context, Token, *Progress, uint, Version) (Version, error)
 }
 
 // Service that dispatches progress
@@ -63,21 +183,70 @@ type Service interface {
 	HandleProgress(progress MetaProgress)
 	HandleSubscription(subscription *Subscription)
 	Run(BackendListener, ClientListener)
+	// Stop the loop started by Run, returns once it stopped. Listeners, the
+	// channel and the store are left to their owners to close.
+	Stop()
 	SetCleanupInterval(time.Duration)
+	SetTenantLimits(Tenant, TenantLimits)
 }
 
-// Store interface for progress persistence
+// Store interface for progress persistence. Get returns ErrNotFound for
+// unknown tokens, deleting one is not an error.
 type Store interface {
-	Get(Token) (*Progress, error)
-	Set(Token, *Progress) error
-	Delete(Token) error
+	Get(context.Context, Token) (*Progress, error)
+	Set(context.Context, Token, *Progress) error
+	Delete(context.Context, Token) error
+}
+
+// VersionedStore is implemented by stores keeping the version of progresses and
+// able to set them conditionally: at a version, only if missing with NoVersion or
+// only if existing with AnyVersion. Unmet conditions fail with ErrConflict.
+// Versions start at 1 whenever a progress is created, including after it was
+// deleted or expired, so a version only tells updates of one progress apart.
+type VersionedStore interface {
+	GetVersion(context.Context, Token) (*Progress, Version, error)
+	SetIfVersion(context.Context, Token, *Progress, Version) (Version, error)
+}
+
+// PropagationReporter is implemented by channels measuring how long progresses
+// pushed by other nodes take to reach this one
+type PropagationReporter interface {
+	PropagationDelay() time.Duration
+}
+
+// TokenSubscriber is implemented by channels able to route progresses only to
+// the nodes subscribed to their token. The service subscribes to a token while
+// it has local clients for it.
+type TokenSubscriber interface {
+	Subscribe(Token) error
+	Unsubscribe(Token) error
+}
+
+// Lister is implemented by stores able to list the progresses whose tokens start with a prefix
+type Lister interface {
+	List(ctx context.Context, prefix Token) ([]MetaProgress, error)
+}
+
+// Pusher is implemented by stores sharing the deployment of the channel, able to
+// save and push a progress in a single round trip. The service uses it for
+// progresses set with the Broadcast guarantee.
+type Pusher interface {
+	SetAndPush(context.Context, MetaProgress) error
+}
+
+// Observer is implemented by stores caching progresses. The service hands them
+// the progresses received over the channel, and the tokens it stops receiving
+// progresses of.
+type Observer interface {
+	Observe(MetaProgress)
+	Forget(Token)
 }
 
 // Channel used to send/receive progresses to other nodes
 type Channel interface {
 	ErrorProvider
 
-	Push(MetaProgress) error
+	Push(context.Context, MetaProgress) error
 	Progresses() <-chan MetaProgress
 	Close() error
 }
@@ -92,10 +261,29 @@ type Client interface {
 // ClientListener provides new clients that are interested in progress updates
 type ClientListener interface {
 	Wait() <-chan *Subscription
+	Disconnected() <-chan *Subscription
 	Close() error
 }
 
+// TicketIssuer hands out subscription tickets for a token or token prefix
+type TicketIssuer interface {
+	Issue(tenant Tenant, scope Token, prefix bool, ttl time.Duration) (string, time.Time, error)
+}
+
+// TicketVerifier checks that a subscription ticket grants access to a token
+// and returns the tenant the ticket was issued for
+type TicketVerifier interface {
+	Verify(ticket string, token Token) (Tenant, error)
+}
+
+// TicketSigner both issues and verifies subscription tickets
+type TicketSigner interface {
+	TicketIssuer
+	TicketVerifier
+}
+
 // BackendListener provides an interface for inputting progresses from backend
 type BackendListener interface {
 	Run(ProgressHandler)
+	Close() error
 }
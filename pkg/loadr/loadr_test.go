@@ -0,0 +1,34 @@
+package loadr
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestErrorCodes_Stable(t *testing.T) {
+	// Codes reach clients and logs, they must not move when new ones are added
+	codes := map[uint]uint{
+		ChannelCloseError:        4,
+		ChannelSubscribeError:    5,
+		ChannelUnmarshalError:    6,
+		TicketInvalidError:       7,
+		TicketExpiredError:       8,
+		TicketScopeError:         9,
+		QuotaExceededError:       10,
+		ChannelDisconnectedError: 11,
+		ChannelReconnectedError:  12,
+		ChannelPeerError:         13,
+		ValidationError:          14,
+		NotFoundError:            15,
+		FlushError:               16,
+		ConflictError:            17,
+		UnsupportedError:         18,
+		ChannelOverflowError:     19,
+		StorageError:             20,
+		BroadcastError:           21,
+	}
+	assert.Len(t, codes, 18, "codes are unique")
+	for code, expected := range codes {
+		assert.Equal(t, expected, code)
+	}
+}
@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Limit of a token bucket: Rate tokens are added every second, up to Burst
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// IsZero reports whether the limit is unset, meaning unlimited
+func (l Limit) IsZero() bool {
+	return l.Rate <= 0
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst < 1 {
+		return math.Max(1, math.Ceil(l.Rate))
+	}
+	return float64(l.Burst)
+}
+
+// Bucket is a token bucket, it is not safe for concurrent use
+type Bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// Take a token at the given time. When the bucket is empty it returns false
+// and how long until a token becomes available.
+func (b *Bucket) Take(now time.Time) (bool, time.Duration) {
+	if b.limit.IsZero() {
+		return true, 0
+	}
+	burst := b.limit.burst()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / b.limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// NewBucket full token bucket for a limit
+func NewBucket(limit Limit) *Bucket {
+	return &Bucket{
+		limit:  limit,
+		tokens: limit.burst(),
+	}
+}
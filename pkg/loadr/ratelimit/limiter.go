@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter decides whether an action identified by a key may happen now. When it
+// may not, it returns how long to wait before trying again. The context bounds any remote call.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// pruneInterval at which idle buckets are dropped from a memory limiter
+const pruneInterval = time.Minute
+
+type memory struct {
+	limit   Limit
+	lock    sync.Mutex
+	buckets map[string]*Bucket
+	pruned  time.Time
+	now     func() time.Time
+}
+
+func (m *memory) Allow(_ context.Context, key string) (bool, time.Duration, error) {
+	if m.limit.IsZero() {
+		return true, 0, nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	m.prune(now)
+
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = NewBucket(m.limit)
+		m.buckets[key] = bucket
+	}
+	allowed, wait := bucket.Take(now)
+
+	return allowed, wait, nil
+}
+
+// prune buckets that have been idle long enough to be full again, they behave like new ones
+func (m *memory) prune(now time.Time) {
+	if now.Sub(m.pruned) < pruneInterval {
+		return
+	}
+	m.pruned = now
+	refill := time.Duration(m.limit.burst() / m.limit.Rate * float64(time.Second))
+	for key, bucket := range m.buckets {
+		if now.Sub(bucket.last) > refill {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// NewMemory limiter keeping one token bucket per key in this process
+func NewMemory(limit Limit) Limiter {
+	return &memory{
+		limit:   limit,
+		buckets: make(map[string]*Bucket),
+		now:     time.Now,
+	}
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket_Take(t *testing.T) {
+	b := NewBucket(Limit{Rate: 1, Burst: 2})
+	now := time.Now()
+
+	ok, _ := b.Take(now)
+	assert.True(t, ok)
+	ok, _ = b.Take(now)
+	assert.True(t, ok)
+	ok, wait := b.Take(now)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	ok, _ = b.Take(now.Add(time.Second))
+	assert.True(t, ok)
+}
+
+func TestBucket_Unlimited(t *testing.T) {
+	b := NewBucket(Limit{})
+	for i := 0; i < 100; i++ {
+		ok, _ := b.Take(time.Now())
+		assert.True(t, ok)
+	}
+}
+
+func TestMemory_Allow(t *testing.T) {
+	l := NewMemory(Limit{Rate: 1, Burst: 1})
+
+	ok, _, err := l.Allow(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, wait, err := l.Allow(context.Background(), "a")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.True(t, wait > 0)
+
+	ok, _, err = l.Allow(context.Background(), "b")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRedis_Allow(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		return redis.Dial("tcp", server.Addr())
+	}}
+	a := NewRedis(pool, "test:", Limit{Rate: 1, Burst: 2})
+	b := NewRedis(pool, "test:", Limit{Rate: 1, Burst: 2})
+
+	// Both limiters share the same buckets
+	ok, _, err := a.Allow(context.Background(), "x")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _, err = b.Allow(context.Background(), "x")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, wait, err := a.Allow(context.Background(), "x")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.True(t, wait > 0 && wait <= time.Second)
+
+	ok, _, err = b.Allow(context.Background(), "y")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestRedis_AllowOnCluster(t *testing.T) {
+	server := miniredis.RunT(t)
+	cluster := &redisc.Cluster{StartupNodes: []string{server.Addr()}}
+	defer cluster.Close() // nolint: errcheck
+	l := NewRedis(cluster, "test:", Limit{Rate: 1, Burst: 1})
+
+	ok, _, err := l.Allow(context.Background(), "x")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, _, err = l.Allow(context.Background(), "x")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestRedis_AllowCancelled(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) {
+		return redis.Dial("tcp", server.Addr())
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := NewRedis(pool, "test:", Limit{Rate: 1}).Allow(ctx, "x")
+	assert.Error(t, err)
+}
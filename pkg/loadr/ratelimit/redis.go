@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Pool of Redis connections
+type Pool interface {
+	Get() redis.Conn
+}
+
+// takeScript takes a token from the bucket stored at KEYS[1], refilled at ARGV[1] per second up to ARGV[2].
+// It returns whether the token was taken and, if not, how many milliseconds until one is available.
+// The server's clock is shared by every node. Reading it makes the script non-deterministic,
+// so its writes must be replicated as effects rather than by replaying it, as Redis 5 and later do by default.
+var takeScript = redis.NewScript(1, `
+redis.replicate_commands()
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+type redisLimiter struct {
+	pool   Pool
+	prefix string
+	limit  Limit
+}
+
+func (r *redisLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	if r.limit.IsZero() {
+		return true, 0, nil
+	}
+	connection := r.pool.Get()
+	defer connection.Close() // nolint: errcheck
+	// EVALSHA names its key after the script, Cluster connections are bound to it instead
+	if bound, ok := connection.(interface{ Bind(...string) error }); ok {
+		if err := bound.Bind(r.prefix + key); err != nil {
+			return false, 0, fmt.Errorf("error taking rate limit token: %s", err)
+		}
+	}
+
+	result, err := redis.Int64s(take(ctx, connection, r.prefix+key, r.limit.Rate, r.limit.burst()))
+	if err != nil {
+		return false, 0, fmt.Errorf("error taking rate limit token: %s", err)
+	}
+	if len(result) != 2 {
+		return false, 0, fmt.Errorf("unexpected rate limit reply: %v", result)
+	}
+
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// take runs takeScript bound by ctx. Cluster connections can't be, they only check it before.
+func take(ctx context.Context, connection redis.Conn, args ...interface{}) (interface{}, error) {
+	if _, ok := connection.(redis.ConnWithContext); ok {
+		return takeScript.DoContext(ctx, connection, args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return takeScript.Do(connection, args...)
+}
+
+// NewRedis limiter keeping its token buckets in Redis so they are shared by every loadr node.
+// Keys are stored under the given prefix.
+func NewRedis(pool Pool, prefix string, limit Limit) Limiter {
+	return &redisLimiter{
+		pool:   pool,
+		prefix: prefix,
+		limit:  limit,
+	}
+}
@@ -1,33 +1,83 @@
 package loadr
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/Sinea/loadr/pkg/loadr/ratelimit"
 	"gopkg.in/validator.v2"
 )
 
+// initialStateTimeout bounds reading a token's progress for a new subscriber,
+// subscriptions are handled one at a time
+const initialStateTimeout = 5 * time.Second
+
+type tenant struct {
+	limits  TenantLimits
+	updates *ratelimit.Bucket
+	// tokens active and the time of their last update
+	tokens      map[Token]time.Time
+	subscribers int
+	stats       TenantStats
+}
+
+// expire the tokens that went without updates for the idle timeout
+func (t *tenant) expire(now time.Time) {
+	timeout := t.limits.TokenIdleTimeout
+	if timeout <= 0 {
+		timeout = DefaultTokenIdleTimeout
+	}
+	for token, updated := range t.tokens {
+		if now.Sub(updated) >= timeout {
+			delete(t.tokens, token)
+		}
+	}
+}
+
 type service struct {
-	store           Store
-	channel         Channel
-	clients         map[Token][]Client
-	errors          chan error
-	cleanupInterval time.Duration
-	isCleaningUp    bool
-	logger          *log.Logger
+	store     Store
+	channel   Channel
+	clients   map[Token][]Client
+	interests map[Token]int
+	// subscribed tokens of channels routing by token, guarded by subscriptionLock
+	subscribed       map[Token]bool
+	subscriptionLock sync.Mutex
+	tenants          map[Tenant]*tenant
+	lock             sync.Mutex
+	errors           chan error
+	done             chan struct{}
+	stopped          chan struct{}
+	stopOnce         sync.Once
+	cleanupInterval  time.Duration
+	logger           *log.Logger
 }
 
 // Delete delete the progress for a specific token
-func (s *service) Delete(token Token) error {
-	if clients, ok := s.clients[token]; ok {
-		for _, client := range clients {
-			s.closeClient(client)
-		}
+func (s *service) Delete(ctx context.Context, token Token) error {
+	s.lock.Lock()
+	clients := s.clients[token]
+	changed := s.setClients(token, nil)
+	delete(s.tenant(token.Tenant()).tokens, token)
+	s.lock.Unlock()
+
+	if changed {
+		s.syncInterest(token)
+	}
+
+	for _, client := range clients {
+		s.closeClient(client)
 	}
-	s.clients[token] = make([]Client, 0)
-	if err := s.store.Delete(token); err != nil {
-		err := fmt.Errorf("error deleting progress for token '%s' : %s", token, err)
+
+	if err := s.store.Delete(ctx, token); err != nil {
+		err := &Error{
+			Code:    StorageError,
+			Message: fmt.Sprintf("error deleting progress for token '%s' : %s", token, err),
+			Err:     err,
+		}
 		s.logger.Println(err)
 		return err
 	}
@@ -36,21 +86,33 @@ func (s *service) Delete(token Token) error {
 }
 
 // Set update the progress for a token
-func (s *service) Set(token Token, progress *Progress, guarantee uint) error {
+func (s *service) Set(ctx context.Context, token Token, progress *Progress, guarantee uint) error {
 	if err := validator.Validate(progress); err != nil {
-		err := fmt.Errorf("error validating progress: %s", err)
+		err := &Error{Code: ValidationError, Message: fmt.Sprintf("error validating progress: %s", err), Err: err}
+		s.logger.Println(err)
+		return err
+	}
+	if _, err := s.admit(token); err != nil {
 		s.logger.Println(err)
 		return err
 	}
-	if err := s.store.Set(token, progress); err != nil {
-		err := fmt.Errorf("error saving progress: %s", err)
+	if pusher, ok := s.store.(Pusher); ok && guarantee >= Broadcast {
+		if err := pusher.SetAndPush(ctx, MetaProgress{token, *progress}); err != nil {
+			err := &Error{Code: StorageError, Message: fmt.Sprintf("error saving and broadcasting progress: %s", err), Err: err}
+			s.logger.Println(err)
+			return err
+		}
+		return nil
+	}
+	if err := s.store.Set(WithGuarantee(ctx, guarantee), token, progress); err != nil {
+		err := &Error{Code: StorageError, Message: fmt.Sprintf("error saving progress: %s", err), Err: err}
 		s.logger.Println(err)
 		if guarantee >= Storage {
 			return err
 		}
 	}
-	if err := s.channel.Push(MetaProgress{token, *progress}); err != nil {
-		err := fmt.Errorf("error broadcasting progress: %s", err)
+	if err := s.channel.Push(ctx, MetaProgress{token, *progress}); err != nil {
+		err := &Error{Code: BroadcastError, Message: fmt.Sprintf("error broadcasting progress: %s", err), Err: err}
 		s.logger.Println(err)
 		if guarantee >= Broadcast {
 			return err
@@ -59,33 +121,200 @@ func (s *service) Set(token Token, progress *Progress, guarantee uint) error {
 	return nil
 }
 
+// Get the progress of a token and its version, NoVersion when the store doesn't keep versions
+func (s *service) Get(ctx context.Context, token Token) (*Progress, Version, error) {
+	var progress *Progress
+	var version Version
+	var err error
+	if versioned, ok := s.store.(VersionedStore); ok {
+		progress, version, err = versioned.GetVersion(ctx, token)
+	} else {
+		progress, err = s.store.Get(ctx, token)
+	}
+	if err != nil {
+		err := &Error{Code: StorageError, Message: fmt.Sprintf("error reading progress: %s", err), Err: err}
+		if !errors.Is(err, ErrNotFound) {
+			s.logger.Println(err)
+		}
+		return nil, NoVersion, err
+	}
+	return progress, version, nil
+}
+
+// SetIfVersion updates the progress for a token only if it is at version. The
+// progress is always saved before it is broadcast, whatever the guarantee.
+func (s *service) SetIfVersion(ctx context.Context, token Token, progress *Progress, guarantee uint, version Version) (Version, error) {
+	if err := validator.Validate(progress); err != nil {
+		err := &Error{Code: ValidationError, Message: fmt.Sprintf("error validating progress: %s", err), Err: err}
+		s.logger.Println(err)
+		return NoVersion, err
+	}
+	versioned, ok := s.store.(VersionedStore)
+	if !ok {
+		return NoVersion, ErrUnsupported
+	}
+	added, err := s.admit(token)
+	if err != nil {
+		s.logger.Println(err)
+		return NoVersion, err
+	}
+	version, err = versioned.SetIfVersion(ctx, token, progress, version)
+	if err != nil {
+		// Unmet conditions don't make tokens active
+		s.withdraw(token, added)
+		err := &Error{Code: StorageError, Message: fmt.Sprintf("error saving progress: %s", err), Err: err}
+		if !errors.Is(err, ErrConflict) {
+			s.logger.Println(err)
+		}
+		return NoVersion, err
+	}
+	if err := s.channel.Push(ctx, MetaProgress{token, *progress}); err != nil {
+		err := &Error{Code: BroadcastError, Message: fmt.Sprintf("error broadcasting progress: %s", err), Err: err}
+		s.logger.Println(err)
+		if guarantee >= Broadcast {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+// admit an update on a token if its tenant's quotas allow it, reports whether
+// the token became active
+func (s *service) admit(token Token) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	t := s.tenant(token.Tenant())
+	_, active := t.tokens[token]
+	if !active && t.limits.MaxTokens > 0 && len(t.tokens) >= t.limits.MaxTokens {
+		// Idle tokens are only looked for once the quota is reached
+		t.expire(now)
+		if len(t.tokens) >= t.limits.MaxTokens {
+			t.stats.Rejected++
+			return false, &Error{
+				Code:    QuotaExceededError,
+				Message: fmt.Sprintf("tenant '%s' reached its limit of %d active tokens", token.Tenant(), t.limits.MaxTokens),
+			}
+		}
+	}
+	if ok, wait := t.updates.Take(now); !ok {
+		t.stats.Rejected++
+		return false, &Error{
+			Code:    QuotaExceededError,
+			Message: fmt.Sprintf("tenant '%s' exceeded its update rate, retry in %s", token.Tenant(), wait),
+		}
+	}
+	t.tokens[token] = now
+	t.stats.Updates++
+
+	return !active, nil
+}
+
+// withdraw an admitted update that wasn't applied, the token is inactive again
+// if the update made it active. The update rate isn't refunded.
+func (s *service) withdraw(token Token, added bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t := s.tenant(token.Tenant())
+	if added {
+		delete(t.tokens, token)
+	}
+	t.stats.Updates--
+}
+
 // Run the service
 func (s *service) Run(backend BackendListener, clients ClientListener) {
 	// Listen for backend progress information
 	go backend.Run(s)
 
+	// Stores saving in the background report their failures too
+	var storeErrors <-chan error
+	if provider, ok := s.store.(ErrorProvider); ok {
+		storeErrors = provider.Errors()
+	}
+
+	// Stop may be called from another goroutine
+	stopped := make(chan struct{})
+	s.lock.Lock()
+	s.stopped = stopped
+	s.lock.Unlock()
 	go func() {
+		defer close(stopped)
 		ticker := time.NewTicker(s.cleanupInterval)
+		defer ticker.Stop()
 		for {
 			select {
 			case subscription := <-clients.Wait():
 				s.HandleSubscription(subscription)
+			case subscription := <-clients.Disconnected():
+				s.removeClient(subscription)
 			case p := <-s.channel.Progresses():
 				s.HandleProgress(p)
 			case err := <-s.channel.Errors():
-				s.errors <- err
+				s.report(err)
+			case err := <-storeErrors:
+				s.report(err)
 			case <-ticker.C:
-				go s.cleanupClients()
+				s.cleanupClients()
+			case <-s.done:
+				return
 			}
 		}
 	}()
 }
 
-// SetCleanupInterval interval at which to clean up broken clients
+// Stop the service
+func (s *service) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+	s.lock.Lock()
+	stopped := s.stopped
+	s.lock.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+// report an error on Errors() unless the service is stopped
+func (s *service) report(err error) {
+	select {
+	case s.errors <- err:
+	case <-s.done:
+	}
+}
+
+// SetCleanupInterval interval at which to sweep clients that died without being reported
 func (s *service) SetCleanupInterval(duration time.Duration) {
 	s.cleanupInterval = duration
 }
 
+// SetTenantLimits quotas enforced on a tenant
+func (s *service) SetTenantLimits(tenant Tenant, limits TenantLimits) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t := s.tenant(tenant)
+	t.limits = limits
+	t.updates = ratelimit.NewBucket(limits.Updates)
+}
+
+// Stats of a tenant on this node
+func (s *service) Stats(tenant Tenant) TenantStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t := s.tenant(tenant)
+	t.expire(time.Now())
+	stats := t.stats
+	stats.Tokens = len(t.tokens)
+	stats.Subscribers = t.subscribers
+
+	return stats
+}
+
 // Errors produced by the service
 func (s *service) Errors() <-chan error {
 	return s.errors
@@ -93,33 +322,58 @@ func (s *service) Errors() <-chan error {
 
 // Handle an incoming progress
 func (s *service) HandleProgress(progress MetaProgress) {
-	if clients, ok := s.clients[progress.Token]; ok {
-		for _, client := range clients {
-			if err := client.Write(&progress.Progress); err != nil {
-				s.logger.Printf("error writing to client: %s\n", err)
-				s.closeClient(client)
-			}
+	if observer, ok := s.store.(Observer); ok {
+		observer.Observe(progress)
+	}
+
+	// Slow clients don't hold the lock, client slices are only ever replaced or appended to
+	s.lock.Lock()
+	clients := s.clients[progress.Token]
+	s.lock.Unlock()
+
+	var failed []Client
+	for _, client := range clients {
+		if err := client.Write(&progress.Progress); err != nil {
+			s.logger.Printf("error writing to client: %s\n", err)
+			s.closeClient(client)
+			failed = append(failed, client)
+		}
+	}
+	if len(failed) > 0 {
+		s.lock.Lock()
+		changed := s.dropClients(progress.Token, failed...)
+		s.lock.Unlock()
+		if changed {
+			s.syncInterest(progress.Token)
 		}
 	}
 }
 
 // Cleanup client connections
 func (s *service) cleanupClients() {
-	if s.isCleaningUp {
-		return
-	}
-	s.isCleaningUp = true
+	s.lock.Lock()
+	var changed []Token
 	for token, clients := range s.clients {
-		// TODO : Lock
-		s.clients[token] = s.cleanupTokenClients(clients)
+		if s.setClients(token, s.cleanupTokenClients(clients)) {
+			changed = append(changed, token)
+		}
+	}
+	// Tenants without a token quota don't expire their tokens on updates
+	now := time.Now()
+	for _, t := range s.tenants {
+		t.expire(now)
+	}
+	s.lock.Unlock()
+
+	for _, token := range changed {
+		s.syncInterest(token)
 	}
-	s.isCleaningUp = false
 }
 
 func (s *service) cleanupTokenClients(clients []Client) []Client {
-	remaining := make([]Client, 0)
+	remaining := make([]Client, 0, len(clients))
 	for _, c := range clients {
-		if !c.IsAlive() {
+		if c.IsAlive() {
 			remaining = append(remaining, c)
 		} else {
 			s.closeClient(c)
@@ -129,19 +383,163 @@ func (s *service) cleanupTokenClients(clients []Client) []Client {
 	return remaining
 }
 
+// removeClient of a subscription whose connection died
+func (s *service) removeClient(subscription *Subscription) {
+	s.lock.Lock()
+	changed := s.dropClients(subscription.Token, subscription.Client)
+	s.lock.Unlock()
+
+	if changed {
+		s.syncInterest(subscription.Token)
+	}
+}
+
+// dropClients of a token, those already gone are skipped. Reports whether the
+// interest in the token changed, must hold the lock.
+func (s *service) dropClients(token Token, dropped ...Client) bool {
+	clients := s.clients[token]
+	remaining := make([]Client, 0, len(clients))
+	for _, c := range clients {
+		keep := true
+		for _, d := range dropped {
+			keep = keep && c != d
+		}
+		if keep {
+			remaining = append(remaining, c)
+		}
+	}
+	return s.setClients(token, remaining)
+}
+
 func (s *service) HandleSubscription(subscription *Subscription) {
 	token := subscription.Token
 
-	if progress, err := s.store.Get(token); err == nil {
+	s.lock.Lock()
+	t := s.tenant(token.Tenant())
+	if t.limits.MaxSubscribers > 0 && t.subscribers >= t.limits.MaxSubscribers {
+		t.stats.Rejected++
+		s.lock.Unlock()
+		s.logger.Printf("tenant '%s' reached its limit of %d subscribers\n", token.Tenant(), t.limits.MaxSubscribers)
+		s.closeClient(subscription.Client)
+		return
+	}
+	// The slot is taken until the client is added, concurrent subscriptions count it
+	t.subscribers++
+	// Receive the token's progresses before reading its state, so no update falls in between
+	changed := s.interest(token, 1)
+	s.lock.Unlock()
+	if changed {
+		s.syncInterest(token)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), initialStateTimeout)
+	progress, err := s.store.Get(ctx, token)
+	cancel()
+	if err == nil {
 		if err := subscription.Client.Write(progress); err != nil {
 			s.logger.Printf("error writing initial progress state: %s\n", err)
 			s.closeClient(subscription.Client)
+			s.lock.Lock()
+			s.tenant(token.Tenant()).subscribers--
+			changed = s.interest(token, -1)
+			s.lock.Unlock()
+			if changed {
+				s.syncInterest(token)
+			}
+			return
 		}
-	} else {
+	} else if !errors.Is(err, ErrNotFound) {
 		s.logger.Printf("error retrieving initial progress state: %s\n", err)
 	}
 
-	s.clients[token] = append(s.clients[token], subscription.Client)
+	s.lock.Lock()
+	// setClients counts the client in place of the slot
+	s.tenant(token.Tenant()).subscribers--
+	changed = s.setClients(token, append(s.clients[token], subscription.Client))
+	changed = s.interest(token, -1) || changed
+	s.lock.Unlock()
+	if changed {
+		s.syncInterest(token)
+	}
+}
+
+// setClients of a token and keep the tenant's subscriber count in sync. Reports
+// whether the interest in the token changed, must hold the lock.
+func (s *service) setClients(token Token, clients []Client) bool {
+	t := s.tenant(token.Tenant())
+	t.subscribers += len(clients) - len(s.clients[token])
+	changed := s.interest(token, len(clients)-len(s.clients[token]))
+	if len(clients) == 0 {
+		delete(s.clients, token)
+	} else {
+		s.clients[token] = clients
+	}
+	return changed
+}
+
+// interest in a token changed by delta. Reports whether it went from zero to
+// positive or back, syncInterest must then be called once the lock is released.
+// Must hold the lock.
+func (s *service) interest(token Token, delta int) bool {
+	if delta == 0 {
+		return false
+	}
+	before := s.interests[token]
+	after := before + delta
+	if after > 0 {
+		s.interests[token] = after
+	} else {
+		delete(s.interests, token)
+	}
+	return (before > 0) != (after > 0)
+}
+
+// syncInterest subscribes channels routing by token to a token while there is
+// interest in it and unsubscribes them otherwise. Brokers are called without the
+// lock, subscriptionLock keeps the changes of a token in order.
+func (s *service) syncInterest(token Token) {
+	subscriber, ok := s.channel.(TokenSubscriber)
+	if !ok {
+		return
+	}
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+
+	s.lock.Lock()
+	interested := s.interests[token] > 0
+	s.lock.Unlock()
+	if interested == s.subscribed[token] {
+		return
+	}
+
+	if interested {
+		s.subscribed[token] = true
+		if err := subscriber.Subscribe(token); err != nil {
+			s.logger.Printf("error subscribing to token '%s': %s\n", token, err)
+		}
+		return
+	}
+	delete(s.subscribed, token)
+	if err := subscriber.Unsubscribe(token); err != nil {
+		s.logger.Printf("error unsubscribing from token '%s': %s\n", token, err)
+	}
+	// Progresses of the token aren't received anymore to keep a cached one up to date
+	if observer, ok := s.store.(Observer); ok {
+		observer.Forget(token)
+	}
+}
+
+// tenant state, created on first use, must hold the lock
+func (s *service) tenant(name Tenant) *tenant {
+	t, ok := s.tenants[name]
+	if !ok {
+		t = &tenant{
+			updates: ratelimit.NewBucket(ratelimit.Limit{}),
+			tokens:  make(map[Token]time.Time),
+		}
+		s.tenants[name] = t
+	}
+	return t
 }
 
 // closeClient and log the error, if any
@@ -159,6 +557,10 @@ func New(store Store, channel Channel, logger *log.Logger) Service {
 		store:           store,
 		channel:         channel,
 		clients:         make(map[Token][]Client),
+		interests:       make(map[Token]int),
+		subscribed:      make(map[Token]bool),
+		tenants:         make(map[Tenant]*tenant),
 		errors:          make(chan error),
+		done:            make(chan struct{}),
 	}
 }
@@ -2,10 +2,14 @@ package loadr
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"log"
 	"testing"
+	"time"
 )
 
 type mockClient struct {
@@ -14,19 +18,15 @@ type mockClient struct {
 }
 
 func (m *mockClient) Write(p *Progress) error {
-	var e error = nil
-	if m.Called().Error(0) != nil {
-		e = m.Called().Error(0)
-	}
-	return e
+	return m.Called().Error(0)
 }
 
 func (m *mockClient) Close() error {
-	var e error = nil
-	if m.Called().Error(0) != nil {
-		e = m.Called().Error(0)
-	}
-	return e
+	return m.Called().Error(0)
+}
+
+func (m *mockClient) IsAlive() bool {
+	return m.Called().Bool(0)
 }
 
 type mockStore struct {
@@ -34,7 +34,11 @@ type mockStore struct {
 	mock.Mock
 }
 
-func (m *mockStore) Get(t Token) (*Progress, error) {
+func (m *mockStore) Set(ctx context.Context, t Token, p *Progress) error {
+	return m.Called().Error(0)
+}
+
+func (m *mockStore) Get(ctx context.Context, t Token) (*Progress, error) {
 	args := m.Called()
 	var p *Progress = nil
 	var e error = nil
@@ -47,11 +51,27 @@ func (m *mockStore) Get(t Token) (*Progress, error) {
 	return p, e
 }
 
+func (m *mockStore) Delete(ctx context.Context, t Token) error {
+	return m.Called().Error(0)
+}
+
+type mockPushingStore struct {
+	mockStore
+}
+
+func (m *mockPushingStore) SetAndPush(ctx context.Context, p MetaProgress) error {
+	return m.Called().Error(0)
+}
+
 type mockChannel struct {
 	Channel
 	mock.Mock
 }
 
+func (m *mockChannel) Push(ctx context.Context, p MetaProgress) error {
+	return m.Called().Error(0)
+}
+
 func (m *mockChannel) Progresses() <-chan MetaProgress {
 	args := m.Called()
 
@@ -64,6 +84,18 @@ func (m *mockChannel) Errors() <-chan error {
 	return args.Get(0).(chan error)
 }
 
+type mockSubscriberChannel struct {
+	mockChannel
+}
+
+func (m *mockSubscriberChannel) Subscribe(t Token) error {
+	return m.Called(t).Error(0)
+}
+
+func (m *mockSubscriberChannel) Unsubscribe(t Token) error {
+	return m.Called(t).Error(0)
+}
+
 type backendListenerMock struct {
 	BackendListener
 	mock.Mock
@@ -82,6 +114,10 @@ func (m *mockClientsListener) Wait() <-chan *Subscription {
 	return m.Called().Get(0).(chan *Subscription)
 }
 
+func (m *mockClientsListener) Disconnected() <-chan *Subscription {
+	return m.Called().Get(0).(chan *Subscription)
+}
+
 func TestService_HandleSubscription_WithStoreError(t *testing.T) {
 	store := &mockStore{}
 	store.On("Get").Once().Return(nil, errors.New("asd"))
@@ -96,6 +132,8 @@ func TestService_HandleSubscription_WithStoreError(t *testing.T) {
 	s := New(store, channel, testLogger)
 
 	s.HandleSubscription(&Subscription{Token: Token("x")})
+	store.AssertExpectations(t)
+	assert.Contains(t, bb.String(), "asd", "store errors are logged")
 }
 
 func TestService_HandleSubscription_WithoutStoreError(t *testing.T) {
@@ -115,6 +153,8 @@ func TestService_HandleSubscription_WithoutStoreError(t *testing.T) {
 	testLogger := log.New(bb, "", 0)
 	s := New(store, channel, testLogger)
 	s.HandleSubscription(&Subscription{Token: Token("x"), Client: client})
+	store.AssertExpectations(t)
+	client.AssertExpectations(t)
 }
 
 func TestService_HandleSubscription_WithoutStoreErrorAndClientError(t *testing.T) {
@@ -135,6 +175,7 @@ func TestService_HandleSubscription_WithoutStoreErrorAndClientError(t *testing.T
 	testLogger := log.New(bb, "", 0)
 	s := New(store, channel, testLogger)
 	s.HandleSubscription(&Subscription{Token: Token("x"), Client: client})
+	client.AssertCalled(t, "Close")
 }
 
 func TestService_HandleProgress_ClientWriteError(t *testing.T) {
@@ -156,6 +197,7 @@ func TestService_HandleProgress_ClientWriteError(t *testing.T) {
 	s := New(store, channel, testLogger)
 	s.HandleSubscription(&Subscription{Token: Token("x"), Client: client})
 	s.HandleProgress(MetaProgress{Token: Token("x"), Progress: Progress{Stage: "x", Progress: 0}})
+	client.AssertCalled(t, "Close")
 }
 
 func TestService_HandleProgress_ClientWriteSucces(t *testing.T) {
@@ -177,8 +219,389 @@ func TestService_HandleProgress_ClientWriteSucces(t *testing.T) {
 	s := New(store, channel, testLogger)
 	s.HandleSubscription(&Subscription{Token: Token("x"), Client: client})
 	s.HandleProgress(MetaProgress{Token: Token("x"), Progress: Progress{Stage: "x", Progress: 0}})
+	client.AssertNumberOfCalls(t, "Write", 2)
+	client.AssertNotCalled(t, "Close")
+}
+
+func TestService_HandleProgress_SlowClientDoesntHoldTheLock(t *testing.T) {
+	store := &mockStore{}
+	store.On("Get").Return(nil, ErrNotFound)
+	store.On("Delete").Return(nil)
+
+	release := make(chan time.Time)
+	client := &mockClient{}
+	client.On("Write").WaitUntil(release).Return(nil)
+	client.On("Close").Return(nil)
+
+	s := New(store, &mockChannel{}, log.New(new(bytes.Buffer), "", 0))
+	token := Token("x")
+	s.HandleSubscription(&Subscription{Token: token, Client: client})
+
+	written := make(chan struct{})
+	go func() {
+		s.HandleProgress(MetaProgress{Token: token, Progress: Progress{Stage: "x", Progress: 0}})
+		close(written)
+	}()
+
+	// The service keeps serving while the client is written to
+	done := make(chan struct{})
+	go func() {
+		assert.Equal(t, 1, s.Stats(token.Tenant()).Subscribers)
+		assert.NoError(t, s.Delete(context.Background(), token))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the service is blocked by a slow client")
+	}
+	close(release)
+	<-written
+	client.AssertCalled(t, "Close")
+}
+
+func TestService_Set_TenantTokenQuota(t *testing.T) {
+	store := &mockStore{}
+	store.On("Set").Return(nil)
+
+	channel := &mockChannel{}
+	channel.On("Push").Return(nil)
+
+	bb := new(bytes.Buffer)
+	testLogger := log.New(bb, "", 0)
+	s := New(store, channel, testLogger)
+	s.SetTenantLimits("acme", TenantLimits{MaxTokens: 1})
+
+	progress := &Progress{Stage: "x", Progress: 0}
+	assert.NoError(t, s.Set(context.Background(), Tenant("acme").Token("a"), progress, Broadcast))
+	assert.NoError(t, s.Set(context.Background(), Tenant("acme").Token("a"), progress, Broadcast))
+	assert.NoError(t, s.Set(context.Background(), Tenant("other").Token("b"), progress, Broadcast))
+
+	err := s.Set(context.Background(), Tenant("acme").Token("b"), progress, Broadcast)
+	if assert.IsType(t, &Error{}, err) {
+		assert.Equal(t, uint(QuotaExceededError), err.(*Error).Code)
+	}
+
+	stats := s.Stats("acme")
+	assert.Equal(t, 1, stats.Tokens)
+	assert.Equal(t, uint64(2), stats.Updates)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	store.AssertNumberOfCalls(t, "Set", 3)
+	channel.AssertNumberOfCalls(t, "Push", 3)
+}
+
+func TestService_Set_TenantTokensGoIdle(t *testing.T) {
+	store := &mockStore{}
+	store.On("Set").Return(nil)
+
+	channel := &mockChannel{}
+	channel.On("Push").Return(nil)
+
+	s := New(store, channel, log.New(new(bytes.Buffer), "", 0))
+	s.SetTenantLimits("acme", TenantLimits{MaxTokens: 1, TokenIdleTimeout: 50 * time.Millisecond})
+
+	progress := &Progress{Stage: "x", Progress: 0}
+	assert.NoError(t, s.Set(context.Background(), Tenant("acme").Token("a"), progress, Broadcast))
+	assert.Error(t, s.Set(context.Background(), Tenant("acme").Token("b"), progress, Broadcast))
+
+	// a stops counting once idle, b takes its place
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, 0, s.Stats("acme").Tokens)
+	assert.NoError(t, s.Set(context.Background(), Tenant("acme").Token("b"), progress, Broadcast))
+	assert.Equal(t, 1, s.Stats("acme").Tokens)
+}
+
+type mockVersionedStore struct {
+	mockStore
+}
+
+func (m *mockVersionedStore) GetVersion(ctx context.Context, t Token) (*Progress, Version, error) {
+	p, err := m.Get(ctx, t)
+	return p, NoVersion, err
+}
+
+func (m *mockVersionedStore) SetIfVersion(ctx context.Context, t Token, p *Progress, v Version) (Version, error) {
+	args := m.Called()
+	return args.Get(0).(Version), args.Error(1)
+}
+
+func TestService_SetIfVersion_ConflictsDontTakeQuota(t *testing.T) {
+	store := &mockVersionedStore{}
+	store.On("SetIfVersion").Once().Return(NoVersion, ErrConflict)
+	store.On("SetIfVersion").Return(Version(1), nil)
+
+	channel := &mockChannel{}
+	channel.On("Push").Return(nil)
+
+	s := New(store, channel, log.New(new(bytes.Buffer), "", 0))
+	s.SetTenantLimits("acme", TenantLimits{MaxTokens: 1})
+
+	progress := &Progress{Stage: "x", Progress: 0}
+	_, err := s.SetIfVersion(context.Background(), Tenant("acme").Token("a"), progress, Broadcast, AnyVersion)
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Equal(t, TenantStats{}, s.Stats("acme"))
+
+	version, err := s.SetIfVersion(context.Background(), Tenant("acme").Token("b"), progress, Broadcast, NoVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, Version(1), version)
+	assert.Equal(t, TenantStats{Tokens: 1, Updates: 1}, s.Stats("acme"))
+	channel.AssertNumberOfCalls(t, "Push", 1)
+}
+
+func TestToken_Tenant(t *testing.T) {
+	assert.Equal(t, Token("x"), Tenant("").Token("x"))
+	assert.Equal(t, Tenant("acme"), Tenant("acme").Token("x").Tenant())
+	assert.Equal(t, Tenant(""), Token("x").Tenant())
+}
+
+func TestService_CleanupClients(t *testing.T) {
+	store := &mockStore{}
+	store.On("Get").Return(nil, ErrNotFound)
+
+	alive := &mockClient{}
+	alive.On("IsAlive").Return(true)
+	dead := &mockClient{}
+	dead.On("IsAlive").Return(false)
+	dead.On("Close").Return(nil)
+
+	bb := new(bytes.Buffer)
+	testLogger := log.New(bb, "", 0)
+	s := New(store, &mockChannel{}, testLogger).(*service)
+	s.HandleSubscription(&Subscription{Token: Token("x"), Client: alive})
+	s.HandleSubscription(&Subscription{Token: Token("x"), Client: dead})
+
+	s.cleanupClients()
+
+	assert.Equal(t, []Client{alive}, s.clients["x"])
+	assert.Equal(t, 1, s.Stats("").Subscribers)
+	dead.AssertCalled(t, "Close")
+	alive.AssertNotCalled(t, "Close")
+}
+
+func TestService_RemoveClient(t *testing.T) {
+	store := &mockStore{}
+	store.On("Get").Return(nil, ErrNotFound)
+
+	bb := new(bytes.Buffer)
+	testLogger := log.New(bb, "", 0)
+	s := New(store, &mockChannel{}, testLogger).(*service)
+	client := &mockClient{}
+	s.HandleSubscription(&Subscription{Token: Token("x"), Client: client})
+
+	s.removeClient(&Subscription{Token: Token("x"), Client: client})
+
+	assert.NotContains(t, s.clients, Token("x"))
+	assert.Equal(t, 0, s.Stats("").Subscribers)
+}
+
+func TestService_TokenInterest(t *testing.T) {
+	store := &mockStore{}
+	store.On("Get").Return(nil, ErrNotFound)
+	channel := &mockSubscriberChannel{}
+	channel.On("Subscribe", Token("x")).Once().Return(nil)
+	channel.On("Unsubscribe", Token("x")).Once().Return(nil)
+
+	bb := new(bytes.Buffer)
+	testLogger := log.New(bb, "", 0)
+	s := New(store, channel, testLogger).(*service)
+	first, second := &mockClient{}, &mockClient{}
+	s.HandleSubscription(&Subscription{Token: Token("x"), Client: first})
+	s.HandleSubscription(&Subscription{Token: Token("x"), Client: second})
+	channel.AssertNumberOfCalls(t, "Subscribe", 1)
+
+	s.removeClient(&Subscription{Token: Token("x"), Client: first})
+	channel.AssertNotCalled(t, "Unsubscribe", Token("x"))
+
+	s.removeClient(&Subscription{Token: Token("x"), Client: second})
+	channel.AssertExpectations(t)
+	assert.NotContains(t, s.interests, Token("x"))
+}
+
+func TestService_TokenInterest_SlowBroker(t *testing.T) {
+	store := &mockStore{}
+	store.On("Get").Return(nil, ErrNotFound)
+	release := make(chan time.Time)
+	channel := &mockSubscriberChannel{}
+	channel.On("Subscribe", Token("x")).WaitUntil(release).Return(nil)
+
+	s := New(store, channel, log.New(new(bytes.Buffer), "", 0)).(*service)
+	subscribed := make(chan struct{})
+	go func() {
+		s.HandleSubscription(&Subscription{Token: Token("x"), Client: &mockClient{}})
+		close(subscribed)
+	}()
+	assert.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.interests[Token("x")] > 0
+	}, time.Second, time.Millisecond)
+
+	// The broker is called without the service lock
+	done := make(chan struct{})
+	go func() {
+		s.Stats(Token("x").Tenant())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the service is blocked by the broker")
+	}
+	close(release)
+	<-subscribed
+	channel.AssertNumberOfCalls(t, "Subscribe", 1)
+}
+
+func TestService_HandleSubscription_TenantSubscriberQuota(t *testing.T) {
+	release := make(chan time.Time)
+	store := &mockStore{}
+	store.On("Get").WaitUntil(release).Return(nil, ErrNotFound)
+
+	s := New(store, &mockChannel{}, log.New(new(bytes.Buffer), "", 0))
+	s.SetTenantLimits("acme", TenantLimits{MaxSubscribers: 1})
+	first, second := &mockClient{}, &mockClient{}
+	second.On("Close").Return(nil)
+
+	// The first subscription takes the last slot while reading the initial state
+	done := make(chan struct{})
+	go func() {
+		s.HandleSubscription(&Subscription{Token: "acme/x", Client: first})
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return s.Stats("acme").Subscribers == 1 }, time.Second, time.Millisecond)
+	s.HandleSubscription(&Subscription{Token: "acme/y", Client: second})
+	second.AssertCalled(t, "Close")
+
+	close(release)
+	<-done
+	stats := s.Stats("acme")
+	assert.Equal(t, 1, stats.Subscribers)
+	assert.Equal(t, uint64(1), stats.Rejected)
 }
 
 func TestService_Delete(t *testing.T) {
+	store := &mockStore{}
+	store.On("Set").Return(nil)
+	store.On("Delete").Return(nil).Once()
+	store.On("Delete").Return(errors.New("store unavailable"))
+	channel := &mockChannel{}
+	channel.On("Push").Return(nil)
+
+	s := New(store, channel, log.New(new(bytes.Buffer), "", 0))
+	s.SetTenantLimits("acme", TenantLimits{MaxTokens: 1})
+	ctx := context.Background()
+	progress := &Progress{Stage: "x", Progress: 0}
+
+	// Deleting a token withdraws it from its tenant's quota
+	assert.NoError(t, s.Set(ctx, Tenant("acme").Token("a"), progress, Storage))
+	err := s.Set(ctx, Tenant("acme").Token("b"), progress, Storage)
+	assert.ErrorIs(t, err, &Error{Code: QuotaExceededError})
+	assert.NoError(t, s.Delete(ctx, Tenant("acme").Token("a")))
+	assert.Equal(t, 0, s.Stats("acme").Tokens)
+	assert.NoError(t, s.Set(ctx, Tenant("acme").Token("b"), progress, Storage))
+
+	err = s.Delete(ctx, Tenant("acme").Token("b"))
+	assert.ErrorIs(t, err, &Error{Code: StorageError})
+	assert.ErrorContains(t, err, "store unavailable")
+	store.AssertNumberOfCalls(t, "Delete", 2)
+}
+
+func TestService_SetErrors(t *testing.T) {
+	timeout := fmt.Errorf("error writing: %w", context.DeadlineExceeded)
+	store := &mockStore{}
+	store.On("Set").Return(timeout)
+	channel := &mockChannel{}
+	channel.On("Push").Return(errors.New("broker unavailable"))
 
+	bb := new(bytes.Buffer)
+	testLogger := log.New(bb, "", 0)
+	s := New(store, channel, testLogger)
+	ctx := context.Background()
+
+	err := s.Set(ctx, "x", &Progress{Stage: "x", Progress: 2}, Storage)
+	assert.ErrorIs(t, err, &Error{Code: ValidationError})
+
+	err = s.Set(ctx, "x", &Progress{Stage: "x", Progress: 0.5}, Storage)
+	assert.ErrorIs(t, err, &Error{Code: StorageError})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	err = s.Set(ctx, "x", &Progress{Stage: "x", Progress: 0.5}, Broadcast)
+	assert.ErrorIs(t, err, &Error{Code: StorageError})
+
+	store.ExpectedCalls = nil
+	store.On("Set").Return(nil)
+	err = s.Set(ctx, "x", &Progress{Stage: "x", Progress: 0.5}, Broadcast)
+	assert.ErrorIs(t, err, &Error{Code: BroadcastError})
+	assert.NotErrorIs(t, err, ErrNotFound)
+}
+
+func TestService_SetAndPush(t *testing.T) {
+	store := &mockPushingStore{}
+	store.On("Set").Return(nil)
+	store.On("SetAndPush").Return(nil)
+	channel := &mockChannel{}
+	channel.On("Push").Return(nil)
+
+	s := New(store, channel, log.New(new(bytes.Buffer), "", 0))
+	ctx := context.Background()
+
+	// Broadcast progresses are saved and pushed at once
+	assert.NoError(t, s.Set(ctx, "x", &Progress{Stage: "x", Progress: 0.5}, Broadcast))
+	store.AssertNotCalled(t, "Set")
+	channel.AssertNotCalled(t, "Push")
+
+	assert.NoError(t, s.Set(ctx, "x", &Progress{Stage: "x", Progress: 0.5}, Storage))
+	store.AssertNumberOfCalls(t, "Set", 1)
+	channel.AssertNumberOfCalls(t, "Push", 1)
+
+	store.ExpectedCalls = nil
+	store.On("SetAndPush").Return(errors.New("script failed"))
+	err := s.Set(ctx, "x", &Progress{Stage: "x", Progress: 0.5}, Broadcast)
+	assert.ErrorIs(t, err, &Error{Code: StorageError})
+}
+
+func TestService_Stop(t *testing.T) {
+	progresses := make(chan MetaProgress)
+	channel := &mockChannel{}
+	channel.On("Progresses").Return(progresses)
+	channel.On("Errors").Return(make(chan error))
+	clients := &mockClientsListener{}
+	clients.On("Wait").Return(make(chan *Subscription))
+	clients.On("Disconnected").Return(make(chan *Subscription))
+
+	s := New(&mockStore{}, channel, log.New(new(bytes.Buffer), "", 0))
+	s.Run(&backendListenerMock{}, clients)
+	progresses <- MetaProgress{Token: "x"}
+	s.Stop()
+	s.Stop()
+
+	select {
+	case progresses <- MetaProgress{Token: "x"}:
+		t.Error("stopped service still handles progresses")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestService_StopWhileRunning(t *testing.T) {
+	channel := &mockChannel{}
+	channel.On("Progresses").Return(make(chan MetaProgress))
+	channel.On("Errors").Return(make(chan error))
+	clients := &mockClientsListener{}
+	clients.On("Wait").Return(make(chan *Subscription))
+	clients.On("Disconnected").Return(make(chan *Subscription))
+
+	// Stopped from another goroutine, as on a signal, while Run sets up
+	s := New(&mockStore{}, channel, log.New(new(bytes.Buffer), "", 0))
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	s.Run(&backendListenerMock{}, clients)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("service not stopped")
+	}
 }
@@ -0,0 +1,257 @@
+package stores
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt defaults
+const (
+	DefaultBoltPath          = "loadr.db"
+	DefaultBoltBucket        = "progress"
+	DefaultBoltSweepInterval = time.Minute
+	DefaultBoltOpenTimeout   = time.Second
+)
+
+// BoltConfig for a store kept in an embedded bbolt file, for single node deployments
+type BoltConfig struct {
+	// Path of the database file, created when missing
+	Path string
+	// Bucket progresses are stored in
+	Bucket string
+	// TTL after which a progress that wasn't updated expires, 0 keeps progresses forever
+	TTL time.Duration
+	// SweepInterval at which expired progresses are deleted
+	SweepInterval time.Duration
+	// OpenTimeout waiting for the file lock, held by another process using the file
+	OpenTimeout time.Duration
+}
+
+// boltRecord of a progress, keyed by its token
+type boltRecord struct {
+	loadr.Progress
+	Version   loadr.Version `json:"version"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	ExpiresAt *time.Time    `json:"expires_at,omitempty"`
+}
+
+func (r *boltRecord) expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !r.ExpiresAt.After(now)
+}
+
+type boltStore struct {
+	db        *bolt.DB
+	config    BoltConfig
+	bucket    []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *boltStore) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	p, _, err := s.GetVersion(ctx, token)
+	return p, err
+}
+
+func (s *boltStore) GetVersion(ctx context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, loadr.NoVersion, err
+	}
+	var record *boltRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = decodeBoltRecord(tx.Bucket(s.bucket).Get([]byte(token)))
+		return err
+	})
+	if err != nil {
+		return nil, loadr.NoVersion, err
+	}
+	if record == nil || record.expired(time.Now()) {
+		return nil, loadr.NoVersion, loadr.ErrNotFound
+	}
+	return &record.Progress, record.Version, nil
+}
+
+func (s *boltStore) Set(ctx context.Context, token loadr.Token, progress *loadr.Progress) error {
+	_, err := s.set(ctx, token, progress, nil)
+	return err
+}
+
+func (s *boltStore) SetIfVersion(ctx context.Context, token loadr.Token, progress *loadr.Progress, version loadr.Version) (loadr.Version, error) {
+	return s.set(ctx, token, progress, &version)
+}
+
+// set a progress at its next version, only at the given one if any
+func (s *boltStore) set(ctx context.Context, token loadr.Token, progress *loadr.Progress, version *loadr.Version) (loadr.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return loadr.NoVersion, err
+	}
+	now := time.Now().UTC()
+	record := boltRecord{Progress: *progress, UpdatedAt: now}
+	if s.config.TTL > 0 {
+		expiresAt := now.Add(s.config.TTL)
+		record.ExpiresAt = &expiresAt
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		current, err := decodeBoltRecord(bucket.Get([]byte(token)))
+		if err != nil {
+			return err
+		}
+		// Expired progresses are replaced, their versions restart like deleted ones
+		if current != nil && !current.expired(now) {
+			record.Version = current.Version
+		}
+		if version != nil && !version.Matches(record.Version) {
+			return loadr.ErrConflict
+		}
+		record.Version++
+		value, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(token), value)
+	})
+	if err != nil {
+		return loadr.NoVersion, err
+	}
+	return record.Version, nil
+}
+
+func (s *boltStore) Delete(ctx context.Context, token loadr.Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(token))
+	})
+}
+
+// List the progresses whose tokens start with prefix, ordered by token
+func (s *boltStore) List(ctx context.Context, prefix loadr.Token) ([]loadr.MetaProgress, error) {
+	var result []loadr.MetaProgress
+	now := time.Now()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(s.bucket).Cursor()
+		for key, value := cursor.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, value = cursor.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			record, err := decodeBoltRecord(value)
+			if err != nil {
+				return err
+			}
+			if !record.expired(now) {
+				result = append(result, loadr.MetaProgress{Token: loadr.Token(key), Progress: record.Progress})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *boltStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.db.Close()
+}
+
+// sweep expired progresses until the store is closed
+func (s *boltStore) sweep() {
+	ticker := time.NewTicker(s.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			_ = s.deleteExpired(time.Now())
+		}
+	}
+}
+
+// deleteExpired progresses, scanning the whole bucket is cheap at single node sizes
+func (s *boltStore) deleteExpired(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		// Deleting under a cursor makes it skip the next key
+		var expired [][]byte
+		err := bucket.ForEach(func(key, value []byte) error {
+			if record, err := decodeBoltRecord(value); err == nil && record.expired(now) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// decodeBoltRecord stored under a key, nil when there is none
+func decodeBoltRecord(value []byte) (*boltRecord, error) {
+	if value == nil {
+		return nil, nil
+	}
+	record := &boltRecord{}
+	if err := json.Unmarshal(value, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func newBoltStore(config *BoltConfig) (loadr.Store, error) {
+	if strings.TrimSpace(config.Path) == "" {
+		config.Path = DefaultBoltPath
+	}
+	if strings.TrimSpace(config.Bucket) == "" {
+		config.Bucket = DefaultBoltBucket
+	}
+	if config.SweepInterval <= 0 {
+		config.SweepInterval = DefaultBoltSweepInterval
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = DefaultBoltOpenTimeout
+	}
+
+	db, err := bolt.Open(config.Path, 0600, &bolt.Options{Timeout: config.OpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	bucket := []byte(config.Bucket)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	store := &boltStore{
+		db:     db,
+		config: *config,
+		bucket: bucket,
+		done:   make(chan struct{}),
+	}
+	if config.TTL > 0 {
+		go store.sweep()
+	}
+
+	return store, nil
+}
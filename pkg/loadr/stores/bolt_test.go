@@ -0,0 +1,107 @@
+package stores
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStore(t *testing.T) {
+	ctx := context.Background()
+	config := BoltConfig{Path: filepath.Join(t.TempDir(), "loadr.db")}
+	s, err := New(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+
+	progress := &loadr.Progress{Stage: "a", Progress: 0.5}
+	assert.NoError(t, s.Set(ctx, "tenant/x", progress))
+	assert.NoError(t, s.Set(ctx, "tenant/y", progress))
+	assert.NoError(t, s.Set(ctx, "tenants/z", progress))
+
+	list, err := s.(loadr.Lister).List(ctx, "tenant/")
+	assert.NoError(t, err)
+	assert.Equal(t, []loadr.MetaProgress{
+		{Token: "tenant/x", Progress: *progress},
+		{Token: "tenant/y", Progress: *progress},
+	}, list)
+
+	// Progresses survive a restart
+	assert.NoError(t, s.(*boltStore).Close())
+	s, err = New(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.(*boltStore).Close() // nolint: errcheck
+
+	p, err := s.Get(ctx, "tenant/x")
+	assert.NoError(t, err)
+	assert.Equal(t, progress, p)
+
+	assert.NoError(t, s.Delete(ctx, "tenant/x"))
+	_, err = s.Get(ctx, "tenant/x")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+	assert.NoError(t, s.Delete(ctx, "tenant/x"))
+}
+
+func TestBoltStore_TTL(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(BoltConfig{Path: filepath.Join(t.TempDir(), "loadr.db"), TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	store := s.(*boltStore)
+	defer store.Close() // nolint: errcheck
+
+	assert.NoError(t, s.Set(ctx, "x", &loadr.Progress{Stage: "a"}))
+	_, err = s.Get(ctx, "x")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.deleteExpired(time.Now()))
+	_, err = s.Get(ctx, "x")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.deleteExpired(time.Now().Add(time.Hour)))
+	assert.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket(store.bucket).Get([]byte("x")))
+		return nil
+	}))
+}
+
+func TestBoltStore_ExpiredVersions(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(BoltConfig{Path: filepath.Join(t.TempDir(), "loadr.db"), TTL: time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	store := s.(*boltStore)
+	defer store.Close() // nolint: errcheck
+
+	progress := &loadr.Progress{Stage: "a"}
+	assert.NoError(t, s.Set(ctx, "x", progress))
+	assert.NoError(t, s.Set(ctx, "x", progress))
+	time.Sleep(5 * time.Millisecond)
+
+	// The expired record is still there, its version isn't kept
+	version, err := store.SetIfVersion(ctx, "x", progress, loadr.NoVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, loadr.Version(1), version)
+}
+
+func TestBoltStore_CloseTwice(t *testing.T) {
+	s, err := New(BoltConfig{Path: filepath.Join(t.TempDir(), "loadr.db"), TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	store := s.(*boltStore)
+	assert.NoError(t, store.Close())
+	assert.NotPanics(t, func() { _ = store.Close() })
+}
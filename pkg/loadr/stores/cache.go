@@ -0,0 +1,278 @@
+package stores
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+)
+
+// Cache defaults
+const (
+	DefaultCacheSize = 10000
+	DefaultCacheTTL  = time.Minute
+)
+
+// CacheConfig for a bounded LRU cache in front of another store. Cached progresses
+// are updated by the ones the service receives over the channel. Deletes on other
+// nodes aren't, their progresses are served until they expire.
+type CacheConfig struct {
+	// Store config of the cached store
+	Store interface{}
+	// Size in progresses, DefaultCacheSize by default
+	Size int
+	// TTL of a cached progress, DefaultCacheTTL by default
+	TTL time.Duration
+}
+
+// CacheStats of a cache since it was created
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+}
+
+// CacheStatsProvider is implemented by caching stores
+type CacheStatsProvider interface {
+	CacheStats() CacheStats
+}
+
+type cacheEntry struct {
+	token    loadr.Token
+	progress loadr.Progress
+	expires  time.Time
+}
+
+// cacheLoad of a token from the cached store, stale when the token changed meanwhile
+type cacheLoad struct {
+	loads int
+	stale bool
+}
+
+type cache struct {
+	store   loadr.Store
+	config  CacheConfig
+	lock    sync.Mutex
+	entries map[loadr.Token]*list.Element
+	// recent entries first
+	recent  *list.List
+	loading map[loadr.Token]*cacheLoad
+	stats   CacheStats
+	now     func() time.Time
+}
+
+func (c *cache) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	c.lock.Lock()
+	if element, ok := c.entries[token]; ok {
+		entry := element.Value.(*cacheEntry)
+		if c.now().Before(entry.expires) {
+			c.recent.MoveToFront(element)
+			c.stats.Hits++
+			progress := entry.progress
+			c.lock.Unlock()
+			return &progress, nil
+		}
+		c.remove(element)
+	}
+	c.stats.Misses++
+	load, ok := c.loading[token]
+	if !ok {
+		load = &cacheLoad{}
+		c.loading[token] = load
+	}
+	load.loads++
+	c.lock.Unlock()
+
+	progress, err := c.store.Get(ctx, token)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Progresses set or received while loading are newer than the loaded one
+	if err == nil && !load.stale {
+		c.put(token, progress)
+	}
+	if load.loads--; load.loads == 0 {
+		delete(c.loading, token)
+	}
+	return progress, err
+}
+
+// Set the progress in the cached store and drop the cached one, concurrent sets
+// could otherwise leave the cache and the store with different progresses
+func (c *cache) Set(ctx context.Context, token loadr.Token, progress *loadr.Progress) error {
+	err := c.store.Set(ctx, token, progress)
+	c.Forget(token)
+	return err
+}
+
+func (c *cache) Delete(ctx context.Context, token loadr.Token) error {
+	err := c.store.Delete(ctx, token)
+	c.Forget(token)
+	return err
+}
+
+// Observe a progress received over the channel, updating the cached token if any
+func (c *cache) Observe(p loadr.MetaProgress) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if load, ok := c.loading[p.Token]; ok {
+		load.stale = true
+	}
+	if element, ok := c.entries[p.Token]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.progress = p.Progress
+		entry.expires = c.now().Add(c.config.TTL)
+		c.recent.MoveToFront(element)
+	}
+}
+
+// Forget a token, whose progresses aren't received anymore
+func (c *cache) Forget(token loadr.Token) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if load, ok := c.loading[token]; ok {
+		load.stale = true
+	}
+	if element, ok := c.entries[token]; ok {
+		c.remove(element)
+	}
+}
+
+// CacheStats of the cache
+func (c *cache) CacheStats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
+
+// Errors of the cached store, if it reports any
+func (c *cache) Errors() <-chan error {
+	if provider, ok := c.store.(loadr.ErrorProvider); ok {
+		return provider.Errors()
+	}
+	return nil
+}
+
+// Close the cached store, if it can be
+func (c *cache) Close() error {
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// put a progress in the cache, evicting the least recently used one when full, must hold the lock
+func (c *cache) put(token loadr.Token, progress *loadr.Progress) {
+	entry := &cacheEntry{token: token, progress: *progress, expires: c.now().Add(c.config.TTL)}
+	if element, ok := c.entries[token]; ok {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[token] = c.recent.PushFront(entry)
+	if c.recent.Len() > c.config.Size {
+		c.remove(c.recent.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove an entry, must hold the lock
+func (c *cache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).token)
+}
+
+// setAndPush with a pusher and drop the cached progress
+func (c *cache) setAndPush(ctx context.Context, pusher loadr.Pusher, p loadr.MetaProgress) error {
+	err := pusher.SetAndPush(ctx, p)
+	c.Forget(p.Token)
+	return err
+}
+
+// pushingCache caches a store able to save and push progresses at once
+type pushingCache struct {
+	*cache
+	pusher loadr.Pusher
+}
+
+func (c *pushingCache) SetAndPush(ctx context.Context, p loadr.MetaProgress) error {
+	return c.setAndPush(ctx, c.pusher, p)
+}
+
+// versionedCache caches a store keeping versions, which aren't cached
+type versionedCache struct {
+	*cache
+	versioned loadr.VersionedStore
+}
+
+func (c *versionedCache) GetVersion(ctx context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	return c.versioned.GetVersion(ctx, token)
+}
+
+func (c *versionedCache) SetIfVersion(ctx context.Context, token loadr.Token, progress *loadr.Progress, version loadr.Version) (loadr.Version, error) {
+	version, err := c.versioned.SetIfVersion(ctx, token, progress, version)
+	c.Forget(token)
+	return version, err
+}
+
+// versionedPushingCache caches a store keeping versions and able to save and push at once
+type versionedPushingCache struct {
+	*versionedCache
+	pusher loadr.Pusher
+}
+
+func (c *versionedPushingCache) SetAndPush(ctx context.Context, p loadr.MetaProgress) error {
+	return c.setAndPush(ctx, c.pusher, p)
+}
+
+func newCache(config *CacheConfig) (loadr.Store, error) {
+	if _, ok := config.Store.(CacheConfig); ok {
+		return nil, errors.New("a cache can't cache another one")
+	}
+	if config.Size <= 0 {
+		config.Size = DefaultCacheSize
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultCacheTTL
+	}
+
+	store, err := New(config.Store)
+	if err != nil {
+		return nil, err
+	}
+	c := &cache{
+		store:   store,
+		config:  *config,
+		entries: make(map[loadr.Token]*list.Element),
+		recent:  list.New(),
+		loading: make(map[loadr.Token]*cacheLoad),
+		now:     time.Now,
+	}
+	return cacheStore(c), nil
+}
+
+// cacheStore with the optional interfaces of the cached store, no more
+func cacheStore(c *cache) loadr.Store {
+	pusher, pushing := c.store.(loadr.Pusher)
+	versioned, ok := c.store.(loadr.VersionedStore)
+	switch {
+	case ok && pushing:
+		return &versionedPushingCache{versionedCache: &versionedCache{cache: c, versioned: versioned}, pusher: pusher}
+	case ok:
+		return &versionedCache{cache: c, versioned: versioned}
+	case pushing:
+		return &pushingCache{cache: c, pusher: pusher}
+	default:
+		return c
+	}
+}
@@ -0,0 +1,138 @@
+package stores
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	s, err := New(CacheConfig{Size: 2, TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := s.(*versionedCache).cache
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+
+	progress := &loadr.Progress{Stage: "a", Progress: 0.5}
+	assert.NoError(t, s.Set(ctx, "x", progress))
+	assert.NoError(t, c.store.Set(ctx, "y", progress))
+	assert.NoError(t, c.store.Set(ctx, "z", progress))
+
+	for _, token := range []loadr.Token{"x", "x", "y", "x", "z"} {
+		p, err := s.Get(ctx, token)
+		assert.NoError(t, err)
+		assert.Equal(t, progress, p)
+	}
+	// y was the least recently used
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 4, Evictions: 1, Entries: 2}, c.CacheStats())
+
+	// Progresses received over the channel update cached ones only
+	updated := loadr.Progress{Stage: "b", Progress: 1}
+	c.Observe(loadr.MetaProgress{Token: "x", Progress: updated})
+	c.Observe(loadr.MetaProgress{Token: "y", Progress: updated})
+	p, _ := s.Get(ctx, "x")
+	assert.Equal(t, &updated, p)
+	assert.Equal(t, 2, c.CacheStats().Entries)
+
+	// Deletes on other nodes are seen once the progress expires
+	assert.NoError(t, c.store.Delete(ctx, "x"))
+	_, err = s.Get(ctx, "x")
+	assert.NoError(t, err)
+	now = now.Add(time.Minute)
+	_, err = s.Get(ctx, "x")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+
+	c.Forget("z")
+	assert.NoError(t, s.Delete(ctx, "z"))
+	assert.Equal(t, 0, c.CacheStats().Entries)
+}
+
+// blockingStore blocks Get until released
+type blockingStore struct {
+	loadr.Store
+	release chan struct{}
+}
+
+func (s *blockingStore) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	<-s.release
+	return s.Store.Get(ctx, token)
+}
+
+func TestCache_StaleLoad(t *testing.T) {
+	ctx := context.Background()
+	inner, _ := New(nil)
+	old := &loadr.Progress{Stage: "a"}
+	assert.NoError(t, inner.Set(ctx, "x", old))
+	s, _ := New(CacheConfig{})
+	c := s.(*versionedCache).cache
+	blocking := &blockingStore{Store: inner, release: make(chan struct{})}
+	c.store = blocking
+
+	loaded := make(chan *loadr.Progress)
+	go func() {
+		p, _ := s.Get(ctx, "x")
+		loaded <- p
+	}()
+	assert.Eventually(t, func() bool { return c.CacheStats().Misses == 1 }, time.Second, time.Millisecond)
+
+	// A progress received while loading makes the loaded one stale
+	c.Observe(loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "b"}})
+	close(blocking.release)
+	assert.Equal(t, old, <-loaded)
+	assert.Equal(t, 0, c.CacheStats().Entries)
+}
+
+// plainStore hides the optional interfaces of a store
+type plainStore struct {
+	loadr.Store
+}
+
+// pushingStore saves and pushes at once, without versions
+type pushingStore struct {
+	loadr.Store
+}
+
+func (s *pushingStore) SetAndPush(ctx context.Context, p loadr.MetaProgress) error {
+	return s.Set(ctx, p.Token, &p.Progress)
+}
+
+// versionedPushingStore keeps versions and saves and pushes at once
+type versionedPushingStore struct {
+	loadr.Store
+	loadr.VersionedStore
+}
+
+func (s *versionedPushingStore) SetAndPush(ctx context.Context, p loadr.MetaProgress) error {
+	return s.Set(ctx, p.Token, &p.Progress)
+}
+
+func TestCache_OptionalInterfaces(t *testing.T) {
+	inner, _ := newInMemoryStore()
+	for name, test := range map[string]struct {
+		store     loadr.Store
+		versioned bool
+		pusher    bool
+	}{
+		"plain":     {store: &plainStore{inner}},
+		"versioned": {store: inner, versioned: true},
+		"pushing":   {store: &pushingStore{inner}, pusher: true},
+		"both":      {store: &versionedPushingStore{inner, inner.(loadr.VersionedStore)}, versioned: true, pusher: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := cacheStore(&cache{store: test.store})
+			_, versioned := s.(loadr.VersionedStore)
+			_, pusher := s.(loadr.Pusher)
+			assert.Equal(t, test.versioned, versioned, "a cache only keeps versions when the cached store does")
+			assert.Equal(t, test.pusher, pusher)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package stores
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/channels"
+	"github.com/Sinea/loadr/pkg/loadr/storetest"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// factory of stores made from a config
+func factory(config func(t *testing.T) interface{}) storetest.Factory {
+	return func(t *testing.T) loadr.Store {
+		s, err := New(config(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+}
+
+func TestConformance(t *testing.T) {
+	configs := map[string]func(t *testing.T) interface{}{
+		"in memory": func(t *testing.T) interface{} { return nil },
+		"bolt": func(t *testing.T) interface{} {
+			return BoltConfig{Path: filepath.Join(t.TempDir(), "loadr.db")}
+		},
+		"redis": func(t *testing.T) interface{} {
+			return RedisConfig{Connection: channels.RedisConfig{Address: miniredis.RunT(t).Addr()}}
+		},
+		"cache": func(t *testing.T) interface{} {
+			return CacheConfig{Store: BoltConfig{Path: filepath.Join(t.TempDir(), "loadr.db")}}
+		},
+		"write behind": func(t *testing.T) interface{} {
+			return WriteBehindConfig{}
+		},
+	}
+	// Stores of external deployments, e.g. LOADR_TEST_MONGO=mongodb://localhost:27017
+	// and LOADR_TEST_POSTGRES=postgres://postgres@localhost/loadr?sslmode=disable
+	if uri := os.Getenv("LOADR_TEST_MONGO"); uri != "" {
+		configs["mongo"] = func(t *testing.T) interface{} {
+			return MongoConfig{URI: uri, Collection: "test_conformance"}
+		}
+	}
+	if dsn := os.Getenv("LOADR_TEST_POSTGRES"); dsn != "" {
+		configs["postgres"] = func(t *testing.T) interface{} {
+			return PostgresConfig{DSN: dsn, Table: "loadr_test_conformance"}
+		}
+	}
+
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, factory(config))
+		})
+	}
+}
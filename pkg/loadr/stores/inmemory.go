@@ -1,35 +1,79 @@
 package stores
 
 import (
-	"errors"
+	"context"
+	"sync"
 
 	"github.com/Sinea/loadr/pkg/loadr"
 )
 
+type inMemoryEntry struct {
+	progress loadr.Progress
+	version  loadr.Version
+}
+
 type inMemory struct {
-	data map[loadr.Token]*loadr.Progress
+	lock sync.RWMutex
+	data map[loadr.Token]*inMemoryEntry
+}
+
+func (s *inMemory) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	p, _, err := s.GetVersion(ctx, token)
+	return p, err
 }
 
-func (s *inMemory) Get(token loadr.Token) (*loadr.Progress, error) {
-	if p, ok := s.data[token]; ok {
-		return p, nil
+func (s *inMemory) GetVersion(_ context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if e, ok := s.data[token]; ok {
+		p := e.progress
+		return &p, e.version, nil
 	}
 
-	return nil, errors.New("progress not found")
+	return nil, loadr.NoVersion, loadr.ErrNotFound
 }
 
-func (s *inMemory) Set(token loadr.Token, progress *loadr.Progress) error {
-	s.data[token] = progress
+func (s *inMemory) Set(_ context.Context, token loadr.Token, progress *loadr.Progress) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.set(token, progress)
 	return nil
 }
 
-func (s *inMemory) Delete(token loadr.Token) error {
+func (s *inMemory) SetIfVersion(_ context.Context, token loadr.Token, progress *loadr.Progress, version loadr.Version) (loadr.Version, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	current := loadr.NoVersion
+	if e, ok := s.data[token]; ok {
+		current = e.version
+	}
+	if !version.Matches(current) {
+		return loadr.NoVersion, loadr.ErrConflict
+	}
+	return s.set(token, progress), nil
+}
+
+func (s *inMemory) Delete(_ context.Context, token loadr.Token) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	delete(s.data, token)
 	return nil
 }
 
+// set a progress at its next version, must hold the lock
+func (s *inMemory) set(token loadr.Token, progress *loadr.Progress) loadr.Version {
+	e, ok := s.data[token]
+	if !ok {
+		e = &inMemoryEntry{}
+		s.data[token] = e
+	}
+	e.progress = *progress
+	e.version++
+	return e.version
+}
+
 func newInMemoryStore() (loadr.Store, error) {
 	return &inMemory{
-		data: make(map[loadr.Token]*loadr.Progress),
+		data: make(map[loadr.Token]*inMemoryEntry),
 	}, nil
 }
@@ -1,66 +1,275 @@
 package stores
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/Sinea/loadr/pkg/loadr"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDB defaults
+const (
+	DefaultMongoDatabase   = "loadr"
+	DefaultMongoCollection = "progress"
+	DefaultMongoTimeout    = 5 * time.Second
 )
 
 type MongoConfig struct {
+	// URI of the deployment, e.g. mongodb://user:pass@a,b,c/?replicaSet=rs0&tls=true&authSource=admin.
+	// When empty it is built from Address, User and Pass.
+	URI        string
 	Address    string
 	User       string
 	Pass       string
 	Database   string
 	Collection string
+	// Timeout of each call to the deployment
+	Timeout time.Duration
+	// TTL after which a progress that wasn't updated expires, 0 keeps progresses forever
+	TTL time.Duration
+}
+
+// uri to connect to, authenticating against Database like the former mgo store did
+func (c *MongoConfig) uri() string {
+	if strings.TrimSpace(c.URI) != "" {
+		return c.URI
+	}
+	u := url.URL{Scheme: "mongodb", Host: c.Address, Path: "/" + c.Database}
+	if c.User != "" {
+		u.User = url.UserPassword(c.User, c.Pass)
+	}
+	return u.String()
+}
+
+// mongoDocument of a progress, the token is its _id
+type mongoDocument struct {
+	Token     string         `bson:"_id"`
+	Progress  loadr.Progress `bson:"progress"`
+	Version   loadr.Version  `bson:"version"`
+	UpdatedAt time.Time      `bson:"updated_at"`
+	// ExpiresAt drives the TTL index, nil never expires
+	ExpiresAt *time.Time `bson:"expires_at"`
 }
 
 type mongoStore struct {
-	config  MongoConfig
-	session *mgo.Session
+	config     MongoConfig
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+func (m *mongoStore) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	p, _, err := m.GetVersion(ctx, token)
+	return p, err
+}
+
+func (m *mongoStore) GetVersion(ctx context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+
+	document := mongoDocument{}
+	filter := bson.M{"_id": string(token), "$or": m.unexpired()}
+	if err := m.collection.FindOne(ctx, filter).Decode(&document); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, loadr.NoVersion, loadr.ErrNotFound
+		}
+		return nil, loadr.NoVersion, mongoError(err)
+	}
+	return &document.Progress, document.Version, nil
 }
 
-func (m *mongoStore) Get(token loadr.Token) (p *loadr.Progress, err error) {
-	collection := m.session.DB(m.config.Database).C(m.config.Collection)
-	query := collection.FindId(token)
-	meta := loadr.MetaProgress{}
-	err = query.One(&meta)
-	p = &meta.Progress
-	return
+func (m *mongoStore) Set(ctx context.Context, token loadr.Token, progress *loadr.Progress) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+
+	_, err := m.collection.UpdateOne(ctx, bson.M{"_id": string(token)}, m.update(progress), options.Update().SetUpsert(true))
+	return mongoError(err)
 }
 
-func (m *mongoStore) Set(token loadr.Token, progress *loadr.Progress) error {
-	collection := m.session.DB(m.config.Database).C(m.config.Collection)
-	_, err := collection.Upsert(bson.M{"_id": token}, bson.M{"progress": progress})
+// SetIfVersion in a single atomic update, matching the progress only at the version
+func (m *mongoStore) SetIfVersion(ctx context.Context, token loadr.Token, progress *loadr.Progress, version loadr.Version) (loadr.Version, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+
+	filter := bson.M{"_id": string(token)}
+	switch version {
+	case loadr.NoVersion:
+		// Expired progresses are replaced, inserting over a live one fails on the _id index
+		filter["expires_at"] = bson.M{"$lte": time.Now().UTC()}
+	case loadr.AnyVersion:
+		filter["$or"] = m.unexpired()
+	default:
+		filter["$or"] = m.unexpired()
+		filter["version"] = int64(version)
+	}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetUpsert(version == loadr.NoVersion)
 
+	document := mongoDocument{}
+	err := m.collection.FindOneAndUpdate(ctx, filter, m.update(progress), opts).Decode(&document)
+	if errors.Is(err, mongo.ErrNoDocuments) || mongo.IsDuplicateKeyError(err) {
+		return loadr.NoVersion, loadr.ErrConflict
+	}
 	if err != nil {
-		return err
+		return loadr.NoVersion, mongoError(err)
 	}
+	return document.Version, nil
+}
 
-	return nil
+// SetMany progresses in a single bulk write
+func (m *mongoStore) SetMany(ctx context.Context, progresses []loadr.MetaProgress) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+
+	models := make([]mongo.WriteModel, 0, len(progresses))
+	for _, p := range progresses {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": string(p.Token)}).
+			SetUpdate(m.update(&p.Progress)).
+			SetUpsert(true))
+	}
+	_, err := m.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return mongoError(err)
+}
+
+func (m *mongoStore) Delete(ctx context.Context, token loadr.Token) error {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+
+	_, err := m.collection.DeleteOne(ctx, bson.M{"_id": string(token)})
+	return mongoError(err)
+}
+
+// List the progresses whose tokens start with prefix, ordered by token
+func (m *mongoStore) List(ctx context.Context, prefix loadr.Token) ([]loadr.MetaProgress, error) {
+	ctx, cancel := m.context(ctx)
+	defer cancel()
+
+	// An anchored regular expression without options is served by the _id index
+	filter := bson.M{
+		"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(string(prefix))},
+		"$or": m.unexpired(),
+	}
+	cursor, err := m.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	defer cursor.Close(ctx) // nolint: errcheck
+
+	var result []loadr.MetaProgress
+	for cursor.Next(ctx) {
+		document := mongoDocument{}
+		if err := cursor.Decode(&document); err != nil {
+			return nil, mongoError(err)
+		}
+		result = append(result, loadr.MetaProgress{Token: loadr.Token(document.Token), Progress: document.Progress})
+	}
+	return result, mongoError(cursor.Err())
+}
+
+func (m *mongoStore) Close() error {
+	ctx, cancel := m.context(context.Background())
+	defer cancel()
+	return m.client.Disconnect(ctx)
+}
+
+// update saving a progress now at its next version. Expired documents restart
+// at version 1, as if they had been deleted by the TTL index.
+func (m *mongoStore) update(progress *loadr.Progress) mongo.Pipeline {
+	now := time.Now().UTC()
+	var expiresAt *time.Time
+	if m.config.TTL > 0 {
+		at := now.Add(m.config.TTL)
+		expiresAt = &at
+	}
+	expired := bson.M{"$and": bson.A{
+		bson.M{"$ne": bson.A{bson.M{"$ifNull": bson.A{"$expires_at", nil}}, nil}},
+		bson.M{"$lte": bson.A{"$expires_at", now}},
+	}}
+	next := bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", int64(0)}}, int64(1)}}
+	return mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		// Stages starting with $ would be read as field paths
+		"progress":   bson.M{"$literal": *progress},
+		"updated_at": now,
+		"expires_at": expiresAt,
+		"version":    bson.M{"$cond": bson.A{expired, int64(1), next}},
+	}}}}
+}
+
+// unexpired progresses, MongoDB only deletes expired documents once a minute
+func (m *mongoStore) unexpired() bson.A {
+	return bson.A{
+		bson.M{"expires_at": nil},
+		bson.M{"expires_at": bson.M{"$gt": time.Now().UTC()}},
+	}
+}
+
+// context of a call, bounded by the configured timeout
+func (m *mongoStore) context(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, m.config.Timeout)
+}
+
+// mongoError makes timeouts match context.DeadlineExceeded
+func mongoError(err error) error {
+	if err != nil && mongo.IsTimeout(err) && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", context.DeadlineExceeded, err)
+	}
+	return err
 }
 
-func (m *mongoStore) Delete(token loadr.Token) (err error) {
-	collection := m.session.DB(m.config.Database).C(m.config.Collection)
-	return collection.Remove(bson.M{"_id": token})
+// createIndexes creates the TTL index deleting documents once they expire
+func (m *mongoStore) createIndexes() error {
+	ctx, cancel := m.context(context.Background())
+	defer cancel()
+
+	_, err := m.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetName("expires_at_ttl").SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("error creating indexes on %s: %s", m.config.Collection, err)
+	}
+	return nil
 }
 
-func newMongoStore(config *MongoConfig) (store loadr.Store, err error) {
-	address := fmt.Sprintf("mongodb://%s:%s@%s/%s", config.User, config.Pass, config.Address, config.Database)
-	session, err := mgo.Dial(address)
+func newMongoStore(config *MongoConfig) (loadr.Store, error) {
+	if strings.TrimSpace(config.Database) == "" {
+		config.Database = DefaultMongoDatabase
+	}
+	if strings.TrimSpace(config.Collection) == "" {
+		config.Collection = DefaultMongoCollection
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultMongoTimeout
+	}
 
+	store := &mongoStore{config: *config}
+	ctx, cancel := store.context(context.Background())
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(config.uri()).SetTimeout(config.Timeout))
 	if err != nil {
 		return nil, err
 	}
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	store.client = client
+	store.collection = client.Database(config.Database).Collection(config.Collection)
 
-	if err := session.Ping(); err != nil {
-		session.Close()
+	if err := store.createIndexes(); err != nil {
+		_ = client.Disconnect(context.Background())
 		return nil, err
 	}
 
-	return &mongoStore{
-		config:  *config,
-		session: session,
-	}, nil
+	return store, nil
 }
@@ -0,0 +1,44 @@
+package stores
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs against the deployment at LOADR_TEST_MONGO, e.g. mongodb://localhost:27017
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv("LOADR_TEST_MONGO")
+	if uri == "" {
+		t.Skip("LOADR_TEST_MONGO not set")
+	}
+	s, err := New(MongoConfig{URI: uri, Collection: "test_progress", TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.(*mongoStore).Close() // nolint: errcheck
+
+	ctx := context.Background()
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+
+	progress := &loadr.Progress{Stage: "a", Progress: 0.5}
+	assert.NoError(t, s.Set(ctx, "tenant/x", progress))
+	p, err := s.Get(ctx, "tenant/x")
+	assert.NoError(t, err)
+	assert.Equal(t, progress, p)
+
+	list, err := s.(loadr.Lister).List(ctx, "tenant/")
+	assert.NoError(t, err)
+	assert.Equal(t, []loadr.MetaProgress{{Token: "tenant/x", Progress: *progress}}, list)
+
+	assert.NoError(t, s.Delete(ctx, "tenant/x"))
+	_, err = s.Get(ctx, "tenant/x")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+	assert.NoError(t, s.Delete(ctx, "tenant/x"))
+
+}
@@ -0,0 +1,240 @@
+package stores
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/lib/pq"
+)
+
+// PostgreSQL defaults
+const (
+	DefaultPostgresTable         = "loadr_progress"
+	DefaultPostgresSweepInterval = time.Minute
+)
+
+// PostgresConfig for a store backed by a PostgreSQL table
+type PostgresConfig struct {
+	// DSN connection string, as understood by lib/pq
+	DSN string
+	// Table progresses are stored in, created when missing
+	Table string
+	// TTL after which a progress that wasn't updated expires, 0 keeps progresses forever
+	TTL time.Duration
+	// SweepInterval at which expired progresses are deleted
+	SweepInterval time.Duration
+}
+
+type postgresStore struct {
+	db        *sql.DB
+	config    PostgresConfig
+	table     string
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *postgresStore) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	p, _, err := s.GetVersion(ctx, token)
+	return p, err
+}
+
+func (s *postgresStore) GetVersion(ctx context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	p := &loadr.Progress{}
+	var version int64
+	row := s.db.QueryRowContext(ctx, `SELECT stage, progress, version FROM `+s.table+`
+		WHERE token = $1 AND (expires_at IS NULL OR expires_at > now())`, string(token))
+	if err := row.Scan(&p.Stage, &p.Progress, &version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, loadr.NoVersion, loadr.ErrNotFound
+		}
+		return nil, loadr.NoVersion, err
+	}
+	return p, loadr.Version(version), nil
+}
+
+func (s *postgresStore) Set(ctx context.Context, token loadr.Token, progress *loadr.Progress) error {
+	_, err := s.db.ExecContext(ctx, s.upsert(""), string(token), progress.Stage, progress.Progress, s.expiresAt())
+	return err
+}
+
+// SetIfVersion in a single statement, matching the progress only at the version
+func (s *postgresStore) SetIfVersion(ctx context.Context, token loadr.Token, progress *loadr.Progress, version loadr.Version) (loadr.Version, error) {
+	var row *sql.Row
+	switch version {
+	case loadr.NoVersion:
+		// Expired progresses are replaced
+		row = s.db.QueryRowContext(ctx, s.upsert(`WHERE `+s.table+`.expires_at <= now()`),
+			string(token), progress.Stage, progress.Progress, s.expiresAt())
+	case loadr.AnyVersion:
+		row = s.db.QueryRowContext(ctx, s.update(""),
+			string(token), progress.Stage, progress.Progress, s.expiresAt())
+	default:
+		row = s.db.QueryRowContext(ctx, s.update(`AND version = $5`),
+			string(token), progress.Stage, progress.Progress, s.expiresAt(), int64(version))
+	}
+
+	var updated int64
+	if err := row.Scan(&updated); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return loadr.NoVersion, loadr.ErrConflict
+		}
+		return loadr.NoVersion, err
+	}
+	return loadr.Version(updated), nil
+}
+
+// upsert statement saving a progress at its next version, conflicting rows are
+// only updated when they match condition. Expired rows restart at version 1,
+// as if they had been swept.
+func (s *postgresStore) upsert(condition string) string {
+	return `INSERT INTO ` + s.table + ` (token, stage, progress, updated_at, expires_at, version)
+		VALUES ($1, $2, $3, now(), $4, 1)
+		ON CONFLICT (token) DO UPDATE SET
+			stage = EXCLUDED.stage,
+			progress = EXCLUDED.progress,
+			updated_at = EXCLUDED.updated_at,
+			expires_at = EXCLUDED.expires_at,
+			version = CASE WHEN ` + s.table + `.expires_at <= now() THEN 1 ELSE ` + s.table + `.version + 1 END
+		` + condition + `
+		RETURNING version`
+}
+
+// update statement saving an existing progress at its next version, only when it matches condition
+func (s *postgresStore) update(condition string) string {
+	return `UPDATE ` + s.table + ` SET
+			stage = $2,
+			progress = $3,
+			updated_at = now(),
+			expires_at = $4,
+			version = version + 1
+		WHERE token = $1 AND (expires_at IS NULL OR expires_at > now()) ` + condition + `
+		RETURNING version`
+}
+
+func (s *postgresStore) Delete(ctx context.Context, token loadr.Token) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM `+s.table+` WHERE token = $1`, string(token))
+	return err
+}
+
+// List the progresses whose tokens start with prefix, ordered by token
+func (s *postgresStore) List(ctx context.Context, prefix loadr.Token) ([]loadr.MetaProgress, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT token, stage, progress FROM `+s.table+`
+		WHERE token LIKE $1 AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY token`, likePrefix(string(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var result []loadr.MetaProgress
+	for rows.Next() {
+		var token string
+		p := loadr.MetaProgress{}
+		if err := rows.Scan(&token, &p.Progress.Stage, &p.Progress.Progress); err != nil {
+			return nil, err
+		}
+		p.Token = loadr.Token(token)
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func (s *postgresStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return s.db.Close()
+}
+
+func (s *postgresStore) expiresAt() interface{} {
+	if s.config.TTL <= 0 {
+		return nil
+	}
+	return time.Now().Add(s.config.TTL)
+}
+
+// migrate creates the table and its indexes when missing. The text_pattern_ops
+// index serves prefix listing whatever the database collation is.
+func (s *postgresStore) migrate() error {
+	name := strings.Trim(s.table, `"`)
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.table + ` (
+			token      text PRIMARY KEY,
+			stage      text NOT NULL,
+			progress   real NOT NULL,
+			updated_at timestamptz NOT NULL DEFAULT now(),
+			expires_at timestamptz,
+			version    bigint NOT NULL DEFAULT 1
+		)`,
+		`ALTER TABLE ` + s.table + ` ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1`,
+		`CREATE INDEX IF NOT EXISTS ` + pq.QuoteIdentifier(name+"_prefix") + ` ON ` + s.table + ` (token text_pattern_ops)`,
+		`CREATE INDEX IF NOT EXISTS ` + pq.QuoteIdentifier(name+"_expires_at") + ` ON ` + s.table + ` (expires_at)
+			WHERE expires_at IS NOT NULL`,
+	}
+	for _, statement := range statements {
+		if _, err := s.db.Exec(statement); err != nil {
+			return fmt.Errorf("error migrating table %s: %s", s.table, err)
+		}
+	}
+	return nil
+}
+
+// sweep expired progresses until the store is closed
+func (s *postgresStore) sweep() {
+	ticker := time.NewTicker(s.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			_, _ = s.db.Exec(`DELETE FROM ` + s.table + ` WHERE expires_at <= now()`)
+		}
+	}
+}
+
+// likePrefix builds a LIKE pattern matching strings that start with prefix
+func likePrefix(prefix string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(prefix) + "%"
+}
+
+func newPostgresStore(config *PostgresConfig) (loadr.Store, error) {
+	if strings.TrimSpace(config.Table) == "" {
+		config.Table = DefaultPostgresTable
+	}
+	if config.SweepInterval <= 0 {
+		config.SweepInterval = DefaultPostgresSweepInterval
+	}
+
+	db, err := sql.Open("postgres", config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	store := &postgresStore{
+		db:     db,
+		config: *config,
+		table:  pq.QuoteIdentifier(config.Table),
+		done:   make(chan struct{}),
+	}
+	if err := store.migrate(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if config.TTL > 0 {
+		go store.sweep()
+	}
+
+	return store, nil
+}
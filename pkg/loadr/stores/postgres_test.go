@@ -0,0 +1,252 @@
+package stores
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStatement run against a fakeDriver
+type fakeStatement struct {
+	query string
+	args  []driver.Value
+}
+
+// fakeReply to the next statement: the rows it returns, or its error
+type fakeReply struct {
+	rows [][]driver.Value
+	err  error
+}
+
+// fakeDriver records the statements it runs and answers them with scripted
+// replies, statements without a reply return no rows
+type fakeDriver struct {
+	lock       sync.Mutex
+	statements []fakeStatement
+	replies    []fakeReply
+}
+
+func (d *fakeDriver) reply(rows ...[]driver.Value) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.replies = append(d.replies, fakeReply{rows: rows})
+}
+
+func (d *fakeDriver) fail(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.replies = append(d.replies, fakeReply{err: err})
+}
+
+// last statement run
+func (d *fakeDriver) last() fakeStatement {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(d.statements) == 0 {
+		return fakeStatement{}
+	}
+	return d.statements[len(d.statements)-1]
+}
+
+func (d *fakeDriver) run(query string, args []driver.NamedValue) fakeReply {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	values := make([]driver.Value, 0, len(args))
+	for _, arg := range args {
+		values = append(values, arg.Value)
+	}
+	d.statements = append(d.statements, fakeStatement{query: query, args: values})
+	if len(d.replies) == 0 {
+		return fakeReply{}
+	}
+	reply := d.replies[0]
+	d.replies = d.replies[1:]
+	return reply
+}
+
+func (d *fakeDriver) Connect(context.Context) (driver.Conn, error) { return &fakeConn{d}, nil }
+func (d *fakeDriver) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	reply := c.driver.run(query, args)
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	return &fakeRows{rows: reply.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	reply := c.driver.run(query, args)
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	return driver.RowsAffected(len(reply.rows)), nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newFakePostgresStore(config PostgresConfig) (*postgresStore, *fakeDriver) {
+	d := &fakeDriver{}
+	return &postgresStore{
+		db:     sql.OpenDB(d),
+		config: config,
+		table:  pq.QuoteIdentifier(config.Table),
+		done:   make(chan struct{}),
+	}, d
+}
+
+func TestPostgresStore_Get(t *testing.T) {
+	ctx := context.Background()
+	s, d := newFakePostgresStore(PostgresConfig{Table: "progress"})
+	defer s.Close() // nolint: errcheck
+
+	_, err := s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+	assert.Contains(t, d.last().query, `FROM "progress"`)
+	assert.Contains(t, d.last().query, "expires_at IS NULL OR expires_at > now()", "expired progresses are missing")
+	assert.Equal(t, []driver.Value{"missing"}, d.last().args)
+
+	d.reply([]driver.Value{"a", 0.5, int64(3)})
+	p, version, err := s.GetVersion(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, &loadr.Progress{Stage: "a", Progress: 0.5}, p)
+	assert.Equal(t, loadr.Version(3), version)
+
+	failure := errors.New("connection refused")
+	d.fail(failure)
+	_, err = s.Get(ctx, "x")
+	assert.ErrorIs(t, err, failure)
+}
+
+func TestPostgresStore_Set(t *testing.T) {
+	ctx := context.Background()
+	s, d := newFakePostgresStore(PostgresConfig{Table: `odd"table`})
+	defer s.Close() // nolint: errcheck
+
+	assert.NoError(t, s.Set(ctx, "x", &loadr.Progress{Stage: "a", Progress: 0.5}))
+	statement := d.last()
+	assert.Contains(t, statement.query, `INSERT INTO "odd""table"`, "the table name is quoted")
+	assert.Contains(t, statement.query, "ON CONFLICT (token) DO UPDATE")
+	assert.Contains(t, statement.query, `version = CASE WHEN "odd""table".expires_at <= now() THEN 1 ELSE "odd""table".version + 1 END`,
+		"expired rows restart at version 1")
+	assert.Equal(t, []driver.Value{"x", "a", 0.5, nil}, statement.args, "progresses don't expire without a TTL")
+}
+
+func TestPostgresStore_TTL(t *testing.T) {
+	ctx := context.Background()
+	s, d := newFakePostgresStore(PostgresConfig{Table: "progress", TTL: time.Hour})
+	defer s.Close() // nolint: errcheck
+
+	before := time.Now()
+	assert.NoError(t, s.Set(ctx, "x", &loadr.Progress{Stage: "a", Progress: 0.5}))
+	args := d.last().args
+	if assert.Len(t, args, 4) && assert.IsType(t, time.Time{}, args[3]) {
+		expires := args[3].(time.Time)
+		assert.False(t, expires.Before(before.Add(time.Hour)))
+		assert.False(t, expires.After(time.Now().Add(time.Hour)))
+	}
+}
+
+func TestPostgresStore_SetIfVersion(t *testing.T) {
+	ctx := context.Background()
+	s, d := newFakePostgresStore(PostgresConfig{Table: "progress"})
+	defer s.Close() // nolint: errcheck
+	progress := &loadr.Progress{Stage: "a", Progress: 0.5}
+
+	// Creating conflicts with a live progress, expired ones are replaced
+	_, err := s.SetIfVersion(ctx, "x", progress, loadr.NoVersion)
+	assert.ErrorIs(t, err, loadr.ErrConflict)
+	assert.Contains(t, d.last().query, "INSERT INTO")
+	assert.Contains(t, d.last().query, `WHERE "progress".expires_at <= now()`)
+
+	d.reply([]driver.Value{int64(1)})
+	version, err := s.SetIfVersion(ctx, "x", progress, loadr.NoVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, loadr.Version(1), version)
+
+	// Updating any version only matches live progresses
+	d.reply([]driver.Value{int64(2)})
+	version, err = s.SetIfVersion(ctx, "x", progress, loadr.AnyVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, loadr.Version(2), version)
+	assert.True(t, strings.HasPrefix(d.last().query, `UPDATE "progress"`))
+	assert.NotContains(t, d.last().query, "version = $5")
+	assert.Len(t, d.last().args, 4)
+
+	// Updating a version matches it
+	_, err = s.SetIfVersion(ctx, "x", progress, 1)
+	assert.ErrorIs(t, err, loadr.ErrConflict)
+	assert.Contains(t, d.last().query, "AND version = $5")
+	assert.Equal(t, int64(1), d.last().args[4])
+
+	d.reply([]driver.Value{int64(3)})
+	version, err = s.SetIfVersion(ctx, "x", progress, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, loadr.Version(3), version)
+}
+
+func TestPostgresStore_List(t *testing.T) {
+	ctx := context.Background()
+	s, d := newFakePostgresStore(PostgresConfig{Table: "progress"})
+	defer s.Close() // nolint: errcheck
+
+	d.reply([]driver.Value{"a_%/x", "a", 0.5}, []driver.Value{"a_%/y", "b", 1.0})
+	list, err := s.List(ctx, "a_%/")
+	assert.NoError(t, err)
+	assert.Equal(t, []loadr.MetaProgress{
+		{Token: "a_%/x", Progress: loadr.Progress{Stage: "a", Progress: 0.5}},
+		{Token: "a_%/y", Progress: loadr.Progress{Stage: "b", Progress: 1}},
+	}, list)
+	assert.Contains(t, d.last().query, "ORDER BY token")
+	assert.Equal(t, []driver.Value{`a\_\%/%`}, d.last().args, "wildcards in the prefix are escaped")
+}
+
+func TestPostgresStore_Sweep(t *testing.T) {
+	s, d := newFakePostgresStore(PostgresConfig{Table: "progress", TTL: time.Hour, SweepInterval: time.Millisecond})
+	go s.sweep()
+	assert.Eventually(t, func() bool {
+		return d.last().query == `DELETE FROM "progress" WHERE expires_at <= now()`
+	}, time.Second, time.Millisecond)
+
+	// Closing twice doesn't stop the sweep twice
+	assert.NoError(t, s.Close())
+	assert.NotPanics(t, func() { _ = s.Close() })
+}
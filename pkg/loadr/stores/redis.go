@@ -0,0 +1,295 @@
+package stores
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/channels"
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultRedisPrefix of the keys progresses are stored under
+const DefaultRedisPrefix = "loadr:progress:"
+
+// redisScanCount hints how many keys SCAN visits at once
+const redisScanCount = 500
+
+// RedisPool of connections to the Redis deployment, e.g. channels.RedisPool of the Redis channel
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// redisNodes is implemented by pools reaching several masters, as a Cluster's
+type redisNodes interface {
+	EachNode(func(redis.Conn) error) error
+}
+
+// RedisPublisher publishes progresses as a Redis channel does, see channels.RedisPublisher
+type RedisPublisher interface {
+	Publication(context.Context, loadr.MetaProgress) (command string, topic string, message []byte, err error)
+	Published(loadr.MetaProgress)
+}
+
+// RedisConfig for a store keeping every progress in a Redis hash
+type RedisConfig struct {
+	// Connection to the Redis deployment, with its authentication, TLS and pool
+	// settings, only used without Pool
+	Connection channels.RedisConfig
+	// Pool of connections, shared with the Redis channel to use its deployment
+	Pool RedisPool
+	// Prefix of the keys, DefaultRedisPrefix by default
+	Prefix string
+	// TTL after which a progress that wasn't updated expires, 0 keeps progresses forever
+	TTL time.Duration
+	// Publisher of the Redis channel, if any. Progresses set with the Broadcast
+	// guarantee are then saved and published by a single script.
+	Publisher RedisPublisher
+}
+
+// setScript saves the progress at KEYS[1] at its next version, returned, with a TTL of
+// ARGV[3] milliseconds, 0 for none. ARGV[4] is the condition, "create", "update" or
+// the version the progress must be at, empty for none. Unmet conditions return 0.
+// When given, it publishes ARGV[7] on ARGV[6] with the ARGV[5] command.
+var setScript = redis.NewScript(1, `
+local exists = redis.call('EXISTS', KEYS[1]) == 1
+local condition = ARGV[4]
+if condition == 'create' then
+	if exists then return 0 end
+elseif condition == 'update' then
+	if not exists then return 0 end
+elseif condition ~= '' then
+	local current = tonumber(redis.call('HGET', KEYS[1], 'version') or 0)
+	if not exists or current ~= tonumber(condition) then return 0 end
+end
+redis.call('HSET', KEYS[1], 'stage', ARGV[1], 'progress', ARGV[2])
+local version = redis.call('HINCRBY', KEYS[1], 'version', 1)
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+if ARGV[5] then
+	redis.call(ARGV[5], ARGV[6], ARGV[7])
+end
+return version
+`)
+
+type redisStore struct {
+	pool   RedisPool
+	config RedisConfig
+	// owned connections are closed with the store
+	owned channels.RedisConnections
+}
+
+func (s *redisStore) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	p, _, err := s.GetVersion(ctx, token)
+	return p, err
+}
+
+func (s *redisStore) GetVersion(ctx context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	connection := s.pool.Get()
+	defer connection.Close() // nolint: errcheck
+
+	values, err := redis.StringMap(redisDo(ctx, connection, "HGETALL", s.key(token)))
+	if err != nil {
+		return nil, loadr.NoVersion, err
+	}
+	p, version, ok := redisProgress(values)
+	if !ok {
+		return nil, loadr.NoVersion, loadr.ErrNotFound
+	}
+	return p, version, nil
+}
+
+func (s *redisStore) Set(ctx context.Context, token loadr.Token, progress *loadr.Progress) error {
+	_, err := s.set(ctx, token, progress, "")
+	return err
+}
+
+func (s *redisStore) SetIfVersion(ctx context.Context, token loadr.Token, progress *loadr.Progress, version loadr.Version) (loadr.Version, error) {
+	condition := strconv.FormatUint(uint64(version), 10)
+	switch version {
+	case loadr.NoVersion:
+		condition = "create"
+	case loadr.AnyVersion:
+		condition = "update"
+	}
+	return s.set(ctx, token, progress, condition)
+}
+
+func (s *redisStore) Delete(ctx context.Context, token loadr.Token) error {
+	connection := s.pool.Get()
+	defer connection.Close() // nolint: errcheck
+
+	_, err := redisDo(ctx, connection, "DEL", s.key(token))
+	return err
+}
+
+// List the progresses whose tokens start with prefix, ordered by token. Keys
+// are scanned on every master of a Cluster.
+func (s *redisStore) List(ctx context.Context, prefix loadr.Token) ([]loadr.MetaProgress, error) {
+	var keys []string
+	scan := func(connection redis.Conn) error {
+		cursor := "0"
+		for {
+			reply, err := redis.Values(redisDo(ctx, connection, "SCAN", cursor,
+				"MATCH", globEscape(s.key(prefix))+"*", "COUNT", redisScanCount))
+			if err != nil {
+				return err
+			}
+			var batch []string
+			if _, err := redis.Scan(reply, &cursor, &batch); err != nil {
+				return err
+			}
+			keys = append(keys, batch...)
+			if cursor == "0" {
+				return nil
+			}
+		}
+	}
+
+	var err error
+	if nodes, ok := s.pool.(redisNodes); ok {
+		err = nodes.EachNode(scan)
+	} else {
+		connection := s.pool.Get()
+		err = scan(connection)
+		_ = connection.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	result := make([]loadr.MetaProgress, 0, len(keys))
+	for _, key := range keys {
+		token := loadr.Token(strings.TrimPrefix(key, s.config.Prefix))
+		// Progresses expiring meanwhile are skipped
+		p, err := s.Get(ctx, token)
+		if err == loadr.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, loadr.MetaProgress{Token: token, Progress: *p})
+	}
+	return result, nil
+}
+
+func (s *redisStore) Close() error {
+	if s.owned != nil {
+		return s.owned.Close()
+	}
+	return nil
+}
+
+// set a progress if it meets the condition, publishing it in the same script when publication is given
+func (s *redisStore) set(ctx context.Context, token loadr.Token, progress *loadr.Progress, condition string, publication ...interface{}) (loadr.Version, error) {
+	connection := s.pool.Get()
+	defer connection.Close() // nolint: errcheck
+
+	key := s.key(token)
+	// EVALSHA names its key after the script, Cluster connections are bound to it instead
+	if bound, ok := connection.(interface{ Bind(...string) error }); ok {
+		if err := bound.Bind(key); err != nil {
+			return loadr.NoVersion, err
+		}
+	}
+
+	args := append([]interface{}{
+		key,
+		progress.Stage,
+		strconv.FormatFloat(float64(progress.Progress), 'f', -1, 32),
+		s.config.TTL.Milliseconds(),
+		condition,
+	}, publication...)
+	var reply interface{}
+	var err error
+	if _, ok := connection.(redis.ConnWithContext); ok {
+		reply, err = setScript.DoContext(ctx, connection, args...)
+	} else {
+		reply, err = setScript.Do(connection, args...)
+	}
+	version, err := redis.Uint64(reply, err)
+	if err != nil {
+		return loadr.NoVersion, err
+	}
+	if version == 0 {
+		return loadr.NoVersion, loadr.ErrConflict
+	}
+	return loadr.Version(version), nil
+}
+
+func (s *redisStore) key(token loadr.Token) string {
+	return s.config.Prefix + string(token)
+}
+
+// redisPushingStore publishes progresses set with the Broadcast guarantee as it saves them
+type redisPushingStore struct {
+	*redisStore
+}
+
+// SetAndPush saves and publishes a progress in a single round trip
+func (s *redisPushingStore) SetAndPush(ctx context.Context, p loadr.MetaProgress) error {
+	command, topic, message, err := s.config.Publisher.Publication(ctx, p)
+	if err != nil {
+		return err
+	}
+	if _, err := s.set(ctx, p.Token, &p.Progress, "", command, topic, message); err != nil {
+		return err
+	}
+	s.config.Publisher.Published(p)
+	return nil
+}
+
+// redisDo runs a command bound by ctx. Cluster connections only take a timeout.
+func redisDo(ctx context.Context, connection redis.Conn, command string, args ...interface{}) (interface{}, error) {
+	if _, ok := connection.(redis.ConnWithContext); ok {
+		return redis.DoContext(connection, ctx, command, args...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(connection, time.Until(deadline), command, args...)
+	}
+	return connection.Do(command, args...)
+}
+
+// redisProgress of a hash and its version, false when the hash doesn't exist
+func redisProgress(values map[string]string) (*loadr.Progress, loadr.Version, bool) {
+	stage, ok := values["stage"]
+	if !ok {
+		return nil, loadr.NoVersion, false
+	}
+	progress, _ := strconv.ParseFloat(values["progress"], 32)
+	version, _ := strconv.ParseUint(values["version"], 10, 64)
+	return &loadr.Progress{Stage: stage, Progress: float32(progress)}, loadr.Version(version), true
+}
+
+// globEscape escapes the characters SCAN MATCH patterns give a meaning to
+func globEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+func newRedisStore(config *RedisConfig) (loadr.Store, error) {
+	if config.Prefix == "" {
+		config.Prefix = DefaultRedisPrefix
+	}
+
+	store := &redisStore{config: *config, pool: config.Pool}
+	if store.pool == nil {
+		store.owned = channels.NewRedisConnections(config.Connection)
+		store.pool = store.owned
+	}
+
+	if config.Publisher != nil {
+		return &redisPushingStore{store}, nil
+	}
+	return store, nil
+}
@@ -0,0 +1,112 @@
+package stores
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/Sinea/loadr/pkg/loadr/channels"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	s, err := New(RedisConfig{Connection: channels.RedisConfig{Address: server.Addr()}, TTL: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.(*redisStore).Close() // nolint: errcheck
+
+	_, err = s.Get(ctx, "missing")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+
+	progress := &loadr.Progress{Stage: "a", Progress: 0.5}
+	assert.NoError(t, s.Set(ctx, "tenant/x", progress))
+	assert.NoError(t, s.Set(ctx, "tenant/y", progress))
+	assert.NoError(t, s.Set(ctx, "tenants/z", progress))
+	// Glob characters in tokens match literally
+	assert.NoError(t, s.Set(ctx, "tenant*/w", progress))
+
+	p, err := s.Get(ctx, "tenant/x")
+	assert.NoError(t, err)
+	assert.Equal(t, progress, p)
+	assert.Equal(t, time.Minute, server.TTL(DefaultRedisPrefix+"tenant/x"))
+
+	list, err := s.(loadr.Lister).List(ctx, "tenant/")
+	assert.NoError(t, err)
+	assert.Equal(t, []loadr.MetaProgress{
+		{Token: "tenant/x", Progress: *progress},
+		{Token: "tenant/y", Progress: *progress},
+	}, list)
+
+	assert.NoError(t, s.Delete(ctx, "tenant/x"))
+	_, err = s.Get(ctx, "tenant/x")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+	assert.NoError(t, s.Delete(ctx, "tenant/x"))
+
+	// Progresses expire natively
+	server.FastForward(time.Minute)
+	_, err = s.Get(ctx, "tenant/y")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+}
+
+func TestRedisStore_Connection(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	server.RequireUserAuth("loadr", "secret")
+	s, err := New(RedisConfig{Connection: channels.RedisConfig{
+		Address:  server.Addr(),
+		Username: "loadr",
+		Password: "secret",
+		Database: 2,
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.(*redisStore).Close() // nolint: errcheck
+
+	assert.NoError(t, s.Set(ctx, "x", &loadr.Progress{Stage: "a", Progress: 0.5}))
+	assert.Equal(t, "a", server.DB(2).HGet(DefaultRedisPrefix+"x", "stage"))
+	assert.False(t, server.Exists(DefaultRedisPrefix+"x"), "the configured database is selected")
+}
+
+func TestRedisStore_SetAndPush(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	sender := channels.New(channels.RedisConfig{Address: server.Addr()})
+	defer sender.Close() // nolint: errcheck
+	receiver := channels.New(channels.RedisConfig{Address: server.Addr()})
+	defer receiver.Close() // nolint: errcheck
+	for _, c := range []loadr.Channel{sender, receiver} {
+		go func(c loadr.Channel) {
+			for range c.Errors() {
+			}
+		}(c)
+	}
+	assert.Eventually(t, func() bool { return server.PubSubNumPat() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	s, err := New(RedisConfig{Pool: channels.RedisPool(sender), Publisher: channels.RedisPublisher(sender)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	progress := loadr.MetaProgress{Token: "x", Progress: loadr.Progress{Stage: "a", Progress: 1}}
+	assert.NoError(t, s.(loadr.Pusher).SetAndPush(ctx, progress))
+
+	p, err := s.Get(ctx, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, &progress.Progress, p)
+	assert.Equal(t, time.Duration(0), server.TTL(DefaultRedisPrefix+"x"))
+
+	// Delivered to the local clients and published to the other nodes
+	for _, c := range []loadr.Channel{sender, receiver} {
+		select {
+		case p := <-c.Progresses():
+			assert.Equal(t, progress, p)
+		case <-time.After(time.Second):
+			t.Fatal("progress not pushed")
+		}
+	}
+}
@@ -6,6 +6,16 @@ func New(config interface{}) (loadr.Store, error) {
 	switch c := config.(type) {
 	case MongoConfig:
 		return newMongoStore(&c)
+	case PostgresConfig:
+		return newPostgresStore(&c)
+	case BoltConfig:
+		return newBoltStore(&c)
+	case CacheConfig:
+		return newCache(&c)
+	case WriteBehindConfig:
+		return newWriteBehind(&c)
+	case RedisConfig:
+		return newRedisStore(&c)
 	default:
 		return newInMemoryStore()
 	}
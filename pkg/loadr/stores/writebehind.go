@@ -0,0 +1,291 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+)
+
+// Write-behind defaults
+const (
+	DefaultWriteBehindInterval  = time.Second
+	DefaultWriteBehindBatchSize = 100
+	DefaultWriteBehindTimeout   = 10 * time.Second
+)
+
+// WriteBehindConfig for a store saving progresses set below the Storage guarantee
+// in the background. Only the latest progress of a token is kept until it is
+// flushed, in batches, at an interval or once BatchSize tokens are pending.
+// Progresses set with the Storage guarantee are saved right away.
+type WriteBehindConfig struct {
+	// Store config of the store written to
+	Store interface{}
+	// Interval between flushes
+	Interval time.Duration
+	// BatchSize of the flushes, a flush starts as soon as as many tokens are pending
+	BatchSize int
+	// Timeout of a batch
+	Timeout time.Duration
+}
+
+// batchSetter is implemented by stores saving several progresses in a single round trip
+type batchSetter interface {
+	SetMany(context.Context, []loadr.MetaProgress) error
+}
+
+type writeBehind struct {
+	store  loadr.Store
+	config WriteBehindConfig
+	lock   sync.Mutex
+	// pending progresses, the latest of each token
+	pending map[loadr.Token]loadr.Progress
+	// flushing progresses, read until they are saved
+	flushing map[loadr.Token]loadr.Progress
+	// flushLock orders flushes with writes going straight to the store
+	flushLock sync.Mutex
+	full      chan struct{}
+	errors    chan error
+	done      chan struct{}
+	stopped   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func (w *writeBehind) Get(ctx context.Context, token loadr.Token) (*loadr.Progress, error) {
+	w.lock.Lock()
+	p, ok := w.pending[token]
+	if !ok {
+		p, ok = w.flushing[token]
+	}
+	w.lock.Unlock()
+	if ok {
+		return &p, nil
+	}
+	return w.store.Get(ctx, token)
+}
+
+func (w *writeBehind) Set(ctx context.Context, token loadr.Token, progress *loadr.Progress) error {
+	if loadr.GuaranteeOf(ctx) >= loadr.Storage {
+		w.flushLock.Lock()
+		defer w.flushLock.Unlock()
+		w.lock.Lock()
+		delete(w.pending, token)
+		w.lock.Unlock()
+		return w.store.Set(ctx, token, progress)
+	}
+
+	w.lock.Lock()
+	w.pending[token] = *progress
+	full := len(w.pending) >= w.config.BatchSize
+	w.lock.Unlock()
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (w *writeBehind) Delete(ctx context.Context, token loadr.Token) error {
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+	w.lock.Lock()
+	delete(w.pending, token)
+	w.lock.Unlock()
+	return w.store.Delete(ctx, token)
+}
+
+// versionedWriteBehind writes behind to a store keeping versions
+type versionedWriteBehind struct {
+	*writeBehind
+	versioned loadr.VersionedStore
+}
+
+// GetVersion of a token, flushing it first if it is pending
+func (w *versionedWriteBehind) GetVersion(ctx context.Context, token loadr.Token) (*loadr.Progress, loadr.Version, error) {
+	w.lock.Lock()
+	_, pending := w.pending[token]
+	w.lock.Unlock()
+	if pending {
+		if err := w.flush(ctx); err != nil {
+			return nil, loadr.NoVersion, err
+		}
+	}
+	return w.versioned.GetVersion(ctx, token)
+}
+
+// SetIfVersion right away, once the pending progresses are flushed so the version is current
+func (w *versionedWriteBehind) SetIfVersion(ctx context.Context, token loadr.Token, progress *loadr.Progress, version loadr.Version) (loadr.Version, error) {
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+	if err := w.flushLocked(ctx); err != nil {
+		return loadr.NoVersion, err
+	}
+	return w.versioned.SetIfVersion(ctx, token, progress, version)
+}
+
+// Errors flushing progresses
+func (w *writeBehind) Errors() <-chan error {
+	return w.errors
+}
+
+// Close flushes the pending progresses and closes the store written to
+func (w *writeBehind) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.stopped.Wait()
+
+		ctx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+		defer cancel()
+		err = w.flush(ctx)
+		if closer, ok := w.store.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
+		}
+	})
+	return err
+}
+
+// run flushes until closed
+func (w *writeBehind) run() {
+	defer w.stopped.Done()
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.full:
+		}
+		if err := w.flushWithTimeout(); err != nil {
+			select {
+			case w.errors <- err:
+			case <-w.done:
+			}
+		}
+	}
+}
+
+func (w *writeBehind) flushWithTimeout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.Timeout)
+	defer cancel()
+	return w.flush(ctx)
+}
+
+// flush the pending progresses in batches. Failed batches are pending again,
+// unless their tokens were set meanwhile.
+func (w *writeBehind) flush(ctx context.Context) error {
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+	return w.flushLocked(ctx)
+}
+
+// flushLocked flushes, must hold the flush lock
+func (w *writeBehind) flushLocked(ctx context.Context) error {
+	for {
+		batch := w.take()
+		if len(batch) == 0 {
+			return nil
+		}
+		err := w.write(ctx, batch)
+
+		w.lock.Lock()
+		w.flushing = nil
+		if err != nil {
+			for _, p := range batch {
+				if _, ok := w.pending[p.Token]; !ok {
+					w.pending[p.Token] = p.Progress
+				}
+			}
+		}
+		w.lock.Unlock()
+
+		if err != nil {
+			return &loadr.Error{
+				Code:    loadr.FlushError,
+				Message: fmt.Sprintf("error saving %d progresses: %s", len(batch), err),
+				Err:     err,
+			}
+		}
+	}
+}
+
+// take a batch of pending progresses
+func (w *writeBehind) take() []loadr.MetaProgress {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	batch := make([]loadr.MetaProgress, 0, w.config.BatchSize)
+	w.flushing = make(map[loadr.Token]loadr.Progress)
+	for token, p := range w.pending {
+		if len(batch) == w.config.BatchSize {
+			break
+		}
+		batch = append(batch, loadr.MetaProgress{Token: token, Progress: p})
+		w.flushing[token] = p
+		delete(w.pending, token)
+	}
+	return batch
+}
+
+func (w *writeBehind) write(ctx context.Context, batch []loadr.MetaProgress) error {
+	if setter, ok := w.store.(batchSetter); ok {
+		return setter.SetMany(ctx, batch)
+	}
+	for i := range batch {
+		if err := w.store.Set(ctx, batch[i].Token, &batch[i].Progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *WriteBehindConfig) setDefaults() {
+	if c.Interval <= 0 {
+		c.Interval = DefaultWriteBehindInterval
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = DefaultWriteBehindBatchSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultWriteBehindTimeout
+	}
+}
+
+func newWriteBehind(config *WriteBehindConfig) (loadr.Store, error) {
+	store, err := New(config.Store)
+	if err != nil {
+		return nil, err
+	}
+	return writeBehindStore(startWriteBehind(store, config)), nil
+}
+
+// writeBehindStore keeping versions only when the store written to does
+func writeBehindStore(w *writeBehind) loadr.Store {
+	if versioned, ok := w.store.(loadr.VersionedStore); ok {
+		return &versionedWriteBehind{writeBehind: w, versioned: versioned}
+	}
+	return w
+}
+
+// startWriteBehind in front of a store
+func startWriteBehind(store loadr.Store, config *WriteBehindConfig) *writeBehind {
+	config.setDefaults()
+	w := &writeBehind{
+		store:   store,
+		config:  *config,
+		pending: make(map[loadr.Token]loadr.Progress),
+		full:    make(chan struct{}, 1),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+	}
+	w.stopped.Add(1)
+	go w.run()
+	return w
+}
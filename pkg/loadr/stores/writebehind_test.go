@@ -0,0 +1,115 @@
+package stores
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStore counts the progresses set and fails while failing is set
+type countingStore struct {
+	loadr.Store
+	lock    sync.Mutex
+	sets    int
+	failing bool
+}
+
+func (s *countingStore) Set(ctx context.Context, token loadr.Token, progress *loadr.Progress) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.failing {
+		return errors.New("unavailable")
+	}
+	s.sets++
+	return s.Store.Set(ctx, token, progress)
+}
+
+func (s *countingStore) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sets
+}
+
+func newTestWriteBehind(config WriteBehindConfig) (*writeBehind, *countingStore) {
+	store, _ := newInMemoryStore()
+	counting := &countingStore{Store: store}
+	return startWriteBehind(counting, &config), counting
+}
+
+func TestWriteBehind(t *testing.T) {
+	w, counting := newTestWriteBehind(WriteBehindConfig{Interval: time.Hour, BatchSize: 2})
+	background := loadr.WithGuarantee(context.Background(), 0)
+
+	// Only the latest progress of a token is saved, once the batch is full
+	assert.NoError(t, w.Set(background, "x", &loadr.Progress{Stage: "a"}))
+	assert.NoError(t, w.Set(background, "x", &loadr.Progress{Stage: "b"}))
+	p, err := w.Get(background, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, "b", p.Stage)
+	assert.Equal(t, 0, counting.count())
+
+	assert.NoError(t, w.Set(background, "y", &loadr.Progress{Stage: "a"}))
+	assert.Eventually(t, func() bool { return counting.count() == 2 }, time.Second, time.Millisecond)
+
+	// Storage progresses are saved right away
+	assert.NoError(t, w.Set(context.Background(), "z", &loadr.Progress{Stage: "a"}))
+	assert.Equal(t, 3, counting.count())
+
+	// Deletes drop pending progresses
+	assert.NoError(t, w.Set(background, "x", &loadr.Progress{Stage: "c"}))
+	assert.NoError(t, w.Delete(background, "x"))
+	_, err = w.Get(background, "x")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+
+	// Pending progresses are flushed on close
+	assert.NoError(t, w.Set(background, "w", &loadr.Progress{Stage: "a"}))
+	assert.NoError(t, w.Close())
+	assert.Equal(t, 4, counting.count())
+	p, err = counting.Get(background, "w")
+	assert.NoError(t, err)
+	assert.Equal(t, "a", p.Stage)
+}
+
+func TestWriteBehind_Errors(t *testing.T) {
+	w, counting := newTestWriteBehind(WriteBehindConfig{Interval: 10 * time.Millisecond})
+	defer w.Close() // nolint: errcheck
+	background := loadr.WithGuarantee(context.Background(), 0)
+
+	counting.lock.Lock()
+	counting.failing = true
+	counting.lock.Unlock()
+	assert.NoError(t, w.Set(background, "x", &loadr.Progress{Stage: "a"}))
+
+	select {
+	case err := <-w.Errors():
+		assert.ErrorIs(t, err, &loadr.Error{Code: loadr.FlushError})
+	case <-time.After(time.Second):
+		t.Fatal("flush failure not reported")
+	}
+
+	// Failed progresses are retried
+	counting.lock.Lock()
+	counting.failing = false
+	counting.lock.Unlock()
+	assert.Eventually(t, func() bool { return counting.count() == 1 }, time.Second, time.Millisecond)
+}
+
+func TestWriteBehind_Versions(t *testing.T) {
+	// Stores without versions don't get any by being written behind
+	w, _ := newTestWriteBehind(WriteBehindConfig{Interval: time.Hour})
+	defer w.Close() // nolint: errcheck
+	_, ok := writeBehindStore(w).(loadr.VersionedStore)
+	assert.False(t, ok)
+
+	s, err := New(WriteBehindConfig{})
+	assert.NoError(t, err)
+	defer s.(io.Closer).Close() // nolint: errcheck
+	_, ok = s.(loadr.VersionedStore)
+	assert.True(t, ok)
+}
@@ -0,0 +1,272 @@
+// Package storetest runs a standard behavioral suite against loadr.Store
+// implementations. Optional interfaces, Lister and VersionedStore, are tested
+// when a store implements them.
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory makes the store tested by a test. Stores may share their data between
+// tests, every test uses tokens of its own.
+type Factory func(t *testing.T) loadr.Store
+
+// run of the suite, tokens are unique to it
+var run int64
+
+// Run the suite against the stores made by factory
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, loadr.Store, loadr.Token)
+	}{
+		{"NotFound", testNotFound},
+		{"SetGet", testSetGet},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"Copies", testCopies},
+		{"Concurrency", testConcurrency},
+		{"List", testList},
+		{"Versions", testVersions},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			s := factory(t)
+			test.test(t, s, uniquePrefix(test.name))
+			expectNoErrors(t, s)
+			if closer, ok := s.(io.Closer); ok {
+				assert.NoError(t, closer.Close(), "closing the store")
+			}
+		})
+	}
+	// Closes the store itself
+	t.Run("Close", func(t *testing.T) {
+		testClose(t, factory(t), uniquePrefix("Close"))
+	})
+}
+
+// uniquePrefix of the tokens of a test
+func uniquePrefix(name string) loadr.Token {
+	return loadr.Token(fmt.Sprintf("storetest-%d-%d-%s/", time.Now().UnixNano(), atomic.AddInt64(&run, 1), name))
+}
+
+func testNotFound(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	p, err := s.Get(context.Background(), prefix+"missing")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+	assert.Nil(t, p)
+}
+
+func testSetGet(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	ctx := context.Background()
+	progress := &loadr.Progress{Stage: "a", Progress: 0.25}
+	require.NoError(t, s.Set(ctx, prefix+"x", progress))
+
+	p, err := s.Get(ctx, prefix+"x")
+	require.NoError(t, err)
+	assert.Equal(t, progress, p)
+}
+
+func testOverwrite(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	ctx := context.Background()
+	require.NoError(t, s.Set(ctx, prefix+"x", &loadr.Progress{Stage: "a", Progress: 0.25}))
+	require.NoError(t, s.Set(ctx, prefix+"x", &loadr.Progress{Stage: "b", Progress: 1}))
+
+	p, err := s.Get(ctx, prefix+"x")
+	require.NoError(t, err)
+	assert.Equal(t, &loadr.Progress{Stage: "b", Progress: 1}, p)
+}
+
+func testDelete(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	ctx := context.Background()
+	require.NoError(t, s.Set(ctx, prefix+"x", &loadr.Progress{Stage: "a"}))
+	require.NoError(t, s.Set(ctx, prefix+"y", &loadr.Progress{Stage: "a"}))
+	require.NoError(t, s.Delete(ctx, prefix+"x"))
+
+	_, err := s.Get(ctx, prefix+"x")
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+	_, err = s.Get(ctx, prefix+"y")
+	assert.NoError(t, err, "deleting a token deletes only that one")
+	assert.NoError(t, s.Delete(ctx, prefix+"x"), "deleting an unknown token is not an error")
+}
+
+// testCopies checks that stores don't keep the progresses they are given or hand out
+func testCopies(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	ctx := context.Background()
+	progress := &loadr.Progress{Stage: "a", Progress: 0.25}
+	require.NoError(t, s.Set(ctx, prefix+"x", progress))
+	progress.Stage = "changed"
+
+	p, err := s.Get(ctx, prefix+"x")
+	require.NoError(t, err)
+	assert.Equal(t, "a", p.Stage)
+	p.Stage = "changed"
+
+	p, err = s.Get(ctx, prefix+"x")
+	require.NoError(t, err)
+	assert.Equal(t, "a", p.Stage)
+}
+
+func testConcurrency(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	ctx := context.Background()
+	const workers, sets = 8, 20
+
+	var wait sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+		go func(w int) {
+			defer wait.Done()
+			own := prefix + loadr.Token(fmt.Sprintf("own-%d", w))
+			for i := 0; i < sets; i++ {
+				progress := &loadr.Progress{Stage: fmt.Sprintf("w%d", w), Progress: float32(i) / sets}
+				assert.NoError(t, s.Set(ctx, prefix+"shared", progress))
+				assert.NoError(t, s.Set(ctx, own, progress))
+				_, err := s.Get(ctx, prefix+"shared")
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wait.Wait()
+
+	for w := 0; w < workers; w++ {
+		p, err := s.Get(ctx, prefix+loadr.Token(fmt.Sprintf("own-%d", w)))
+		require.NoError(t, err)
+		assert.Equal(t, &loadr.Progress{Stage: fmt.Sprintf("w%d", w), Progress: float32(sets-1) / sets}, p, "a worker's last write wins")
+	}
+	p, err := s.Get(ctx, prefix+"shared")
+	require.NoError(t, err)
+	assert.Equal(t, float32(sets-1)/sets, p.Progress, "the shared token holds one of the last writes")
+}
+
+func testList(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	lister, ok := s.(loadr.Lister)
+	if !ok {
+		t.Skipf("%T doesn't list progresses", s)
+	}
+	ctx := context.Background()
+	progress := loadr.Progress{Stage: "a", Progress: 0.5}
+	for _, token := range []loadr.Token{"b/2", "a", "b/1", "b%_*?[", "c"} {
+		require.NoError(t, s.Set(ctx, prefix+token, &progress))
+	}
+	require.NoError(t, s.Set(ctx, prefix[:len(prefix)-1]+"-other/b/3", &progress))
+
+	list, err := lister.List(ctx, prefix+"b")
+	require.NoError(t, err)
+	assert.Equal(t, []loadr.MetaProgress{
+		{Token: prefix + "b%_*?[", Progress: progress},
+		{Token: prefix + "b/1", Progress: progress},
+		{Token: prefix + "b/2", Progress: progress},
+	}, list, "progresses starting with the prefix, ordered by token")
+
+	list, err = lister.List(ctx, prefix+"missing")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func testVersions(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	versioned, ok := s.(loadr.VersionedStore)
+	if !ok {
+		t.Skipf("%T doesn't keep versions", s)
+	}
+	ctx := context.Background()
+	token := prefix + "x"
+	a, b := &loadr.Progress{Stage: "a"}, &loadr.Progress{Stage: "b"}
+
+	_, err := versioned.SetIfVersion(ctx, token, a, loadr.AnyVersion)
+	assert.ErrorIs(t, err, loadr.ErrConflict, "updates need the progress")
+	created, err := versioned.SetIfVersion(ctx, token, a, loadr.NoVersion)
+	require.NoError(t, err)
+	_, err = versioned.SetIfVersion(ctx, token, b, loadr.NoVersion)
+	assert.ErrorIs(t, err, loadr.ErrConflict, "creates need no progress")
+
+	p, version, err := versioned.GetVersion(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, a, p)
+	assert.Equal(t, created, version)
+
+	updated, err := versioned.SetIfVersion(ctx, token, b, created)
+	require.NoError(t, err)
+	assert.NotEqual(t, created, updated)
+	_, err = versioned.SetIfVersion(ctx, token, a, created)
+	assert.ErrorIs(t, err, loadr.ErrConflict, "stale versions don't match")
+
+	require.NoError(t, s.Set(ctx, token, a))
+	_, version, err = versioned.GetVersion(ctx, token)
+	require.NoError(t, err)
+	assert.NotEqual(t, updated, version, "unconditional sets move the version too")
+
+	updated, err = versioned.SetIfVersion(ctx, token, b, loadr.AnyVersion)
+	require.NoError(t, err)
+	p, version, err = versioned.GetVersion(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, b, p)
+	assert.Equal(t, updated, version)
+
+	// Concurrent updates at the same version, only one wins
+	var wins int32
+	var wait sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := versioned.SetIfVersion(ctx, token, a, updated); err == nil {
+				atomic.AddInt32(&wins, 1)
+			} else {
+				assert.ErrorIs(t, err, loadr.ErrConflict)
+			}
+		}()
+	}
+	wait.Wait()
+	assert.Equal(t, int32(1), wins, "one update wins at a version")
+
+	require.NoError(t, s.Delete(ctx, token))
+	_, _, err = versioned.GetVersion(ctx, token)
+	assert.ErrorIs(t, err, loadr.ErrNotFound)
+	created, err = versioned.SetIfVersion(ctx, token, a, loadr.NoVersion)
+	require.NoError(t, err)
+	assert.Equal(t, loadr.Version(1), created, "versions restart once a progress is deleted")
+}
+
+// testClose twice, as owners sharing a store may. The second one may fail but not panic or hang.
+func testClose(t *testing.T, s loadr.Store, prefix loadr.Token) {
+	closer, ok := s.(io.Closer)
+	if !ok {
+		t.Skip("store can't be closed")
+	}
+	require.NoError(t, s.Set(context.Background(), prefix+"x", &loadr.Progress{Stage: "a", Progress: 0.5}))
+	assert.NoError(t, closer.Close(), "closing the store")
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		assert.NotPanics(t, func() { _ = closer.Close() }, "closing the store again")
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the store again hung")
+	}
+}
+
+// expectNoErrors reported in the background by stores that report any
+func expectNoErrors(t *testing.T, s loadr.Store) {
+	provider, ok := s.(loadr.ErrorProvider)
+	if !ok {
+		return
+	}
+	select {
+	case err := <-provider.Errors():
+		t.Errorf("unexpected store error: %s", err)
+	default:
+	}
+}
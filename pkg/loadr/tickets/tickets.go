@@ -0,0 +1,117 @@
+package tickets
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+)
+
+// MinSecretLength of the HMAC secret, shorter ones could be brute forced from a ticket
+const MinSecretLength = 32
+
+// DefaultTTL used when issuing a ticket without an explicit lifetime
+const DefaultTTL = time.Minute
+
+// Claims carried by a subscription ticket
+type Claims struct {
+	Tenant  loadr.Tenant `json:"ten,omitempty"`
+	Scope   loadr.Token  `json:"scp"`
+	Prefix  bool         `json:"pfx,omitempty"`
+	Expires int64        `json:"exp"`
+}
+
+// Allows reports whether the claims grant access to a token
+func (c *Claims) Allows(token loadr.Token) bool {
+	if c.Prefix {
+		return strings.HasPrefix(string(token), string(c.Scope))
+	}
+	return c.Scope == token
+}
+
+type signer struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// Issue a ticket for a tenant's token, or for every token starting with it when prefix is set
+func (s *signer) Issue(tenant loadr.Tenant, scope loadr.Token, prefix bool, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	expires := s.now().Add(ttl)
+	payload, err := json.Marshal(&Claims{Tenant: tenant, Scope: scope, Prefix: prefix, Expires: expires.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + s.sign(encoded), expires, nil
+}
+
+// Verify that a ticket is authentic, not expired and grants access to the token
+func (s *signer) Verify(ticket string, token loadr.Token) (loadr.Tenant, error) {
+	claims, err := s.parse(ticket)
+	if err != nil {
+		return "", err
+	}
+	if s.now().Unix() >= claims.Expires {
+		return "", &loadr.Error{Code: loadr.TicketExpiredError, Message: "ticket expired"}
+	}
+	if !claims.Allows(token) {
+		return "", &loadr.Error{
+			Code:    loadr.TicketScopeError,
+			Message: fmt.Sprintf("ticket does not grant access to token '%s'", token),
+		}
+	}
+
+	return claims.Tenant, nil
+}
+
+func (s *signer) parse(ticket string) (*Claims, error) {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 2 {
+		return nil, invalid("malformed ticket")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return nil, invalid("bad ticket signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid(fmt.Sprintf("error decoding ticket: %s", err))
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, invalid(fmt.Sprintf("error unmarshalling ticket: %s", err))
+	}
+
+	return claims, nil
+}
+
+func (s *signer) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload)) // nolint: errcheck
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func invalid(message string) error {
+	return &loadr.Error{Code: loadr.TicketInvalidError, Message: message}
+}
+
+// New signer that issues and verifies tickets with a shared HMAC secret.
+// Backend workers can use it offline to hand out tickets without calling loadr.
+// The secret must be at least MinSecretLength bytes.
+func New(secret []byte) (loadr.TicketSigner, error) {
+	if len(secret) < MinSecretLength {
+		return nil, fmt.Errorf("ticket secret must be at least %d bytes, got %d", MinSecretLength, len(secret))
+	}
+	return &signer{
+		secret: secret,
+		now:    time.Now,
+	}, nil
+}
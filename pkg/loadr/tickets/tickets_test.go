@@ -0,0 +1,88 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sinea/loadr/pkg/loadr"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	secret = "0123456789abcdef0123456789abcdef"
+	other  = "fedcba9876543210fedcba9876543210"
+)
+
+func newSigner(t *testing.T, key string) loadr.TicketSigner {
+	t.Helper()
+	s, err := New([]byte(key))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return s
+}
+
+// expectRejected ticket: no tenant and an error with the code
+func expectRejected(t *testing.T, tenant loadr.Tenant, err error, code uint) {
+	t.Helper()
+	assert.Equal(t, loadr.Tenant(""), tenant, "rejected tickets grant no tenant")
+	if assert.IsType(t, &loadr.Error{}, err) {
+		assert.Equal(t, code, err.(*loadr.Error).Code, err.Error())
+	}
+}
+
+func TestSigner_IssueAndVerify(t *testing.T) {
+	s := newSigner(t, secret)
+	ticket, _, err := s.Issue("acme", "x", false, time.Minute)
+	assert.NoError(t, err)
+
+	tenant, err := s.Verify(ticket, "x")
+	assert.NoError(t, err)
+	assert.Equal(t, loadr.Tenant("acme"), tenant)
+
+	tenant, err = s.Verify(ticket, "xy")
+	expectRejected(t, tenant, err, loadr.TicketScopeError)
+}
+
+func TestSigner_VerifyPrefix(t *testing.T) {
+	s := newSigner(t, secret)
+	ticket, _, err := s.Issue("", "jobs-", true, time.Minute)
+	assert.NoError(t, err)
+
+	tenant, err := s.Verify(ticket, "jobs-1")
+	assert.NoError(t, err)
+	assert.Equal(t, loadr.Tenant(""), tenant)
+
+	tenant, err = s.Verify(ticket, "other-1")
+	expectRejected(t, tenant, err, loadr.TicketScopeError)
+}
+
+func TestSigner_VerifyExpired(t *testing.T) {
+	s := &signer{secret: []byte(secret), now: time.Now}
+	ticket, _, err := s.Issue("acme", "x", false, time.Minute)
+	assert.NoError(t, err)
+
+	s.now = func() time.Time { return time.Now().Add(time.Hour) }
+	tenant, err := s.Verify(ticket, "x")
+	expectRejected(t, tenant, err, loadr.TicketExpiredError)
+}
+
+func TestSigner_VerifyForged(t *testing.T) {
+	ticket, _, err := newSigner(t, secret).Issue("acme", "x", false, time.Minute)
+	assert.NoError(t, err)
+
+	tenant, err := newSigner(t, other).Verify(ticket, "x")
+	expectRejected(t, tenant, err, loadr.TicketInvalidError)
+	tenant, err = newSigner(t, secret).Verify("garbage", "x")
+	expectRejected(t, tenant, err, loadr.TicketInvalidError)
+}
+
+func TestNew_ShortSecret(t *testing.T) {
+	for _, short := range []string{"", "secret", secret[:MinSecretLength-1]} {
+		s, err := New([]byte(short))
+		assert.Error(t, err, "secret of %d bytes", len(short))
+		assert.Nil(t, s)
+	}
+	_, err := New(nil)
+	assert.Error(t, err)
+}